@@ -41,6 +41,7 @@ import (
 	"math/rand"
 	"net/http"
 	"net/url"
+	"os"
 	"regexp"
 	"sync"
 	"sync/atomic"
@@ -59,6 +60,13 @@ import (
 
 const (
 	publicIPProvider = "http://checkip.dyndns.org/"
+	// NMDC does not provide keyprints, they are published in the MyINFO tag.
+	// This is a dctk extension, other clients do not publish nor read it
+	nmdcTagKeyprint = "KP"
+	// free mini slots are published in the MyINFO tag
+	nmdcTagMiniSlots = "MS"
+	// minimum interval between infos sent because of slot changes
+	infosSlotsInterval = 5 * time.Second
 )
 
 var rePublicIP = regexp.MustCompile("(" + protocommon.ReStrIP + ")")
@@ -101,11 +109,94 @@ type ClientConf struct {
 	// the maximum number of file to download in parallel. When this number is
 	// exceeded, the other downloads are queued and started when a slot becomes available
 	DownloadMaxParallel uint
+	// the maximum number of connections used to download in parallel from a
+	// single peer. It defaults to 1
+	MaxDownloadConnsPerPeer uint
+	// the maximum number of connections that a single peer can use to download
+	// in parallel from the client. It defaults to 3
+	MaxUploadConnsPerPeer uint
 	// the maximum number of file to upload in parallel
 	UploadMaxParallel uint
+	// the number of upload slots, among UploadMaxParallel, that can be used
+	// only by uploads allowed with UploadAllowReservedSlot by UploadPolicy
+	UploadReservedSlots uint
+	// the maximum number of mini-slots, that are used to upload file lists,
+	// tthl and small files, in addition to the normal upload slots
+	UploadMaxMiniSlots uint
+	// the maximum size of a file that can be uploaded through a mini-slot, in bytes
+	UploadMiniSlotMaxSize uint64
+	// an optional policy that decides whether incoming upload requests can be
+	// served. See UploadPolicy for details
+	UploadPolicy UploadPolicy
+	// the maximum number of peers that can wait in the upload queue when all
+	// slots are busy. Waiting peers are informed of their position, and the
+	// next available slot is assigned to the longest waiter. If zero, the
+	// queue is disabled
+	UploadQueueMaxLen uint
+	// the time after which a waiting peer that did not renew its request is
+	// removed from the upload queue. It defaults to 3 minutes
+	UploadQueueExpiry time.Duration
 
 	// set the policy regarding encryption with other peers. See EncryptionMode for options
 	PeerEncryptionMode EncryptionMode
+	// the zlib compression level used when uploading, from 1 (fastest) to
+	// 9 (best compression). It defaults to 6. Files that are already compressed
+	// are always sent uncompressed
+	PeerCompressionLevel int
+	// requires peers to use encryption and to present a certificate that
+	// matches their keyprint. Unencrypted connections and peers that do not
+	// publish a keyprint are refused. NMDC does not provide keyprints, dctk
+	// publishes them with a custom MyINFO tag, therefore in NMDC only dctk
+	// peers behind hubs that do not hide tags can be validated
+	PeerEncryptionStrict bool
+	// the time after which a peer connection that is not transferring anything
+	// is closed. Connections waiting for a queued download are kept open.
+	// It defaults to 60 seconds
+	PeerConnIdleTimeout time.Duration
+	// the maximum number of peer connections. When this number is reached,
+	// the oldest idle connection is closed to make room for a new one.
+	// It defaults to 100
+	PeerConnMax uint
+	// the maximum number of incoming peer connections from a single ip.
+	// It defaults to 5
+	PeerConnMaxPerIP uint
+
+	// rules that decide which files and directories are shared, applied to
+	// every shared directory. See ShareRules for options
+	ShareRules ShareRules
+	// the share profile of the hub, used for peers without a profile. Its file
+	// count and size are sent to the hub. If it is not defined, the profile
+	// with empty name is used. See ShareProfileSet() for details
+	ShareProfile string
+	// (optional) a function that returns the share profile of a peer. If it
+	// returns an empty string or a profile that is not defined, the profile
+	// of the hub is used
+	SharePeerProfile func(p *Peer) string
+	// the number of files that are hashed in parallel when indexing the share.
+	// It defaults to 2
+	ShareHashWorkers uint
+	// the maximum speed at which shared files are read when hashing them, in
+	// bytes/sec, in order not to slow down uploads. If zero, it is unlimited
+	ShareHashMaxSpeed uint
+	// watch shared directories and index them again as soon as files are
+	// added, removed or modified (Linux only)
+	ShareWatch bool
+	// (optional) the path of a file in which the TTH of shared files are
+	// stored, in order to avoid hashing the whole share again after a
+	// restart. Files are hashed again only if their size, modification time
+	// or inode change. TTH leaves are stored in a directory with the same
+	// path and the .leaves suffix, and are loaded only when requested by peers
+	HashDBPath string
+	// the maximum depth of the TTH trees sent to peers. Leaves are reduced to
+	// at most 2^depth hashes, in order to keep responses small.
+	// It defaults to 10
+	ShareTTHLDepth uint
+
+	// (optional) a directory where file lists downloaded with GetFileList()
+	// are cached. Lists are identified by the peer CID (ADC) or nick (NMDC)
+	// and by the peer share size, and are downloaded again when the share
+	// size changes
+	FileListCacheDir string
 
 	// The hub url in the format protocol://address:port
 	// supported protocols are adc, adcs, nmdc and nmdcs
@@ -161,8 +252,12 @@ type Client struct {
 	hubSolvedIP        string
 	ip                 string
 	shareIndexer       *shareIndexer
-	shareRoots         map[string]string
+	shareRoots         map[string]*shareRoot
 	shareTree          map[string]*shareDirectory
+	shareIndex         *shareIndex
+	shareProfileDefs   map[string][]string
+	shareProfiles      map[string]*shareProfile
+	shareProfileWarned map[string]struct{}
 	shareCount         uint
 	shareSize          uint64
 	fileList           []byte
@@ -174,19 +269,38 @@ type Client struct {
 	privateID             atypes.PID
 	clientID              atypes.CID
 	adcSessionID          atypes.SID
-	adcFingerprint        string
+	tlsCert               tls.Certificate
+	fingerprint           string
 	peers                 map[string]*Peer
 	downloadSlotAvail     uint
 	uploadSlotAvail       uint
+	uploadMiniSlotAvail   uint
+	uploadReservedUsed    uint
+	uploadGrantedSlots    map[string]time.Time
+	uploadQueue           []*uploadQueueEntry
+	uploadStats           UploadStats
+	infosSlotsFree        uint
+	infosMiniSlotsFree    uint
+	infosSentAt           time.Time
+	infosTimer            *time.Timer
 	peerConns             map[*peerConn]struct{}
-	peerConnsByKey        map[nickDirectionPair]*peerConn
+	peerConnsByKey        map[peerConnKey]*peerConn
+	peerConnStats         PeerConnStats
 	transfers             map[transfer]struct{}
-	activeDownloadsByPeer map[string]*Download
+	activeDownloadsByPeer map[string]map[*Download]struct{}
 
 	// OnInitialized is called just after client initialization, before connecting to the hub
 	OnInitialized func()
 	// OnShareIndexed is called every time the share indexer has finished indexing the client share
 	OnShareIndexed func()
+	// OnShareIndexError is called when a file or directory of the share cannot
+	// be indexed, and is therefore skipped. fpath is the path on disk, or the
+	// path in the share (/alias/dir/name) for entries of a ShareProvider, and is
+	// empty if the error is not related to a specific file
+	OnShareIndexError func(fpath string, err error)
+	// OnShareIndexProgress is called periodically while the share indexer is
+	// hashing new or modified files
+	OnShareIndexProgress func(p ShareIndexProgress)
 	// OnHubConnected is called when the connection between client and hub has been established
 	OnHubConnected func()
 	// OnHubError is called when a critical error happens
@@ -197,6 +311,9 @@ type Client struct {
 	OnHubTLS func(st tls.ConnectionState)
 	// OnHubProto is called when a protocol for the hub is selected
 	OnHubProto func(proto string)
+	// OnPeerTLS is called when a TLS connection with a peer is established and
+	// the peer has been identified
+	OnPeerTLS func(p *Peer, st tls.ConnectionState)
 	// OnPeerConnected is called when a peer connects to the hub
 	OnPeerConnected func(p *Peer)
 	// OnPeerUpdated is called when a peer has just updated its informations
@@ -229,15 +346,60 @@ func NewClient(conf ClientConf) (*Client, error) {
 	if !conf.IsPassive && conf.PeerEncryptionMode != DisableEncryption && conf.TLSPort == 0 {
 		return nil, fmt.Errorf("tcp tls port must be set when in active mode and encryption is on")
 	}
+	if conf.PeerEncryptionStrict && conf.PeerEncryptionMode == DisableEncryption {
+		return nil, fmt.Errorf("strict encryption requires encryption to be enabled")
+	}
 	if conf.TCPPort != 0 && conf.TCPPort == conf.TLSPort {
 		return nil, fmt.Errorf("tcp port and tcp tls port cannot be the same")
 	}
 	if conf.DownloadMaxParallel == 0 {
 		conf.DownloadMaxParallel = 6
 	}
+	if conf.MaxDownloadConnsPerPeer == 0 {
+		conf.MaxDownloadConnsPerPeer = 1
+	}
+	if conf.MaxUploadConnsPerPeer == 0 {
+		conf.MaxUploadConnsPerPeer = 3
+	}
 	if conf.UploadMaxParallel == 0 {
 		conf.UploadMaxParallel = 10
 	}
+	if conf.UploadReservedSlots > conf.UploadMaxParallel {
+		return nil, fmt.Errorf("reserved upload slots cannot exceed upload slots")
+	}
+	if conf.UploadMaxMiniSlots == 0 {
+		conf.UploadMaxMiniSlots = 3
+	}
+	if conf.UploadMiniSlotMaxSize == 0 {
+		conf.UploadMiniSlotMaxSize = 64 * 1024
+	}
+	if conf.UploadQueueExpiry == 0 {
+		conf.UploadQueueExpiry = 3 * time.Minute
+	}
+	if conf.PeerCompressionLevel == 0 {
+		conf.PeerCompressionLevel = 6
+	}
+	if conf.PeerCompressionLevel < 1 || conf.PeerCompressionLevel > 9 {
+		return nil, fmt.Errorf("peer compression level must be between 1 and 9")
+	}
+	if conf.PeerConnIdleTimeout == 0 {
+		conf.PeerConnIdleTimeout = 60 * time.Second
+	}
+	if conf.PeerConnMax == 0 {
+		conf.PeerConnMax = 100
+	}
+	if conf.PeerConnMaxPerIP == 0 {
+		conf.PeerConnMaxPerIP = 5
+	}
+	if err := conf.ShareRules.validate(); err != nil {
+		return nil, err
+	}
+	if conf.ShareHashWorkers == 0 {
+		conf.ShareHashWorkers = 2
+	}
+	if conf.ShareTTHLDepth == 0 {
+		conf.ShareTTHLDepth = 10
+	}
 	if conf.HubConnTries == 0 {
 		conf.HubConnTries = 3
 	}
@@ -260,6 +422,12 @@ func NewClient(conf ClientConf) (*Client, error) {
 		conf.ListGenerator = "DC++ 0.868" // verified
 	}
 
+	if conf.FileListCacheDir != "" {
+		if err := os.MkdirAll(conf.FileListCacheDir, 0o755); err != nil {
+			return nil, fmt.Errorf("unable to create file list cache directory: %s", err)
+		}
+	}
+
 	u, err := url.Parse(conf.HubURL)
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse hub url")
@@ -295,15 +463,21 @@ func NewClient(conf ClientConf) (*Client, error) {
 		hubIsEncrypted:        u.Scheme == "adcs" || u.Scheme == "nmdcs",
 		hubHostname:           u.Hostname(),
 		hubPort:               atoui(u.Port()),
-		shareRoots:            make(map[string]string),
+		shareRoots:            make(map[string]*shareRoot),
 		shareTree:             make(map[string]*shareDirectory),
+		shareIndex:            newShareIndex(nil),
+		shareProfileDefs:      make(map[string][]string),
+		shareProfiles:         make(map[string]*shareProfile),
+		shareProfileWarned:    make(map[string]struct{}),
 		peers:                 make(map[string]*Peer),
 		downloadSlotAvail:     conf.DownloadMaxParallel,
 		uploadSlotAvail:       conf.UploadMaxParallel,
+		uploadMiniSlotAvail:   conf.UploadMaxMiniSlots,
+		uploadGrantedSlots:    make(map[string]time.Time),
 		peerConns:             make(map[*peerConn]struct{}),
-		peerConnsByKey:        make(map[nickDirectionPair]*peerConn),
+		peerConnsByKey:        make(map[peerConnKey]*peerConn),
 		transfers:             make(map[transfer]struct{}),
-		activeDownloadsByPeer: make(map[string]*Download),
+		activeDownloadsByPeer: make(map[string]map[*Download]struct{}),
 	}
 	if u.Scheme == "adc" || u.Scheme == "adcs" {
 		c.proto = protocolADC
@@ -320,6 +494,14 @@ func NewClient(conf ClientConf) (*Client, error) {
 	hasher.Write(c.privateID[:])
 	hasher.Sum(c.clientID[:0])
 
+	if c.conf.PeerEncryptionMode != DisableEncryption {
+		var err error
+		c.tlsCert, c.fingerprint, err = newTLSCertificate()
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if err := newHubConn(c); err != nil {
 		return nil, err
 	}
@@ -385,6 +567,11 @@ func (c *Client) Run() {
 	c.wg.Add(1)
 	go c.shareIndexer.do()
 
+	if c.shareIndexer.watcher != nil {
+		c.wg.Add(1)
+		go c.shareIndexer.watcher.do()
+	}
+
 	if c.listenerTCP != nil {
 		c.wg.Add(1)
 		go c.listenerTCP.do()
@@ -412,6 +599,10 @@ func (c *Client) Run() {
 
 	c.Safe(func() {
 		c.hubConn.close()
+		if c.infosTimer != nil {
+			c.infosTimer.Stop()
+			c.infosTimer = nil
+		}
 		for t := range c.transfers {
 			t.Close()
 		}
@@ -465,6 +656,9 @@ func (c *Client) sendInfos(firstTime bool) {
 		hubUnregisteredCount = 1
 	}
 
+	c.infosSlotsFree, c.infosMiniSlotsFree = c.advertisedSlots()
+	c.infosSentAt = time.Now()
+
 	if c.protoIsAdc() {
 		info := &adc.UserInfo{
 			Desc:           c.conf.Description,
@@ -477,6 +671,7 @@ func (c *Client) sendInfos(firstTime bool) {
 			Version:        c.conf.ClientVersion, // verified
 			MaxUpload:      numtoa(c.conf.UploadMaxSpeed),
 			Slots:          int(c.conf.UploadMaxParallel),
+			SlotsFree:      int(c.uploadPublicSlotAvail()),
 		}
 
 		info.Features = append(info.Features, adc.FeaADC0)
@@ -498,15 +693,17 @@ func (c *Client) sendInfos(firstTime bool) {
 			info.Id = c.clientID
 			info.Pid = &c.privateID
 
-			if c.conf.PeerEncryptionMode != DisableEncryption &&
-				!c.conf.IsPassive {
-				info.KP = c.adcFingerprint
+			if c.conf.PeerEncryptionMode != DisableEncryption {
+				info.KP = c.fingerprint
 			}
 		}
 
 		c.hubConn.conn.Write(&protoadc.AdcBInfos{ //nolint:govet
 			&adc.BroadcastPacket{ID: c.adcSessionID},
-			info,
+			&protoadc.AdcUserInfo{
+				UserInfo:      *info,
+				MiniSlotsFree: int(c.uploadMiniSlotAvail),
+			},
 		})
 
 	} else {
@@ -540,10 +737,57 @@ func (c *Client) sendInfos(firstTime bool) {
 			Flag:           userFlag,
 			Email:          c.conf.Email,
 			ShareSize:      c.shareSize,
+			Extra: func() map[string]string {
+				ret := make(map[string]string)
+				if c.conf.PeerEncryptionMode != DisableEncryption {
+					ret[nmdcTagKeyprint] = c.fingerprint
+				}
+				if c.uploadMiniSlotAvail > 0 {
+					ret[nmdcTagMiniSlots] = numtoa(c.uploadMiniSlotAvail)
+				}
+				return ret
+			}(),
 		})
 	}
 }
 
+// advertisedSlots returns the free slots and the free mini slots published
+// in the infos. NMDC does not publish free slots.
+func (c *Client) advertisedSlots() (uint, uint) {
+	if c.protoIsAdc() {
+		return c.uploadPublicSlotAvail(), c.uploadMiniSlotAvail
+	}
+	return 0, c.uploadMiniSlotAvail
+}
+
+// uploadSlotsChanged informs the hub about the new number of free slots.
+// Infos are sent only when the published counts change, and at most once
+// every infosSlotsInterval, in order not to flood the hub.
+func (c *Client) uploadSlotsChanged() {
+	if c.infosTimer != nil || c.hubConn.terminateRequested ||
+		c.hubConn.state != hubInitialized {
+		return
+	}
+
+	free, mini := c.advertisedSlots()
+	if free == c.infosSlotsFree && mini == c.infosMiniSlotsFree {
+		return
+	}
+
+	wait := infosSlotsInterval - time.Since(c.infosSentAt)
+	if wait <= 0 {
+		c.sendInfos(false)
+		return
+	}
+
+	c.infosTimer = time.AfterFunc(wait, func() {
+		c.Safe(func() {
+			c.infosTimer = nil
+			c.uploadSlotsChanged()
+		})
+	})
+}
+
 // Safe is used to safely execute code outside the client context. It must be
 // used when interacting with the client outside the callbacks (i.e. inside a
 // parallel goroutine).
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/aler9/dctk"
+)
+
+var (
+	diff        = kingpin.Command("diff", "Compare two file lists and print added, removed, moved and changed files.")
+	diffSummary = diff.Flag("summary", "Print only a summary of changes for each directory").Bool()
+	diffOld     = diff.Arg("old", "Path to the old file list (files.xml or files.xml.bz2)").Required().String()
+	diffNew     = diff.Arg("new", "Path to the new file list (files.xml or files.xml.bz2)").Required().String()
+)
+
+// loadFileList decodes a file list progressively, without keeping its
+// content in memory.
+func loadFileList(fpath string) (*dctk.FileList, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var flr *dctk.FileListReader
+	if strings.HasSuffix(fpath, ".bz2") {
+		flr = dctk.NewFileListReaderBzip2(f)
+	} else {
+		flr = dctk.NewFileListReader(f)
+	}
+
+	return flr.ReadAll()
+}
+
+func runDiff() {
+	a, err := loadFileList(*diffOld)
+	if err != nil {
+		panic(err)
+	}
+
+	b, err := loadFileList(*diffNew)
+	if err != nil {
+		panic(err)
+	}
+
+	res := dctk.FileListDiff(a, b)
+
+	if !*diffSummary {
+		for _, ch := range res.Changes {
+			switch ch.Type {
+			case dctk.FileListAdded:
+				fmt.Printf("+ %s (%d)\n", ch.Path, ch.New.Size)
+			case dctk.FileListRemoved:
+				fmt.Printf("- %s (%d)\n", ch.Path, ch.Old.Size)
+			case dctk.FileListMoved:
+				fmt.Printf("> %s -> %s\n", ch.OldPath, ch.Path)
+			case dctk.FileListChanged:
+				fmt.Printf("* %s (%d -> %d)\n", ch.Path, ch.Old.Size, ch.New.Size)
+			}
+		}
+		return
+	}
+
+	for _, d := range res.Dirs {
+		fmt.Printf("%s: +%d -%d >%d *%d (%+d bytes)\n",
+			d.Path, d.Added, d.Removed, d.Moved, d.Changed, d.SizeDelta)
+	}
+}
+
+func main() {
+	kingpin.CommandLine.Help = "Inspect and compare file lists."
+
+	switch kingpin.Parse() {
+	case diff.FullCommand():
+		runDiff()
+	}
+}
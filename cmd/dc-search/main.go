@@ -40,7 +40,9 @@ func main() {
 
 	client.OnInitialized = func() {
 		if *share != "" {
-			client.ShareAdd("share", *share)
+			if err := client.ShareAdd("share", *share); err != nil {
+				panic(err)
+			}
 		} else {
 			client.HubConnect()
 		}
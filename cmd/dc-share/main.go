@@ -37,7 +37,9 @@ func main() {
 	}
 
 	client.OnInitialized = func() {
-		client.ShareAdd(*alias, *share)
+		if err := client.ShareAdd(*alias, *share); err != nil {
+			panic(err)
+		}
 	}
 
 	client.OnShareIndexed = func() {
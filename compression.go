@@ -0,0 +1,113 @@
+package dctk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// files smaller than this are not worth compressing
+	compressionMinSize = 10 * 1024
+	// size of the sample used to sniff content type and compression ratio
+	compressionSampleSize = 64 * 1024
+	// compression is skipped when the sample does not shrink below this ratio
+	compressionMaxRatio = 0.9
+)
+
+// extensions of files that are already compressed
+var compressionSkipExts = map[string]struct{}{
+	".7z":   {},
+	".aac":  {},
+	".avi":  {},
+	".bz2":  {},
+	".cab":  {},
+	".docx": {},
+	".epub": {},
+	".flac": {},
+	".flv":  {},
+	".gif":  {},
+	".gz":   {},
+	".jar":  {},
+	".jpeg": {},
+	".jpg":  {},
+	".lz":   {},
+	".lzma": {},
+	".m4a":  {},
+	".m4v":  {},
+	".mkv":  {},
+	".mov":  {},
+	".mp3":  {},
+	".mp4":  {},
+	".mpeg": {},
+	".mpg":  {},
+	".odt":  {},
+	".ogg":  {},
+	".opus": {},
+	".png":  {},
+	".rar":  {},
+	".tgz":  {},
+	".webm": {},
+	".webp": {},
+	".wma":  {},
+	".wmv":  {},
+	".xlsx": {},
+	".xz":   {},
+	".zip":  {},
+	".zst":  {},
+}
+
+// content types of files that are already compressed
+var compressionSkipTypes = []string{
+	"image/",
+	"audio/",
+	"video/",
+	"font/woff",
+	"application/zip",
+	"application/x-gzip",
+	"application/x-rar-compressed",
+	"application/vnd.rar",
+	"application/x-7z-compressed",
+	"application/ogg",
+}
+
+// compressionSkipByName returns whether a file is not worth compressing,
+// given its name.
+func compressionSkipByName(fname string) bool {
+	_, ok := compressionSkipExts[strings.ToLower(filepath.Ext(fname))]
+	return ok
+}
+
+// compressionSkipByContent returns whether a file is not worth compressing,
+// given a sample of its content. The content type is sniffed first, then the
+// sample is compressed in order to compute the compression ratio.
+func compressionSkipByContent(sample []byte, level int) bool {
+	ctype := http.DetectContentType(sample)
+	for _, prefix := range compressionSkipTypes {
+		if strings.HasPrefix(ctype, prefix) {
+			return true
+		}
+	}
+
+	var buf bytes.Buffer
+	zw, err := zlib.NewWriterLevel(&buf, level)
+	if err != nil {
+		return true
+	}
+	zw.Write(sample)
+	zw.Close()
+
+	return float64(buf.Len()) > float64(len(sample))*compressionMaxRatio
+}
+
+// TransferStats contains statistics about the data exchanged by a transfer.
+type TransferStats struct {
+	// whether the content has been compressed
+	Compressed bool
+	// the size of the transferred content
+	RawBytes uint64
+	// the bytes that passed through the connection
+	WireBytes uint64
+}
@@ -1,14 +1,20 @@
 package dctk
 
 import (
+	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 
+	"github.com/aler9/go-dc/nmdc"
 	"github.com/stretchr/testify/require"
 
 	"github.com/aler9/dctk/pkg/log"
+	"github.com/aler9/dctk/pkg/protocommon"
+	"github.com/aler9/dctk/pkg/protonmdc"
 	"github.com/aler9/dctk/pkg/tiger"
 )
 
@@ -563,3 +569,554 @@ func TestDownloadTls(t *testing.T) {
 		require.True(t, ok)
 	})
 }
+
+func TestDownloadLeaves(t *testing.T) {
+	foreachExternalHub(t, "DownloadLeaves", func(t *testing.T, e *externalHub) {
+		ok := false
+
+		client1 := func() {
+			client, err := NewClient(ClientConf{
+				LogLevel:           log.LevelError,
+				HubURL:             e.URL(),
+				Nick:               "client1",
+				IP:                 dockerIP,
+				TCPPort:            3006,
+				UDPPort:            3006,
+				PeerEncryptionMode: DisableEncryption,
+				HubManualConnect:   true,
+			})
+			require.NoError(t, err)
+
+			os.RemoveAll("/tmp/testshare")
+			os.Mkdir("/tmp/testshare", 0o755)
+			ioutil.WriteFile("/tmp/testshare/test file.txt", []byte(strings.Repeat("A", 10000)), 0o644)
+
+			client.OnInitialized = func() {
+				client.ShareAdd("share", "/tmp/testshare")
+			}
+
+			client.OnShareIndexed = func() {
+				client.HubConnect()
+			}
+
+			client.Run()
+		}
+
+		client2 := func() {
+			client, err := NewClient(ClientConf{
+				LogLevel:           log.LevelError,
+				HubURL:             e.URL(),
+				Nick:               "client2",
+				IP:                 dockerIP,
+				TCPPort:            3005,
+				UDPPort:            3005,
+				PeerEncryptionMode: DisableEncryption,
+			})
+			require.NoError(t, err)
+
+			client.OnHubConnected = func() {
+				go client1()
+			}
+
+			client.OnPeerConnected = func(p *Peer) {
+				if p.Nick == "client1" {
+					client.DownloadLeaves(p, tiger.HashMust("UJUIOGYVALWRB56PRJEB6ZH3G4OLTELOEQ3UKMY"))
+				}
+			}
+
+			client.OnDownloadSuccessful = func(d *Download) {
+				require.Equal(t, 10, len(d.Leaves()))
+				require.Equal(t, tiger.HashMust("UJUIOGYVALWRB56PRJEB6ZH3G4OLTELOEQ3UKMY"), d.Leaves().TreeHash())
+				ok = true
+				client.Close()
+			}
+
+			client.Run()
+		}
+
+		client2()
+
+		require.True(t, ok)
+	})
+}
+
+func TestDownloadPartialList(t *testing.T) {
+	foreachExternalHub(t, "DownloadPartialList", func(t *testing.T, e *externalHub) {
+		ok := false
+
+		client1 := func() {
+			client, err := NewClient(ClientConf{
+				LogLevel:           log.LevelError,
+				HubURL:             e.URL(),
+				Nick:               "client1",
+				IP:                 dockerIP,
+				TCPPort:            3006,
+				UDPPort:            3006,
+				PeerEncryptionMode: DisableEncryption,
+				HubManualConnect:   true,
+			})
+			require.NoError(t, err)
+
+			os.RemoveAll("/tmp/testshare")
+			os.Mkdir("/tmp/testshare", 0o755)
+			os.Mkdir("/tmp/testshare/folder", 0o755)
+			os.Mkdir("/tmp/testshare/folder/subdir", 0o755)
+			ioutil.WriteFile("/tmp/testshare/folder/first file.txt", []byte(strings.Repeat("A", 50000)), 0o644)
+			ioutil.WriteFile("/tmp/testshare/folder/second file.txt", []byte(strings.Repeat("B", 50000)), 0o644)
+			ioutil.WriteFile("/tmp/testshare/folder/subdir/third file.txt", []byte(strings.Repeat("C", 50000)), 0o644)
+
+			client.OnInitialized = func() {
+				client.ShareAdd("share", "/tmp/testshare")
+			}
+
+			client.OnShareIndexed = func() {
+				client.HubConnect()
+			}
+
+			client.Run()
+		}
+
+		client2 := func() {
+			client, err := NewClient(ClientConf{
+				LogLevel:           log.LevelError,
+				HubURL:             e.URL(),
+				Nick:               "client2",
+				IP:                 dockerIP,
+				TCPPort:            3005,
+				UDPPort:            3005,
+				PeerEncryptionMode: DisableEncryption,
+			})
+			require.NoError(t, err)
+
+			client.OnHubConnected = func() {
+				go client1()
+			}
+
+			client.OnPeerConnected = func(p *Peer) {
+				if p.Nick == "client1" {
+					client.DownloadPartialList(p, "/share/folder", false)
+				}
+			}
+
+			recursiveDownloaded := false
+			client.OnDownloadSuccessful = func(d *Download) {
+				dir := d.PartialList()
+				require.Equal(t, "folder", dir.Name)
+				require.Equal(t, 2, len(dir.Files))
+				require.Equal(t, 1, len(dir.Dirs))
+				require.Equal(t, "subdir", dir.Dirs[0].Name)
+
+				if recursiveDownloaded == false {
+					recursiveDownloaded = true
+					require.Equal(t, true, dir.Dirs[0].Incomplete)
+					require.Equal(t, 0, len(dir.Dirs[0].Files))
+
+					client.DownloadPartialList(d.Conf().Peer, "/share/folder", true)
+
+				} else {
+					require.Equal(t, false, dir.Dirs[0].Incomplete)
+					require.Equal(t, 1, len(dir.Dirs[0].Files))
+					ok = true
+					client.Close()
+				}
+			}
+
+			client.Run()
+		}
+
+		client2()
+
+		require.True(t, ok)
+	})
+}
+
+func TestDownloadByPath(t *testing.T) {
+	foreachExternalHub(t, "DownloadByPath", func(t *testing.T, e *externalHub) {
+		ok := false
+
+		client1 := func() {
+			client, err := NewClient(ClientConf{
+				LogLevel:           log.LevelError,
+				HubURL:             e.URL(),
+				Nick:               "client1",
+				IP:                 dockerIP,
+				TCPPort:            3006,
+				UDPPort:            3006,
+				PeerEncryptionMode: DisableEncryption,
+				HubManualConnect:   true,
+			})
+			require.NoError(t, err)
+
+			os.RemoveAll("/tmp/testshare")
+			os.MkdirAll("/tmp/testshare/folder", 0o755)
+			ioutil.WriteFile("/tmp/testshare/folder/test file.txt", []byte(strings.Repeat("A", 10000)), 0o644)
+
+			client.OnInitialized = func() {
+				client.ShareAdd("share", "/tmp/testshare")
+			}
+
+			client.OnShareIndexed = func() {
+				client.HubConnect()
+			}
+
+			client.Run()
+		}
+
+		client2 := func() {
+			client, err := NewClient(ClientConf{
+				LogLevel:           log.LevelError,
+				HubURL:             e.URL(),
+				Nick:               "client2",
+				IP:                 dockerIP,
+				TCPPort:            3005,
+				UDPPort:            3005,
+				PeerEncryptionMode: DisableEncryption,
+			})
+			require.NoError(t, err)
+
+			client.OnHubConnected = func() {
+				go client1()
+			}
+
+			client.OnPeerConnected = func(p *Peer) {
+				if p.Nick == "client1" {
+					client.DownloadFile(DownloadConf{
+						Peer: p,
+						Path: "/share/folder/test file.txt",
+						TTH:  tiger.HashMust("UJUIOGYVALWRB56PRJEB6ZH3G4OLTELOEQ3UKMY"),
+					})
+				}
+			}
+
+			client.OnDownloadSuccessful = func(d *Download) {
+				require.Equal(t, strings.Repeat("A", 10000), string(d.Content()))
+				ok = true
+				client.Close()
+			}
+
+			client.Run()
+		}
+
+		client2()
+
+		require.True(t, ok)
+	})
+}
+
+func TestDownloadFileListCache(t *testing.T) {
+	foreachExternalHub(t, "DownloadFileListCache", func(t *testing.T, e *externalHub) {
+		ok := false
+
+		client1 := func() {
+			client, err := NewClient(ClientConf{
+				LogLevel:           log.LevelError,
+				HubURL:             e.URL(),
+				Nick:               "client1",
+				IP:                 dockerIP,
+				TCPPort:            3006,
+				UDPPort:            3006,
+				PeerEncryptionMode: DisableEncryption,
+				HubManualConnect:   true,
+			})
+			require.NoError(t, err)
+
+			os.RemoveAll("/tmp/testshare")
+			os.Mkdir("/tmp/testshare", 0o755)
+			ioutil.WriteFile("/tmp/testshare/test file.txt", []byte(strings.Repeat("A", 10000)), 0o644)
+
+			client.OnInitialized = func() {
+				client.ShareAdd("share", "/tmp/testshare")
+			}
+
+			client.OnShareIndexed = func() {
+				client.HubConnect()
+			}
+
+			client.Run()
+		}
+
+		client2 := func() {
+			os.RemoveAll("/tmp/testcache")
+
+			client, err := NewClient(ClientConf{
+				LogLevel:           log.LevelError,
+				HubURL:             e.URL(),
+				Nick:               "client2",
+				IP:                 dockerIP,
+				TCPPort:            3005,
+				UDPPort:            3005,
+				PeerEncryptionMode: DisableEncryption,
+				FileListCacheDir:   "/tmp/testcache",
+			})
+			require.NoError(t, err)
+
+			client.OnHubConnected = func() {
+				go client1()
+			}
+
+			client.OnPeerConnected = func(p *Peer) {
+				if p.Nick == "client1" {
+					fl, d, err := client.GetFileList(p)
+					require.NoError(t, err)
+					require.Nil(t, fl)
+					require.NotNil(t, d)
+				}
+			}
+
+			client.OnDownloadSuccessful = func(d *Download) {
+				fl, d2, err := client.GetFileList(d.Conf().Peer)
+				require.NoError(t, err)
+				require.Nil(t, d2)
+
+				// the cached list is read outside the client context
+				go func() {
+					defer fl.Close()
+					matches, err := fl.Find(func(fpath string, file *FileListFile) bool {
+						return fpath == "/share/test file.txt"
+					})
+					require.NoError(t, err)
+					require.Equal(t, 1, len(matches))
+
+					client.Safe(func() {
+						ok = true
+						client.Close()
+					})
+				}()
+			}
+
+			client.Run()
+		}
+
+		client2()
+
+		require.True(t, ok)
+	})
+}
+
+// testBlockingProvider shares a single file whose content is not returned
+// until release is closed. started is closed when the file is read.
+type testBlockingProvider struct {
+	size    uint64
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (p *testBlockingProvider) Entries() ([]ShareProviderEntry, error) {
+	return []ShareProviderEntry{{
+		Path: "big.bin",
+		Size: p.size,
+		TTH:  tiger.HashMust("LWPNACQDBZRYXW3VHJVCJ64QBZNGHOHHHZWCLNQ"),
+	}}, nil
+}
+
+func (p *testBlockingProvider) Open(fpath string) (io.ReaderAt, error) {
+	return p, nil
+}
+
+func (p *testBlockingProvider) ReadAt(b []byte, off int64) (int, error) {
+	p.once.Do(func() { close(p.started) })
+	<-p.release
+	return 0, io.EOF
+}
+
+func TestDownloadMiniSlot(t *testing.T) {
+	foreachExternalHub(t, "DownloadMiniSlot", func(t *testing.T, e *externalHub) {
+		ok := false
+
+		provider := &testBlockingProvider{
+			size:    1024 * 1024,
+			started: make(chan struct{}),
+			release: make(chan struct{}),
+		}
+		defer close(provider.release)
+
+		client1 := func() {
+			client, err := NewClient(ClientConf{
+				LogLevel:           log.LevelError,
+				HubURL:             e.URL(),
+				Nick:               "client1",
+				IP:                 dockerIP,
+				TCPPort:            3006,
+				UDPPort:            3006,
+				PeerEncryptionMode: DisableEncryption,
+				HubManualConnect:   true,
+				UploadMaxParallel:  1,
+			})
+			require.NoError(t, err)
+
+			os.RemoveAll("/tmp/testshare")
+			os.Mkdir("/tmp/testshare", 0o755)
+			ioutil.WriteFile("/tmp/testshare/test file.txt", []byte(strings.Repeat("A", 10000)), 0o644)
+
+			client.OnInitialized = func() {
+				client.ShareAdd("share", "/tmp/testshare")
+				client.ShareAddProvider("blocking", provider)
+			}
+
+			connected := false
+			client.OnShareIndexed = func() {
+				if !connected {
+					connected = true
+					client.HubConnect()
+				}
+			}
+
+			client.Run()
+		}
+
+		client2 := func() {
+			client, err := NewClient(ClientConf{
+				LogLevel:                log.LevelError,
+				HubURL:                  e.URL(),
+				Nick:                    "client2",
+				IP:                      dockerIP,
+				TCPPort:                 3005,
+				UDPPort:                 3005,
+				PeerEncryptionMode:      DisableEncryption,
+				MaxDownloadConnsPerPeer: 2,
+			})
+			require.NoError(t, err)
+
+			client.OnHubConnected = func() {
+				go client1()
+			}
+
+			client.OnPeerConnected = func(p *Peer) {
+				if p.Nick == "client1" {
+					// the only normal slot is taken by a download that does
+					// not end
+					client.DownloadFile(DownloadConf{
+						Peer: p,
+						Path: "/blocking/big.bin",
+					})
+
+					go func() {
+						<-provider.started
+						client.Safe(func() {
+							client.DownloadFileList(p, "")
+						})
+					}()
+				}
+			}
+
+			filelistDownloaded := false
+			client.OnDownloadSuccessful = func(d *Download) {
+				if !filelistDownloaded {
+					filelistDownloaded = true
+
+					// small files are served with mini slots too
+					client.DownloadFile(DownloadConf{
+						Peer: d.Conf().Peer,
+						TTH:  tiger.HashMust("UJUIOGYVALWRB56PRJEB6ZH3G4OLTELOEQ3UKMY"),
+					})
+
+				} else {
+					ok = true
+					client.Close()
+				}
+			}
+
+			client.OnDownloadError = func(d *Download) {
+				client.Close()
+			}
+
+			client.Run()
+		}
+
+		client2()
+
+		require.True(t, ok)
+	})
+}
+
+func TestDownloadLegacy(t *testing.T) {
+	content := strings.Repeat("0123456789", 3000)
+	dir := testShareDir(t, nil)
+	defer os.RemoveAll(dir)
+
+	client := testLegacyClient(t, dir)
+
+	// connection requests are sent to a fake hub
+	hubLocal, hubRemote := net.Pipe()
+	hub := protonmdc.NewConn(log.LevelError, "hub", hubRemote, true, true)
+	defer hub.Close()
+
+	results := make(chan []byte, 1)
+	client.Safe(func() {
+		client.hubConn.conn = protonmdc.NewConn(log.LevelError, "h", hubLocal, true, true)
+		client.OnDownloadSuccessful = func(d *Download) {
+			results <- d.Content()
+		}
+		client.OnDownloadError = func(d *Download) {
+			results <- nil
+		}
+	})
+
+	for _, c := range []struct {
+		name    string
+		ext     []string
+		request protocommon.MsgEncodable
+	}{
+		{
+			"get",
+			[]string{nmdc.ExtMinislots},
+			&protonmdc.NmdcGet{Filename: "share\\folder\\test file.txt", Start: 1},
+		},
+		{
+			"ugetblock",
+			[]string{nmdc.ExtMinislots, nmdc.ExtXmlBZList},
+			&protonmdc.NmdcGetBlock{Unicode: true, Length: -1, Filename: "share\\folder\\test file.txt"},
+		},
+		{
+			"ugetzblock",
+			[]string{nmdc.ExtMinislots, nmdc.ExtXmlBZList, nmdc.ExtGetZBlock},
+			&protonmdc.NmdcGetBlock{Unicode: true, Compressed: true, Length: -1,
+				Filename: "share\\folder\\test file.txt"},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			client.Safe(func() {
+				client.peers[c.name] = &Peer{Nick: c.name}
+				_, err := client.DownloadFile(DownloadConf{
+					Peer: client.peers[c.name],
+					Path: "/share/folder/test file.txt",
+				})
+				require.NoError(t, err)
+			})
+
+			msg, err := hub.Read()
+			require.NoError(t, err)
+			require.Equal(t, &nmdc.RevConnectToMe{From: "testdctk", To: c.name}, msg)
+
+			conn := testLegacyPeer(t, client, c.name, true, c.ext)
+
+			msg, err = conn.Read()
+			require.NoError(t, err)
+			require.Equal(t, c.request, msg)
+
+			compressed := false
+			if req, ok := msg.(*protonmdc.NmdcGetBlock); ok {
+				compressed = req.Compressed
+				conn.Write(&protonmdc.NmdcSending{Length: int64(len(content))})
+			} else {
+				// the download starts when Send is received
+				conn.Write(&protonmdc.NmdcFileLength{Length: uint64(len(content))})
+				msg, err = conn.Read()
+				require.NoError(t, err)
+				require.Equal(t, &protonmdc.NmdcSend{}, msg)
+			}
+
+			conn.SetSyncMode(true)
+			if compressed {
+				require.NoError(t, conn.EnableWriterZlib())
+			}
+			require.NoError(t, conn.WriteSync([]byte(content)))
+			if compressed {
+				require.NoError(t, conn.DisableWriterZlib())
+			}
+
+			require.Equal(t, content, string(<-results))
+		})
+	}
+}
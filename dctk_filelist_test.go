@@ -1,9 +1,16 @@
 package dctk
 
 import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/dsnet/compress/bzip2"
 	"github.com/stretchr/testify/require"
 )
 
@@ -24,3 +31,238 @@ func TestFileList(t *testing.T) {
 
 	require.True(t, reflect.DeepEqual(cmp, inout))
 }
+
+func TestFileListPartial(t *testing.T) {
+	inout := []byte(`<?xml version="1.0" encoding="utf-8" standalone="yes"?>
+<FileListing Version="1" CID="testcid" Base="/share/" Generator="testgen">
+    <File Name="file 1" Size="30" TTH="UJUIOGYVALWRB56PRJEB6ZH3G4OLTELOEQ3UKMY"></File>
+    <Directory Name="folder" Incomplete="1"></Directory>
+</FileListing>`)
+
+	fl, err := FileListParse(inout)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(fl.Files))
+	require.Equal(t, true, fl.Dirs[0].Incomplete)
+
+	cmp, err := fl.Export()
+	require.NoError(t, err)
+
+	require.True(t, reflect.DeepEqual(cmp, inout))
+}
+
+func TestFileListAttributes(t *testing.T) {
+	inout := []byte(`<?xml version="1.0" encoding="utf-8" standalone="yes"?>
+<FileListing Version="1" CID="testcid" Base="/share/" Generator="testgen">
+    <File Name="file 1" Size="30" TTH="UJUIOGYVALWRB56PRJEB6ZH3G4OLTELOEQ3UKMY" TS="1600000000"></File>
+    <Directory Name="folder" Incomplete="1" Date="1600000100"></Directory>
+    <Directory Name="other" Date="1600000200">
+        <File Name="file 2" Size="30" TTH="UJUIOGYVALWRB56PRJEB6ZH3G4OLTELOEQ3UKMY" TS="1600000200"></File>
+    </Directory>
+</FileListing>`)
+
+	fl, err := FileListParse(inout)
+	require.NoError(t, err)
+	require.Equal(t, time.Unix(1600000000, 0), fl.Files[0].TS)
+	require.Equal(t, time.Unix(1600000100, 0), fl.Dirs[0].Date)
+
+	f, err := fl.GetFile("/share/other/file 2")
+	require.NoError(t, err)
+	require.Equal(t, time.Unix(1600000200, 0), f.TS)
+
+	f, err = fl.GetFile("/share/file 1")
+	require.NoError(t, err)
+	require.Equal(t, "file 1", f.Name)
+
+	_, err = fl.GetFile("/other/file 2")
+	require.Error(t, err)
+
+	cmp, err := fl.Export()
+	require.NoError(t, err)
+	require.Equal(t, string(inout), string(cmp))
+
+	_, err = FileListParse([]byte(`<FileListing><File Name="a" Size="1" TS="abc"></File></FileListing>`))
+	require.Error(t, err)
+}
+
+func TestFileListSort(t *testing.T) {
+	fl := &FileList{
+		CID:       "testcid",
+		Generator: "testgen",
+		Dirs: []*FileListDirectory{
+			{Name: "b", Files: []*FileListFile{{Name: "z"}, {Name: "y"}}},
+			{Name: "a"},
+		},
+	}
+	fileListSort(fl.Files, fl.Dirs)
+	require.Equal(t, "a", fl.Dirs[0].Name)
+	require.Equal(t, "y", fl.Dirs[1].Files[0].Name)
+
+	out, err := fl.Export()
+	require.NoError(t, err)
+	require.True(t, strings.Contains(string(out), `Base="/"`))
+}
+
+func TestFileListWalk(t *testing.T) {
+	in := []byte(`<?xml version="1.0" encoding="utf-8" standalone="yes"?>
+<FileListing Version="1" CID="testcid" Base="/" Generator="testgen">
+    <Directory Name="share">
+        <File Name="file 1" Size="10" TTH="UJUIOGYVALWRB56PRJEB6ZH3G4OLTELOEQ3UKMY"></File>
+        <Directory Name="sub">
+            <File Name="file 2.mp3" Size="20" TTH="UJUIOGYVALWRB56PRJEB6ZH3G4OLTELOEQ3UKMY"></File>
+        </Directory>
+        <Directory Name="skipped">
+            <File Name="file 3" Size="30" TTH="UJUIOGYVALWRB56PRJEB6ZH3G4OLTELOEQ3UKMY"></File>
+        </Directory>
+    </Directory>
+</FileListing>`)
+
+	fl, err := FileListParse(in)
+	require.NoError(t, err)
+
+	var bz bytes.Buffer
+	w, err := bzip2.NewWriter(&bz, nil)
+	require.NoError(t, err)
+	_, err = w.Write(in)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	walks := map[string]func(FileListWalkFunc) error{
+		"memory": fl.Walk,
+		"stream": NewFileListReader(bytes.NewReader(in)).Walk,
+		"bzip2":  NewFileListReaderBzip2(bytes.NewReader(bz.Bytes())).Walk,
+	}
+
+	for name, walk := range walks {
+		t.Run(name, func(t *testing.T) {
+			var visited []string
+			err := walk(func(fpath string, dir *FileListDirectory, file *FileListFile) error {
+				visited = append(visited, fpath)
+				if dir != nil && dir.Name == "skipped" {
+					return FileListSkipDir
+				}
+				return nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, []string{
+				"/share",
+				"/share/file 1",
+				"/share/sub",
+				"/share/sub/file 2.mp3",
+				"/share/skipped",
+			}, visited)
+		})
+	}
+
+	matches := fl.Find(func(fpath string, file *FileListFile) bool {
+		return strings.HasSuffix(file.Name, ".mp3")
+	})
+	require.Equal(t, 1, len(matches))
+	require.Equal(t, "/share/sub/file 2.mp3", matches[0].Path)
+
+	require.Equal(t, FileListStats{FileCount: 3, DirCount: 3, Size: 60}, fl.Stats())
+
+	r := NewFileListReader(bytes.NewReader(in))
+	st, err := r.Stats()
+	require.NoError(t, err)
+	require.Equal(t, fl.Stats(), st)
+	require.Equal(t, "testcid", r.Header().CID)
+
+	_, err = r.Stats()
+	require.Error(t, err)
+
+	read, err := NewFileListReaderBzip2(bytes.NewReader(bz.Bytes())).ReadAll()
+	require.NoError(t, err)
+	exp, err := fl.Export()
+	require.NoError(t, err)
+	out, err := read.Export()
+	require.NoError(t, err)
+	require.Equal(t, string(exp), string(out))
+
+	// names that refer to other paths are rejected
+	for _, name := range []string{"../escape", "sub/nested", "..", ""} {
+		for _, entry := range []string{
+			`<Directory Name="` + name + `"></Directory>`,
+			`<File Name="` + name + `" Size="10" TTH="UJUIOGYVALWRB56PRJEB6ZH3G4OLTELOEQ3UKMY"></File>`,
+		} {
+			in := []byte(`<FileListing Version="1" Base="/"><Directory Name="share">` +
+				`<Directory Name="sub"></Directory>` + entry + `</Directory></FileListing>`)
+			_, err := NewFileListReader(bytes.NewReader(in)).ReadAll()
+			require.Error(t, err)
+		}
+	}
+}
+
+func TestFileListDiff(t *testing.T) {
+	a, err := FileListParse([]byte(`<?xml version="1.0" encoding="utf-8" standalone="yes"?>
+<FileListing Version="1" CID="testcid" Base="/" Generator="testgen">
+    <Directory Name="share">
+        <File Name="same" Size="10" TTH="UJUIOGYVALWRB56PRJEB6ZH3G4OLTELOEQ3UKMY"></File>
+        <File Name="changed" Size="10" TTH="UJUIOGYVALWRB56PRJEB6ZH3G4OLTELOEQ3UKMY"></File>
+        <File Name="removed" Size="30" TTH="LWPNACQDBZRYXW3VHJVCJ64QBZNGHOHHHZWCLNQ"></File>
+        <Directory Name="old">
+            <File Name="moved" Size="20" TTH="BR4BVJBMHDFVCFI4WBPSL63W5TWXWVBSC574BLI"></File>
+        </Directory>
+    </Directory>
+</FileListing>`))
+	require.NoError(t, err)
+
+	b, err := FileListParse([]byte(`<?xml version="1.0" encoding="utf-8" standalone="yes"?>
+<FileListing Version="1" CID="testcid" Base="/" Generator="testgen">
+    <Directory Name="share">
+        <File Name="same" Size="10" TTH="UJUIOGYVALWRB56PRJEB6ZH3G4OLTELOEQ3UKMY"></File>
+        <File Name="changed" Size="15" TTH="QOAOH3FP5NLNPNTXVULQNSG3SQVL4XZFWW3H2HY"></File>
+        <File Name="added" Size="40" TTH="RBXXO7PS2PCIMYR54SAKTNHEXVJPRHZK6VQLAKQ"></File>
+        <Directory Name="new">
+            <File Name="moved" Size="20" TTH="BR4BVJBMHDFVCFI4WBPSL63W5TWXWVBSC574BLI"></File>
+        </Directory>
+    </Directory>
+</FileListing>`))
+	require.NoError(t, err)
+
+	res := FileListDiff(a, b)
+
+	require.Equal(t, 4, len(res.Changes))
+	require.Equal(t, FileListAdded, res.Changes[0].Type)
+	require.Equal(t, "/share/added", res.Changes[0].Path)
+	require.Equal(t, FileListChanged, res.Changes[1].Type)
+	require.Equal(t, "/share/changed", res.Changes[1].Path)
+	require.Equal(t, FileListMoved, res.Changes[2].Type)
+	require.Equal(t, "/share/new/moved", res.Changes[2].Path)
+	require.Equal(t, "/share/old/moved", res.Changes[2].OldPath)
+	require.Equal(t, FileListRemoved, res.Changes[3].Type)
+	require.Equal(t, "/share/removed", res.Changes[3].Path)
+
+	require.Equal(t, []FileListDirChanges{
+		{Path: "/share", Added: 1, Removed: 1, Moved: 1, Changed: 1, SizeDelta: 15},
+		{Path: "/share/new", Moved: 1},
+	}, res.Dirs)
+
+	require.Equal(t, 0, len(FileListDiff(a, a).Changes))
+}
+
+func TestFileListCacheCorrupted(t *testing.T) {
+	dir := testShareDir(t, map[string]string{"cache/": ""})
+	defer os.RemoveAll(dir)
+
+	client := testShareIndex(t, ClientConf{
+		FileListCacheDir: filepath.Join(dir, "cache"),
+	}, func(client *Client) {
+		require.NoError(t, client.ShareAdd("share", filepath.Join(dir, "cache")))
+	})
+
+	peer := &Peer{Nick: "peer", ShareSize: 100}
+	fpath := client.fileListCachePath(peer)
+	require.NoError(t, ioutil.WriteFile(fpath, []byte("corrupted"), 0o644))
+
+	// the cached list is decoded by the caller
+	fl, d, err := client.GetFileList(peer)
+	require.NoError(t, err)
+	require.Nil(t, d)
+	_, err = fl.ReadAll()
+	require.Error(t, err)
+	fl.Close()
+
+	// the corrupted list is removed from the cache
+	_, err = os.Stat(fpath)
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,84 @@
+package dctk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/dctk/pkg/tiger"
+)
+
+func TestHashDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dctk-hashdb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fpath := filepath.Join(dir, "hashdb")
+
+	e1 := &hashDBEntry{
+		size:    10,
+		modTime: 1000,
+		inode:   5,
+		tth:     tiger.HashMust("UJUIOGYVALWRB56PRJEB6ZH3G4OLTELOEQ3UKMY"),
+	}
+	e2 := &hashDBEntry{
+		size:    20,
+		modTime: 2000,
+		inode:   6,
+		tth:     tiger.HashMust("LWPNACQDBZRYXW3VHJVCJ64QBZNGHOHHHZWCLNQ"),
+	}
+
+	db, err := newHashDB(fpath)
+	require.NoError(t, err)
+	require.NoError(t, db.put("/a", e1))
+	require.NoError(t, db.put("/b", e2))
+	db.close()
+
+	// simulate a crash during a write
+	f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	rec := hashDBEncodeRecord("/c", e2)
+	f.Write(rec[:len(rec)-3])
+	f.Close()
+
+	db, err = newHashDB(fpath)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(db.entries))
+
+	e, ok := db.get("/a", 10, 1000, 5)
+	require.True(t, ok)
+	require.Equal(t, e1, e)
+
+	_, ok = db.get("/a", 10, 1001, 5)
+	require.False(t, ok)
+	_, ok = db.get("/a", 10, 1000, 7)
+	require.False(t, ok)
+
+	// records written after the corrupted one are kept
+	require.NoError(t, db.put("/b", e1))
+	db.close()
+
+	db, err = newHashDB(fpath)
+	require.NoError(t, err)
+	require.Equal(t, 3, db.records)
+	e, ok = db.get("/b", 10, 1000, 5)
+	require.True(t, ok)
+	require.Equal(t, e1, e)
+
+	require.NoError(t, db.compact(map[string]struct{}{"/b": {}}))
+	require.Equal(t, 1, db.records)
+	db.close()
+
+	db, err = newHashDB(fpath)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(db.entries))
+	_, ok = db.get("/b", 10, 1000, 5)
+	require.True(t, ok)
+	db.close()
+
+	ioutil.WriteFile(fpath, []byte("something else"), 0o644)
+	_, err = newHashDB(fpath)
+	require.Error(t, err)
+}
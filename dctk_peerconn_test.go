@@ -0,0 +1,363 @@
+package dctk
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aler9/go-dc/nmdc"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/dctk/pkg/log"
+	"github.com/aler9/dctk/pkg/protocommon"
+	"github.com/aler9/dctk/pkg/protonmdc"
+)
+
+func TestPeerConnUploadLimit(t *testing.T) {
+	c := &Client{
+		conf:           ClientConf{MaxUploadConnsPerPeer: 2},
+		peerConnsByKey: make(map[peerConnKey]*peerConn),
+	}
+	first := &Peer{Nick: "first"}
+	second := &Peer{Nick: "second"}
+
+	c.peerConnsByKey[peerConnKey{"first", "upload", "A"}] = &peerConn{}
+	c.peerConnsByKey[peerConnKey{"first", "download", "B"}] = &peerConn{}
+	require.True(t, c.peerConnUploadAllow(first))
+
+	c.peerConnsByKey[peerConnKey{"first", "upload", "C"}] = &peerConn{}
+	require.False(t, c.peerConnUploadAllow(first))
+	require.True(t, c.peerConnUploadAllow(second))
+	require.Equal(t, uint64(1), c.peerConnStats.Rejected)
+
+	// connections that are closing are not counted
+	c.peerConnsByKey[peerConnKey{"first", "upload", "C"}].terminateRequested = true
+	require.True(t, c.peerConnUploadAllow(first))
+}
+
+func TestPeerConnAllow(t *testing.T) {
+	c := &Client{
+		conf:           ClientConf{LogLevel: log.LevelError, PeerConnMax: 3, PeerConnMaxPerIP: 1},
+		peerConns:      make(map[*peerConn]struct{}),
+		peerConnsByKey: make(map[peerConnKey]*peerConn),
+		transfers:      make(map[transfer]struct{}),
+	}
+	add := func(ip string, direction string, state string, idleSince time.Time) *peerConn {
+		p := &peerConn{
+			client:    c,
+			terminate: make(chan struct{}),
+			state:     state,
+			remoteIP:  ip,
+			idleSince: idleSince,
+			peer:      &Peer{Nick: ip},
+			direction: direction,
+		}
+		c.peerConns[p] = struct{}{}
+		c.peerConnsByKey[peerConnKey{ip, direction, ""}] = p
+		return p
+	}
+
+	add("10.0.0.1", "upload", "delegated_upload", time.Time{})
+
+	// limit per ip
+	require.False(t, c.peerConnAllow("10.0.0.1", true))
+	require.True(t, c.peerConnAllow("10.0.0.1", false))
+	require.True(t, c.peerConnAllow("10.0.0.2", true))
+	require.Equal(t, uint64(1), c.peerConnStats.Rejected)
+
+	// the oldest idle connection is closed to make room for the new one
+	older := add("10.0.0.2", "upload", "wait_upload", time.Now().Add(-2*time.Minute))
+	newer := add("10.0.0.3", "upload", "wait_upload", time.Now().Add(-1*time.Minute))
+	require.True(t, c.peerConnAllow("10.0.0.4", false))
+	require.True(t, older.terminateRequested)
+	require.False(t, newer.terminateRequested)
+	require.NotContains(t, c.peerConnsByKey, peerConnKey{"10.0.0.2", "upload", ""})
+	require.Equal(t, uint64(1), c.peerConnStats.ClosedIdle)
+
+	// connections waiting for queued downloads are kept
+	kept := add("10.0.0.5", "download", "wait_download", time.Now().Add(-3*time.Minute))
+	c.transfers[&Download{conf: DownloadConf{Peer: kept.peer}}] = struct{}{}
+	require.True(t, c.peerConnAllow("10.0.0.6", false))
+	require.False(t, kept.terminateRequested)
+	require.True(t, newer.terminateRequested)
+
+	// no idle connections are left
+	add("10.0.0.6", "upload", "delegated_upload", time.Time{})
+	require.False(t, c.peerConnAllow("10.0.0.7", false))
+	require.Equal(t, uint64(2), c.peerConnStats.Rejected)
+	require.Equal(t, uint64(2), c.peerConnStats.ClosedIdle)
+}
+
+func TestPeerConnIdle(t *testing.T) {
+	c, err := NewClient(ClientConf{
+		LogLevel:            log.LevelError,
+		HubURL:              "adc://127.0.0.1:5000",
+		Nick:                "testdctk",
+		IsPassive:           true,
+		PeerConnIdleTimeout: 200 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	var p *peerConn
+	c.Safe(func() {
+		p = newPeerConn(c, false, true, local, "", 0, "")
+		p.peer = &Peer{Nick: "peer"}
+		p.direction = "download"
+		p.setBusy("delegated_download")
+		p.setIdle("wait_download")
+
+		// idle connections are reused
+		p.setBusy("delegated_download")
+		require.Equal(t, uint64(1), c.PeerConnStats().Reused)
+	})
+
+	// busy connections do not expire
+	time.Sleep(400 * time.Millisecond)
+	c.Safe(func() {
+		require.Equal(t, uint(1), c.PeerConnStats().Open)
+
+		// connections waiting for queued downloads do not expire
+		c.transfers[&Download{conf: DownloadConf{Peer: p.peer}}] = struct{}{}
+		p.setIdle("wait_download")
+		require.Equal(t, uint(1), c.PeerConnStats().Idle)
+	})
+
+	time.Sleep(400 * time.Millisecond)
+	c.Safe(func() {
+		require.Equal(t, uint(1), c.PeerConnStats().Open)
+
+		// idle connections expire
+		c.transfers = make(map[transfer]struct{})
+		p.armIdleTimeout()
+	})
+
+	require.Eventually(t, func() bool {
+		closed := false
+		c.Safe(func() {
+			closed = (c.PeerConnStats().ClosedIdle == 1 && c.PeerConnStats().Open == 0)
+		})
+		return closed
+	}, 2*time.Second, 50*time.Millisecond)
+	c.wg.Wait()
+}
+
+// testTLSPipe returns the server side of an encrypted connection, whose
+// client side presents the given certificates.
+func testTLSPipe(t *testing.T, serverCert tls.Certificate, clientCerts []tls.Certificate) *tls.Conn {
+	local, remote := net.Pipe()
+	server := tls.Server(local, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequestClientCert,
+	})
+	client := tls.Client(remote, &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       clientCerts,
+	})
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+
+	done := make(chan error)
+	go func() { done <- client.Handshake() }()
+	require.NoError(t, server.Handshake())
+	require.NoError(t, <-done)
+	return server
+}
+
+func TestPeerConnValidateTLS(t *testing.T) {
+	localCert, _, err := newTLSCertificate()
+	require.NoError(t, err)
+	peerCert, peerFingerprint, err := newTLSCertificate()
+	require.NoError(t, err)
+	_, otherFingerprint, err := newTLSCertificate()
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		name        string
+		strict      bool
+		encrypted   bool
+		certs       []tls.Certificate
+		fingerprint string
+		valid       bool
+	}{
+		{"matching keyprint", false, true, []tls.Certificate{peerCert}, peerFingerprint, true},
+		{"mismatching keyprint", false, true, []tls.Certificate{peerCert}, otherFingerprint, false},
+		{"mismatching keyprint strict", true, true, []tls.Certificate{peerCert}, otherFingerprint, false},
+		{"no certificate", false, true, nil, peerFingerprint, true},
+		{"no certificate strict", true, true, nil, peerFingerprint, false},
+		{"no keyprint", false, true, []tls.Certificate{peerCert}, "", true},
+		{"no keyprint strict", true, true, []tls.Certificate{peerCert}, "", false},
+		{"unencrypted", false, false, nil, "", true},
+		{"unencrypted strict", true, false, nil, peerFingerprint, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			client := &Client{conf: ClientConf{
+				LogLevel:             log.LevelError,
+				PeerEncryptionStrict: c.strict,
+			}}
+			var tlsPeer *Peer
+			client.OnPeerTLS = func(p *Peer, st tls.ConnectionState) {
+				tlsPeer = p
+			}
+
+			p := &peerConn{
+				client:      client,
+				isEncrypted: c.encrypted,
+				peer:        &Peer{Nick: "peer", fingerprint: c.fingerprint},
+			}
+			if c.encrypted {
+				p.tlsConn = testTLSPipe(t, localCert, c.certs)
+			}
+
+			err := p.validateTLS()
+			if c.valid {
+				require.NoError(t, err)
+				if c.encrypted {
+					require.Equal(t, p.peer, tlsPeer)
+				}
+			} else {
+				require.Error(t, err)
+				require.Nil(t, tlsPeer)
+			}
+		})
+	}
+}
+
+func TestPeerConnStrictListener(t *testing.T) {
+	c, err := NewClient(ClientConf{
+		LogLevel:             log.LevelError,
+		HubURL:               "adc://127.0.0.1:5000",
+		Nick:                 "testdctk",
+		IsPassive:            true,
+		TLSPort:              3010,
+		PeerEncryptionStrict: true,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, newListenerTCP(c, true))
+	c.wg.Add(1)
+	go c.tlsListener.do()
+	defer func() {
+		c.Safe(func() {
+			c.tlsListener.close()
+			for p := range c.peerConns {
+				p.close()
+			}
+		})
+		c.wg.Wait()
+	}()
+
+	// clients that do not present a certificate are refused
+	conn, err := tls.Dial("tcp4", "127.0.0.1:3010", &tls.Config{InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+	require.False(t, isTimeoutError(err))
+
+	_, err = NewClient(ClientConf{
+		HubURL:               "adc://127.0.0.1:5000",
+		Nick:                 "testdctk",
+		IsPassive:            true,
+		PeerEncryptionMode:   DisableEncryption,
+		PeerEncryptionStrict: true,
+	})
+	require.Error(t, err)
+}
+
+// testLegacyClient runs a NMDC client that is not connected to any hub and
+// shares the given directory. It returns when the share has been indexed.
+// The client is closed when the test ends.
+func testLegacyClient(t *testing.T, dir string) *Client {
+	client, err := NewClient(ClientConf{
+		LogLevel:           log.LevelError,
+		HubURL:             "nmdc://127.0.0.1:4111",
+		HubManualConnect:   true,
+		Nick:               "testdctk",
+		IsPassive:          true,
+		PeerEncryptionMode: DisableEncryption,
+	})
+	require.NoError(t, err)
+
+	indexed := make(chan struct{}, 1)
+	client.OnInitialized = func() {
+		client.ShareAdd("share", dir)
+	}
+	client.OnShareIndexed = func() {
+		select {
+		case indexed <- struct{}{}:
+		default:
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		client.Run()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		client.Safe(func() { client.Close() })
+		<-done
+	})
+
+	<-indexed
+	return client
+}
+
+// testLegacyPeer connects a legacy NMDC peer, that does not support ADCGet,
+// to the client, and performs the handshake.
+func testLegacyPeer(t *testing.T, client *Client, nick string, upload bool, ext []string) *protonmdc.Conn {
+	local, remote := net.Pipe()
+	client.Safe(func() {
+		if _, ok := client.peers[nick]; !ok {
+			client.peers[nick] = &Peer{Nick: nick}
+		}
+		newPeerConn(client, false, true, local, "", 0, "")
+	})
+
+	conn := protonmdc.NewConn(log.LevelError, "legacy", remote, true, true)
+	t.Cleanup(func() { conn.Close() })
+
+	conn.Write(&nmdc.MyNick{Name: nmdc.Name(nick)})
+	conn.Write(&nmdc.Lock{Lock: "EXTENDEDPROTOCOLlegacy", PK: "legacy"})
+
+	var lock *nmdc.Lock
+	for _, expected := range []interface{}{
+		&nmdc.MyNick{},
+		&nmdc.Lock{},
+		&nmdc.Supports{},
+		&nmdc.Direction{},
+		&nmdc.Key{},
+	} {
+		msg, err := conn.Read()
+		require.NoError(t, err)
+		require.IsType(t, expected, msg)
+		if l, ok := msg.(*nmdc.Lock); ok {
+			lock = l
+		}
+	}
+
+	conn.Write(&nmdc.Supports{Ext: ext})
+	conn.Write(&nmdc.Direction{Upload: upload, Number: 1})
+	conn.Write(lock.Key())
+	return conn
+}
+
+// testReadBinary reads binary content from a connection.
+func testReadBinary(t *testing.T, conn *protonmdc.Conn, length int) []byte {
+	conn.SetBinaryMode(true)
+	var cnt []byte
+	for len(cnt) < length {
+		msg, err := conn.Read()
+		require.NoError(t, err)
+		cnt = append(cnt, msg.(*protocommon.MsgBinary).Content...)
+	}
+	conn.SetBinaryMode(false)
+	return cnt
+}
@@ -1,15 +1,24 @@
 package dctk
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/aler9/dctk/pkg/log"
+	"github.com/aler9/dctk/pkg/tiger"
 )
 
 func TestShare(t *testing.T) {
@@ -58,3 +67,700 @@ func TestShare(t *testing.T) {
 		require.True(t, ok)
 	})
 }
+
+func TestShareWatch(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("share watching is supported on Linux only")
+	}
+
+	os.RemoveAll("/tmp/testsharewatch")
+	os.MkdirAll("/tmp/testsharewatch/folder", 0o755)
+	ioutil.WriteFile("/tmp/testsharewatch/folder/first.txt", []byte(strings.Repeat("A", 10000)), 0o644)
+	defer os.RemoveAll("/tmp/testsharewatch")
+
+	client, err := NewClient(ClientConf{
+		LogLevel:         log.LevelError,
+		HubURL:           "adc://127.0.0.1:5000",
+		HubManualConnect: true,
+		Nick:             "testdctk",
+		IsPassive:        true,
+		ShareWatch:       true,
+	})
+	require.NoError(t, err)
+
+	client.OnInitialized = func() {
+		client.ShareAdd("share", "/tmp/testsharewatch")
+	}
+
+	step := 0
+	client.OnShareIndexed = func() {
+		step++
+		switch step {
+		case 1:
+			require.Equal(t, uint(1), client.shareCount)
+			ioutil.WriteFile("/tmp/testsharewatch/folder/second.txt", []byte(strings.Repeat("B", 10000)), 0o644)
+
+		case 2:
+			require.Equal(t, uint(2), client.shareCount)
+			require.NotNil(t, client.shareFileByPath("/share/folder/second.txt"))
+			os.Remove("/tmp/testsharewatch/folder/first.txt")
+
+		case 3:
+			require.Equal(t, uint(1), client.shareCount)
+			require.Nil(t, client.shareFileByPath("/share/folder/first.txt"))
+			client.ShareRefresh("share")
+
+		case 4:
+			require.Equal(t, uint(1), client.shareCount)
+			client.Close()
+		}
+	}
+
+	go func() {
+		time.Sleep(20 * time.Second)
+		client.Safe(func() {
+			client.Close()
+		})
+	}()
+
+	client.Run()
+	require.Equal(t, 4, step)
+}
+
+// testShareDir creates a temporary directory with the given files, indexed
+// by relative path. Paths ending with a slash are created as directories.
+func testShareDir(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "dctk-share")
+	require.NoError(t, err)
+
+	for rpath, cnt := range files {
+		fpath := filepath.Join(dir, filepath.FromSlash(rpath))
+		if strings.HasSuffix(rpath, "/") {
+			require.NoError(t, os.MkdirAll(fpath, 0o755))
+			continue
+		}
+		require.NoError(t, os.MkdirAll(filepath.Dir(fpath), 0o755))
+		require.NoError(t, ioutil.WriteFile(fpath, []byte(cnt), 0o644))
+	}
+	return dir
+}
+
+// testShareIndex creates a client that is not connected to any hub, calls
+// setup when the client is initialized and runs the client until the share
+// has been indexed.
+func testShareIndex(t *testing.T, conf ClientConf, setup func(client *Client)) *Client {
+	conf.LogLevel = log.LevelError
+	conf.HubURL = "adc://127.0.0.1:5000"
+	conf.HubManualConnect = true
+	conf.Nick = "testdctk"
+	conf.IsPassive = true
+
+	client, err := NewClient(conf)
+	require.NoError(t, err)
+
+	client.OnInitialized = func() {
+		setup(client)
+	}
+
+	client.OnShareIndexed = func() {
+		client.Close()
+	}
+
+	client.Run()
+	return client
+}
+
+func TestShareIndexProgress(t *testing.T) {
+	dir := testShareDir(t, map[string]string{
+		"first.txt":         strings.Repeat("A", 1000000),
+		"folder/second.txt": strings.Repeat("B", 1000000),
+		"folder/third.txt":  strings.Repeat("C", 1000000),
+	})
+	defer os.RemoveAll(dir)
+
+	defer func(v time.Duration) { shareIndexProgressPeriod = v }(shareIndexProgressPeriod)
+	shareIndexProgressPeriod = 100 * time.Millisecond
+
+	var progress []ShareIndexProgress
+
+	client := testShareIndex(t, ClientConf{
+		ShareHashMaxSpeed: 2 * 1024 * 1024,
+	}, func(client *Client) {
+		client.OnShareIndexProgress = func(p ShareIndexProgress) {
+			progress = append(progress, p)
+		}
+		client.ShareAdd("share", dir)
+	})
+
+	require.True(t, len(progress) >= 3)
+	require.Equal(t, ShareIndexProgress{FilesTotal: 3, BytesTotal: 3000000}, progress[0])
+	last := progress[len(progress)-1]
+	require.Equal(t, uint(3), last.FilesDone)
+	require.Equal(t, uint64(3000000), last.BytesDone)
+	require.True(t, strings.HasPrefix(last.Path, "/share/"))
+	require.Equal(t, uint(3), client.shareCount)
+}
+
+func TestShareIndexHashError(t *testing.T) {
+	dir := testShareDir(t, map[string]string{
+		"folder/first.bin":   strings.Repeat("A", 300000),
+		"folder/sub/new.txt": strings.Repeat("B", 1000),
+	})
+	defer os.RemoveAll(dir)
+
+	// the file that cannot be hashed is the most recent one
+	newPath := filepath.Join(dir, "folder", "sub", "new.txt")
+	require.NoError(t, os.Chtimes(newPath, time.Now(), time.Now().Add(time.Hour)))
+	finfo, err := os.Stat(filepath.Join(dir, "folder", "first.bin"))
+	require.NoError(t, err)
+
+	var errPaths []string
+
+	client := testShareIndex(t, ClientConf{
+		ShareHashWorkers:  1,
+		ShareHashMaxSpeed: 1024 * 1024,
+	}, func(client *Client) {
+		// files are hashed in order, the second one is removed while
+		// the first one is being hashed
+		client.OnShareIndexProgress = func(p ShareIndexProgress) {
+			os.Remove(newPath)
+		}
+		client.OnShareIndexError = func(fpath string, err error) {
+			errPaths = append(errPaths, fpath)
+		}
+		client.ShareAdd("share", dir)
+	})
+
+	require.Equal(t, []string{newPath}, errPaths)
+	require.Equal(t, uint(1), client.shareCount)
+	require.Equal(t, uint64(300000), client.shareSize)
+
+	// totals of directories do not include the removed file
+	tree := client.ShareTree()
+	folder := tree[0].Dirs[0]
+	require.Equal(t, uint64(300000), tree[0].Size)
+	require.Equal(t, uint64(300000), folder.Size)
+	require.Equal(t, uint64(0), folder.Dirs[0].Size)
+	require.True(t, folder.Dirs[0].ModTime.IsZero())
+	require.True(t, folder.ModTime.Equal(finfo.ModTime()))
+	require.True(t, tree[0].ModTime.Equal(finfo.ModTime()))
+
+	res, err := client.ShareSearch(SearchConf{Type: SearchDirectory, Query: "folder"})
+	require.NoError(t, err)
+	require.Equal(t, "/share/folder", res[0].Path)
+	require.Equal(t, uint64(300000), res[0].Size)
+}
+
+func TestShareIndexCancel(t *testing.T) {
+	dir := testShareDir(t, map[string]string{
+		"first.txt": strings.Repeat("A", 10000000),
+	})
+	defer os.RemoveAll(dir)
+
+	indexed := false
+	start := time.Now()
+
+	testShareIndex(t, ClientConf{
+		ShareHashMaxSpeed: 1024 * 1024,
+	}, func(client *Client) {
+		client.OnShareIndexProgress = func(p ShareIndexProgress) {
+			if p.BytesDone > 0 {
+				client.Close()
+			}
+		}
+		client.OnShareIndexed = func() {
+			indexed = true
+			client.Close()
+		}
+		client.ShareAdd("share", dir)
+	})
+
+	require.False(t, indexed)
+	require.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestShareRules(t *testing.T) {
+	dir := testShareDir(t, map[string]string{
+		"share/normal.txt":    strings.Repeat("A", 100),
+		"share/.hidden":       strings.Repeat("A", 100),
+		"share/partial.tmp":   strings.Repeat("A", 100),
+		"share/empty.txt":     "",
+		"share/big.bin":       strings.Repeat("A", 5000),
+		"share/sub/file.txt":  strings.Repeat("B", 100),
+		"share/sub/debug.log": strings.Repeat("B", 100),
+		"out/out.txt":         strings.Repeat("C", 100),
+	})
+	defer os.RemoveAll(dir)
+
+	shareDir := filepath.Join(dir, "share")
+	os.Symlink(filepath.Join(shareDir, "normal.txt"), filepath.Join(shareDir, "inside.txt"))
+	os.Symlink(filepath.Join(dir, "out", "out.txt"), filepath.Join(shareDir, "outside.txt"))
+	os.Symlink(filepath.Join(dir, "out", "missing.txt"), filepath.Join(shareDir, "broken.txt"))
+	os.Symlink(shareDir, filepath.Join(shareDir, "sub", "loop"))
+
+	for _, policy := range []SymlinkPolicy{SymlinkFollow, SymlinkInsideRoot, SymlinkSkip} {
+		client := testShareIndex(t, ClientConf{
+			ShareRules: ShareRules{
+				ExcludeGlobs: []string{"*.tmp"},
+				MinSize:      1,
+				SkipHidden:   true,
+			},
+		}, func(client *Client) {
+			err := client.ShareAddWithRules("share", shareDir, ShareRules{
+				ExcludeRegexps: []*regexp.Regexp{regexp.MustCompile(`^/share/sub/.*\.log$`)},
+				MaxSize:        1000,
+				Symlinks:       policy,
+			})
+			require.NoError(t, err)
+		})
+
+		for _, fpath := range []string{"/share/normal.txt", "/share/sub/file.txt"} {
+			require.NotNil(t, client.shareFileByPath(fpath))
+		}
+		for _, fpath := range []string{
+			"/share/.hidden", "/share/partial.tmp", "/share/empty.txt",
+			"/share/big.bin", "/share/sub/debug.log", "/share/broken.txt",
+		} {
+			require.Nil(t, client.shareFileByPath(fpath))
+		}
+		require.Equal(t, policy != SymlinkSkip, client.shareFileByPath("/share/inside.txt") != nil)
+		require.Equal(t, policy == SymlinkFollow, client.shareFileByPath("/share/outside.txt") != nil)
+		require.Equal(t, 0, len(client.shareTree["share"].dirs["sub"].dirs))
+	}
+
+	_, err := NewClient(ClientConf{
+		HubURL:     "adc://127.0.0.1:5000",
+		Nick:       "testdctk",
+		IsPassive:  true,
+		ShareRules: ShareRules{ExcludeGlobs: []string{"[a"}},
+	})
+	require.Error(t, err)
+}
+
+func TestShareIndexError(t *testing.T) {
+	dir := testShareDir(t, map[string]string{
+		"normal.txt": strings.Repeat("A", 100),
+	})
+	defer os.RemoveAll(dir)
+
+	// a regular file that cannot be read, even by root
+	os.Symlink("/proc/self/mem", filepath.Join(dir, "unreadable"))
+
+	var errPaths []string
+
+	client := testShareIndex(t, ClientConf{}, func(client *Client) {
+		client.OnShareIndexError = func(fpath string, err error) {
+			errPaths = append(errPaths, fpath)
+		}
+		require.Error(t, client.ShareAdd("missing", filepath.Join(dir, "missing")))
+		require.Error(t, client.ShareAdd("file", filepath.Join(dir, "normal.txt")))
+		require.NoError(t, client.ShareAdd("share", dir))
+	})
+
+	require.Equal(t, []string{fmt.Sprintf("/proc/%d/mem", os.Getpid())}, errPaths)
+	require.NotNil(t, client.shareFileByPath("/share/normal.txt"))
+	require.Nil(t, client.shareFileByPath("/share/unreadable"))
+	require.Equal(t, uint64(100), client.shareSize)
+	require.Equal(t, 1, len(client.shareRoots))
+}
+
+func TestShareIndexLookup(t *testing.T) {
+	dir := testShareDir(t, map[string]string{
+		"first-song.mp3":        strings.Repeat("A", 100),
+		"copy.mp3":              strings.Repeat("A", 100),
+		"Music Album/track.ogg": strings.Repeat("B", 200),
+	})
+	defer os.RemoveAll(dir)
+
+	client := testShareIndex(t, ClientConf{}, func(client *Client) {
+		require.NoError(t, client.ShareAdd("share", dir))
+	})
+
+	search := func(req *searchIncomingRequest) []string {
+		res, err := client.handleSearchIncomingRequest(req)
+		require.NoError(t, err)
+		var paths []string
+		for _, r := range res {
+			switch rr := r.(type) {
+			case *shareFile:
+				paths = append(paths, rr.aliasPath)
+			case *shareDirectory:
+				paths = append(paths, rr.aliasPath+"/")
+			}
+		}
+		sort.Strings(paths)
+		return paths
+	}
+
+	require.Equal(t, []string{"/share/copy.mp3", "/share/first-song.mp3"},
+		search(&searchIncomingRequest{stype: SearchAny, query: ".MP3"}))
+	require.Equal(t, []string{"/share/Music Album/", "/share/Music Album/track.ogg"},
+		search(&searchIncomingRequest{stype: SearchAny, query: "sic al"}))
+	require.Equal(t, []string{"/share/Music Album/"},
+		search(&searchIncomingRequest{stype: SearchDirectory, query: "album"}))
+	require.Equal(t, []string{"/share/Music Album/track.ogg"},
+		search(&searchIncomingRequest{stype: SearchAny, query: "ogg", minSize: 150}))
+	require.Equal(t, []string(nil),
+		search(&searchIncomingRequest{stype: SearchAny, query: "mp3", minSize: 150}))
+	require.Equal(t, []string(nil),
+		search(&searchIncomingRequest{stype: SearchAny, query: "missing"}))
+
+	sfile := client.shareFileByPath("/share/copy.mp3")
+	require.Equal(t, []string{"/share/copy.mp3", "/share/first-song.mp3"},
+		search(&searchIncomingRequest{stype: SearchTTH, tth: sfile.tth}))
+	profile := client.shareProfileFor(nil)
+	require.Equal(t, sfile.tth, client.shareVisibleFileByTTH(profile, sfile.tth).tth)
+	require.Nil(t, client.shareVisibleFileByTTH(profile, tiger.Hash{}))
+
+	_, err := client.handleSearchIncomingRequest(&searchIncomingRequest{stype: SearchAny, query: "mp"})
+	require.Error(t, err)
+	_, err = client.handleSearchIncomingRequest(&searchIncomingRequest{stype: SearchAny, query: "日本"})
+	require.Error(t, err)
+}
+
+type testShareProvider map[string][]byte
+
+func (p testShareProvider) Entries() ([]ShareProviderEntry, error) {
+	var ret []ShareProviderEntry
+	for fpath, cnt := range p {
+		tthl, _ := tiger.LeavesFromReader(bytes.NewReader(cnt))
+		ret = append(ret, ShareProviderEntry{
+			Path: fpath,
+			Size: uint64(len(cnt)),
+			TTH:  tthl.TreeHash(),
+		})
+	}
+	return ret, nil
+}
+
+func (p testShareProvider) Open(fpath string) (io.ReaderAt, error) {
+	cnt, ok := p[fpath]
+	if !ok {
+		return nil, fmt.Errorf("not found")
+	}
+	return bytes.NewReader(cnt), nil
+}
+
+func TestShareProvider(t *testing.T) {
+	var errPaths []string
+
+	client := testShareIndex(t, ClientConf{
+		ShareRules: ShareRules{
+			ExcludeGlobs: []string{"*.tmp"},
+			SkipHidden:   true,
+		},
+	}, func(client *Client) {
+		client.OnShareIndexError = func(fpath string, err error) {
+			errPaths = append(errPaths, fpath)
+		}
+		require.NoError(t, client.ShareAddProvider("virtual", testShareProvider{
+			"generated.txt":        []byte("generated content"),
+			"archive/inside.txt":   []byte(strings.Repeat("B", 300)),
+			"archive/deep/one.bin": []byte{0x01},
+			"archive/partial.tmp":  []byte("x"),
+			".hidden/secret.txt":   []byte("x"),
+			"../outside.txt":       []byte("x"),
+		}))
+	})
+
+	require.Equal(t, []string{"/virtual/../outside.txt"}, errPaths)
+	require.Nil(t, client.shareFileByPath("/virtual/archive/partial.tmp"))
+	require.Nil(t, client.shareFileByPath("/virtual/.hidden/secret.txt"))
+	require.Nil(t, client.shareTree["virtual"].dirs[".hidden"])
+	require.Equal(t, uint(3), client.shareCount)
+	require.Equal(t, uint64(318), client.shareSize)
+
+	sfile := client.shareFileByPath("/virtual/archive/inside.txt")
+	require.NotNil(t, sfile)
+	require.Equal(t, sfile, client.shareVisibleFileByTTH(client.shareProfileFor(nil), sfile.tth))
+
+	r, err := sfile.open(100)
+	require.NoError(t, err)
+	cnt, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	r.Close()
+	require.Equal(t, strings.Repeat("B", 200), string(cnt))
+
+	res, err := client.handleSearchIncomingRequest(&searchIncomingRequest{stype: SearchAny, query: "generated"})
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{client.shareFileByPath("/virtual/generated.txt")}, res)
+
+	matches, err := NewFileListReaderBzip2(bytes.NewReader(client.fileList)).Find(
+		func(fpath string, file *FileListFile) bool {
+			return fpath == "/virtual/archive/deep/one.bin"
+		})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(matches))
+	require.Equal(t, uint64(1), matches[0].File.Size)
+}
+
+type testShareEntriesProvider []ShareProviderEntry
+
+func (p testShareEntriesProvider) Entries() ([]ShareProviderEntry, error) {
+	return p, nil
+}
+
+func (p testShareEntriesProvider) Open(fpath string) (io.ReaderAt, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func TestShareProviderLeaves(t *testing.T) {
+	full, err := tiger.LeavesFromBytes([]byte(strings.Repeat("A", 100*1024)))
+	require.NoError(t, err)
+
+	var errPaths []string
+
+	client := testShareIndex(t, ClientConf{
+		ShareTTHLDepth: 3,
+	}, func(client *Client) {
+		client.OnShareIndexError = func(fpath string, err error) {
+			errPaths = append(errPaths, fpath)
+		}
+		require.NoError(t, client.ShareAddProvider("virtual", testShareEntriesProvider{
+			{Path: "good.bin", Size: 100 * 1024, TTH: full.TreeHash(), TTHL: full},
+			{Path: "coarse.bin", Size: 100 * 1024, TTH: full.TreeHash(), TTHL: full.Reduce(1)},
+			{Path: "wrong.bin", Size: 100 * 1024, TTH: tiger.Hash{}, TTHL: full},
+		}))
+	})
+
+	sort.Strings(errPaths)
+	require.Equal(t, []string{"/virtual/coarse.bin", "/virtual/wrong.bin"}, errPaths)
+	require.Equal(t, uint(1), client.shareCount)
+
+	sfile := client.shareFileByPath("/virtual/good.bin")
+	require.NotNil(t, sfile)
+	require.Equal(t, 7, len(sfile.tthl))
+	require.Equal(t, sfile.tth, sfile.tthl.TreeHash())
+}
+
+func TestShareProviderDuplicates(t *testing.T) {
+	var errPaths []string
+
+	client := testShareIndex(t, ClientConf{}, func(client *Client) {
+		client.OnShareIndexError = func(fpath string, err error) {
+			errPaths = append(errPaths, fpath)
+		}
+		require.NoError(t, client.ShareAddProvider("virtual", testShareEntriesProvider{
+			{Path: "first", Size: 100},
+			{Path: "first/inside.txt", Size: 200},
+			{Path: "second/deep/inside.txt", Size: 300},
+			{Path: "second", Size: 400},
+		}))
+	})
+
+	// a name is used by a file or by a directory, whatever comes first
+	require.Equal(t, []string{"/virtual/first/inside.txt", "/virtual/second"}, errPaths)
+	require.NotNil(t, client.shareFileByPath("/virtual/first"))
+	require.Nil(t, client.shareTree["virtual"].dirs["first"])
+	require.NotNil(t, client.shareFileByPath("/virtual/second/deep/inside.txt"))
+	require.Equal(t, uint(2), client.shareCount)
+	require.Equal(t, uint64(400), client.shareSize)
+}
+
+func TestShareLeaves(t *testing.T) {
+	dir := testShareDir(t, map[string]string{
+		"share/file.bin": strings.Repeat("A", 100*1024),
+	})
+	defer os.RemoveAll(dir)
+
+	client := testShareIndex(t, ClientConf{
+		HashDBPath:     filepath.Join(dir, "hashdb"),
+		ShareTTHLDepth: 3,
+	}, func(client *Client) {
+		require.NoError(t, client.ShareAdd("share", filepath.Join(dir, "share")))
+	})
+
+	sfile := client.shareFileByPath("/share/file.bin")
+	require.NotNil(t, sfile)
+	require.Nil(t, sfile.tthl)
+
+	// leaves are stored on disk
+	stored, ok := client.shareIndexer.leaves.load(sfile.tth)
+	require.True(t, ok)
+	require.Equal(t, 7, len(stored))
+
+	tthl, err := client.shareIndexer.fileLeaves(sfile)
+	require.NoError(t, err)
+	require.Equal(t, stored, tthl)
+	require.Equal(t, sfile.tth, tthl.TreeHash())
+
+	// missing leaves are computed again and stored
+	require.NoError(t, os.Remove(client.shareIndexer.leaves.path(sfile.tth)))
+	tthl, err = client.shareIndexer.fileLeaves(sfile)
+	require.NoError(t, err)
+	require.Equal(t, stored, tthl)
+	_, ok = client.shareIndexer.leaves.load(sfile.tth)
+	require.True(t, ok)
+
+	// leaves of files that are not shared anymore are removed
+	require.NoError(t, client.shareIndexer.leaves.save(tiger.Hash{}, tiger.Leaves{{}}))
+	require.NoError(t, client.shareIndexer.leaves.prune(client.shareIndex.byTTH))
+	_, err = os.Stat(client.shareIndexer.leaves.path(tiger.Hash{}))
+	require.True(t, os.IsNotExist(err))
+	_, ok = client.shareIndexer.leaves.load(sfile.tth)
+	require.True(t, ok)
+
+	// leaves of the same TTH can be saved concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, client.shareIndexer.leaves.save(sfile.tth, stored))
+		}()
+	}
+	wg.Wait()
+	tthl, ok = client.shareIndexer.leaves.load(sfile.tth)
+	require.True(t, ok)
+	require.Equal(t, stored, tthl)
+
+	// temporary files of saves in progress are not removed
+	tmpPath := client.shareIndexer.leaves.path(sfile.tth) + ".123" + leavesStoreTmpSuffix
+	require.NoError(t, ioutil.WriteFile(tmpPath, nil, 0o644))
+	require.NoError(t, client.shareIndexer.leaves.prune(client.shareIndex.byTTH))
+	_, err = os.Stat(tmpPath)
+	require.NoError(t, err)
+}
+
+func TestShareProfiles(t *testing.T) {
+	dir := testShareDir(t, map[string]string{
+		"public/public.txt": strings.Repeat("A", 100),
+		"extra/private.txt": strings.Repeat("B", 200),
+	})
+	defer os.RemoveAll(dir)
+
+	client := testShareIndex(t, ClientConf{
+		ShareProfile: "public",
+		SharePeerProfile: func(p *Peer) string {
+			switch p.Nick {
+			case "friend":
+				return "friends"
+			case "misspelled":
+				return "frends"
+			}
+			return ""
+		},
+	}, func(client *Client) {
+		require.NoError(t, client.ShareAdd("public", filepath.Join(dir, "public")))
+		require.NoError(t, client.ShareAdd("extra", filepath.Join(dir, "extra")))
+		client.ShareProfileSet("public", []string{"public"})
+		client.ShareProfileSet("friends", []string{"public", "extra"})
+	})
+
+	friend := &Peer{Nick: "friend"}
+	stranger := &Peer{Nick: "stranger"}
+
+	// the hub sees the public profile
+	require.Equal(t, uint(1), client.shareCount)
+	require.Equal(t, uint64(100), client.shareSize)
+	require.Equal(t, uint64(300), client.shareProfileFor(friend).size)
+
+	// peers with an undefined profile see the profile of the hub
+	misspelled := &Peer{Nick: "misspelled"}
+	require.Equal(t, client.shareProfiles["public"], client.shareProfileFor(misspelled))
+	require.Equal(t, client.shareProfiles["public"], client.shareProfileFor(misspelled))
+	require.Equal(t, map[string]struct{}{"frends": {}}, client.shareProfileWarned)
+
+	listPaths := func(fileList []byte) []string {
+		var paths []string
+		err := NewFileListReaderBzip2(bytes.NewReader(fileList)).Walk(
+			func(fpath string, dir *FileListDirectory, file *FileListFile) error {
+				if file != nil {
+					paths = append(paths, fpath)
+				}
+				return nil
+			})
+		require.NoError(t, err)
+		return paths
+	}
+	require.Equal(t, []string{"/public/public.txt"}, listPaths(client.shareProfileFor(stranger).fileList))
+	require.Equal(t, []string{"/extra/private.txt", "/public/public.txt"},
+		listPaths(client.shareProfileFor(friend).fileList))
+
+	search := func(peer *Peer) int {
+		res, err := client.handleSearchIncomingRequest(&searchIncomingRequest{
+			peer:  peer,
+			stype: SearchAny,
+			query: ".txt",
+		})
+		require.NoError(t, err)
+		return len(res)
+	}
+	require.Equal(t, 1, search(nil))
+	require.Equal(t, 1, search(stranger))
+	require.Equal(t, 2, search(friend))
+
+	private := client.shareFileByPath("/extra/private.txt")
+	require.Nil(t, client.shareVisibleFileByTTH(client.shareProfileFor(stranger), private.tth))
+	require.Equal(t, private, client.shareVisibleFileByTTH(client.shareProfileFor(friend), private.tth))
+
+	_, err := client.sharePartialList(client.shareProfileFor(stranger), "/extra", false)
+	require.Error(t, err)
+	_, err = client.sharePartialList(client.shareProfileFor(friend), "/extra", false)
+	require.NoError(t, err)
+
+	// an undefined profile of the hub is replaced by the profile with empty name
+	client = testShareIndex(t, ClientConf{
+		ShareProfile: "undefined",
+	}, func(client *Client) {
+		require.NoError(t, client.ShareAdd("public", filepath.Join(dir, "public")))
+		require.NoError(t, client.ShareAdd("extra", filepath.Join(dir, "extra")))
+	})
+	require.Equal(t, uint(2), client.shareCount)
+	require.Equal(t, uint64(300), client.shareSize)
+	require.Equal(t, client.shareProfiles[""], client.shareProfileFor(nil))
+}
+
+func TestShareQuery(t *testing.T) {
+	dir := testShareDir(t, map[string]string{
+		"readme.txt":          strings.Repeat("A", 100),
+		"docs/manual.txt":     strings.Repeat("B", 200),
+		"docs/old/manual.txt": strings.Repeat("B", 200),
+	})
+	defer os.RemoveAll(dir)
+
+	client := testShareIndex(t, ClientConf{}, func(client *Client) {
+		require.NoError(t, client.ShareAdd("share", dir))
+	})
+
+	tree := client.ShareTree()
+	require.Equal(t, 1, len(tree))
+	require.Equal(t, "share", tree[0].Name)
+	require.Equal(t, uint64(500), tree[0].Size)
+	require.Equal(t, 1, len(tree[0].Files))
+	require.Equal(t, "/share/readme.txt", tree[0].Files[0].Path)
+	require.Equal(t, filepath.Join(dir, "readme.txt"), tree[0].Files[0].RealPath)
+	require.Equal(t, "docs", tree[0].Dirs[0].Name)
+	require.Equal(t, "/share/docs/old", tree[0].Dirs[0].Dirs[0].Path)
+
+	manual := tree[0].Dirs[0].Files[0]
+	files := client.ShareLookup(manual.TTH)
+	require.Equal(t, 2, len(files))
+	require.Equal(t, "/share/docs/manual.txt", files[0].Path)
+	require.Equal(t, "/share/docs/old/manual.txt", files[1].Path)
+	require.Equal(t, 0, len(client.ShareLookup(tiger.Hash{})))
+
+	res, err := client.ShareSearch(SearchConf{Query: "manual"})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	require.Equal(t, "/share/docs/manual.txt", res[0].Path)
+	require.Equal(t, manual.TTH, *res[0].TTH)
+
+	res, err = client.ShareSearch(SearchConf{Type: SearchDirectory, Query: "docs"})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	require.True(t, res[0].IsDir)
+
+	res, err = client.ShareSearch(SearchConf{Type: SearchTTH, TTH: manual.TTH})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+
+	_, err = client.ShareSearch(SearchConf{Query: "a"})
+	require.Error(t, err)
+
+	fl := client.OwnFileList()
+	f, err := fl.GetFile("/share/docs/old/manual.txt")
+	require.NoError(t, err)
+	require.Equal(t, manual.TTH, f.TTH)
+	require.Equal(t, uint64(200), f.Size)
+}
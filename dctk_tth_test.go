@@ -1,6 +1,7 @@
 package dctk
 
 import (
+	"bytes"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -51,3 +52,21 @@ func TestTigerLeavesSave(t *testing.T) {
 		require.Equal(t, c.b, b)
 	}
 }
+
+func TestTigerLeavesReduce(t *testing.T) {
+	for _, size := range []int{0, 1024, 1025, 5000, 100 * 1024} {
+		l, err := tiger.LeavesFromBytes(bytes.Repeat([]byte{'A'}, size))
+		require.NoError(t, err)
+
+		for _, depth := range []uint{0, 1, 2, 5, 10} {
+			r := l.Reduce(depth)
+			require.Equal(t, tiger.LeavesCount(uint64(size), depth), len(r))
+			require.True(t, len(r) <= 1<<depth)
+			require.Equal(t, l.TreeHash(), r.TreeHash())
+		}
+	}
+
+	l := testCasesTTH[0].l
+	require.Equal(t, l, l.Reduce(2))
+	require.Equal(t, tiger.Leaves{l.TreeHash()}, l.Reduce(0))
+}
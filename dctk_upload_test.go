@@ -0,0 +1,322 @@
+package dctk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aler9/go-dc/nmdc"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/dctk/pkg/protonmdc"
+)
+
+func TestUploadPolicy(t *testing.T) {
+	bl := NewUploadBanList()
+	bl.BanNick("banned")
+	bl.BanIP("10.0.0.1")
+
+	policy := UploadPolicyChain(
+		bl.Policy(),
+		UploadPolicyMinShare(1000),
+	)
+
+	for _, c := range []struct {
+		name     string
+		peer     *Peer
+		query    string
+		decision UploadDecision
+		msg      string
+	}{
+		{"allowed", &Peer{Nick: "user", ShareSize: 1000}, "file TTH/A", UploadAllow, ""},
+		{"banned nick", &Peer{Nick: "banned", ShareSize: 1000}, "file TTH/A", UploadDeny, "Banned"},
+		{"banned ip", &Peer{Nick: "user", IP: "10.0.0.1", ShareSize: 1000}, "file TTH/A", UploadDeny, "Banned"},
+		{"small share", &Peer{Nick: "user", ShareSize: 999}, "file TTH/A", UploadDeny, "Share size too small"},
+		{"small share filelist", &Peer{Nick: "user", ShareSize: 999}, "file files.xml.bz2", UploadAllow, ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			dec, msg := policy(&UploadRequest{Peer: c.peer, Query: c.query, Length: -1})
+			require.Equal(t, c.decision, dec)
+			require.Equal(t, c.msg, msg)
+		})
+	}
+
+	bl.UnbanNick("banned")
+	dec, _ := policy(&UploadRequest{Peer: &Peer{Nick: "banned", ShareSize: 1000}, Query: "file TTH/A", Length: -1})
+	require.Equal(t, UploadAllow, dec)
+
+	dec, _ = UploadPolicyOperatorsOnly()(&UploadRequest{Peer: &Peer{Nick: "user"}})
+	require.Equal(t, UploadDeny, dec)
+	dec, _ = UploadPolicyRegisteredOnly()(&UploadRequest{Peer: &Peer{Nick: "user", IsRegistered: true}})
+	require.Equal(t, UploadAllow, dec)
+}
+
+func TestUploadQueue(t *testing.T) {
+	c := &Client{conf: ClientConf{
+		UploadQueueMaxLen: 2,
+		UploadQueueExpiry: time.Minute,
+	}}
+	p1 := &Peer{Nick: "first"}
+	p2 := &Peer{Nick: "second"}
+	p3 := &Peer{Nick: "third"}
+
+	require.Equal(t, 1, c.uploadQueueAdd(p1))
+	require.Equal(t, 2, c.uploadQueueAdd(p2))
+	require.Equal(t, 0, c.uploadQueueAdd(p3))
+	require.Equal(t, 2, c.uploadQueueAdd(p2))
+
+	require.Equal(t, uint(0), c.uploadQueueAhead(p1))
+	require.Equal(t, uint(1), c.uploadQueueAhead(p2))
+	require.Equal(t, uint(2), c.uploadQueueAhead(p3))
+
+	c.uploadQueueRemove(p1)
+	require.Equal(t, uint(0), c.uploadQueueAhead(p2))
+
+	// expired entries are removed
+	c.uploadQueue[0].lastSeen = time.Now().Add(-2 * time.Minute)
+	require.Equal(t, uint(0), c.uploadQueueAhead(p3))
+	require.Equal(t, 1, c.uploadQueueAdd(p3))
+
+	// stale entries are skipped, but keep their position
+	c.conf.UploadQueueExpiry = 10 * time.Minute
+	require.Equal(t, 2, c.uploadQueueAdd(p1))
+	c.uploadQueue[0].lastSeen = time.Now().Add(-3 * time.Minute)
+	require.Equal(t, uint(0), c.uploadQueueAhead(p1))
+	require.Equal(t, 1, c.uploadQueueAdd(p1))
+	require.Equal(t, 2, len(c.uploadQueue))
+	require.Equal(t, 1, c.uploadQueueAdd(p3))
+	require.Equal(t, uint(1), c.uploadQueueAhead(p1))
+}
+
+func TestUploadReservedSlots(t *testing.T) {
+	c := &Client{
+		conf:            ClientConf{UploadReservedSlots: 2},
+		uploadSlotAvail: 5,
+	}
+	require.Equal(t, uint(3), c.uploadPublicSlotAvail())
+
+	// reserved uploads use reserved slots first
+	c.uploadSlotAvail, c.uploadReservedUsed = 4, 1
+	require.Equal(t, uint(3), c.uploadPublicSlotAvail())
+	c.uploadSlotAvail, c.uploadReservedUsed = 2, 3
+	require.Equal(t, uint(2), c.uploadPublicSlotAvail())
+
+	// normal uploads cannot use reserved slots
+	c.uploadSlotAvail, c.uploadReservedUsed = 2, 0
+	require.Equal(t, uint(0), c.uploadPublicSlotAvail())
+
+	_, err := NewClient(ClientConf{
+		HubURL:              "adc://127.0.0.1:5000",
+		Nick:                "testdctk",
+		IsPassive:           true,
+		UploadMaxParallel:   2,
+		UploadReservedSlots: 3,
+	})
+	require.Error(t, err)
+}
+
+func TestUploadCompressionSkip(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		skip bool
+	}{
+		{"video.mkv", true},
+		{"Photo.JPG", true},
+		{"archive.tar.gz", true},
+		{"document.txt", false},
+		{"noextension", false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			require.Equal(t, c.skip, compressionSkipByName(c.name))
+		})
+	}
+
+	random := make([]byte, compressionSampleSize)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	var zlibbed bytes.Buffer
+	zw := zlib.NewWriter(&zlibbed)
+	zw.Write([]byte(strings.Repeat("compressed content ", 1000)))
+	zw.Close()
+
+	for _, c := range []struct {
+		name   string
+		sample []byte
+		skip   bool
+	}{
+		{"text", []byte(strings.Repeat("text content ", 1000)), false},
+		{"png", append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 1000)...), true},
+		{"zip", append([]byte("PK\x03\x04"), bytes.Repeat([]byte{0}, 1000)...), true},
+		{"random", random, true},
+		{"zlib", zlibbed.Bytes(), true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			require.Equal(t, c.skip, compressionSkipByContent(c.sample, zlib.DefaultCompression))
+		})
+	}
+}
+
+func TestUploadLegacy(t *testing.T) {
+	content := strings.Repeat("0123456789", 3000)
+	dir := testShareDir(t, map[string]string{"folder/test file.txt": content})
+	defer os.RemoveAll(dir)
+
+	client := testLegacyClient(t, dir)
+
+	// uploads end after the peer has received the content
+	uploadStats := func() UploadStats {
+		var stats UploadStats
+		client.Safe(func() { stats = client.UploadStats() })
+		return stats
+	}
+	waitUploads := func(t *testing.T, count uint64) {
+		require.Eventually(t, func() bool {
+			return uploadStats().Finished == count
+		}, 2*time.Second, 10*time.Millisecond)
+	}
+
+	t.Run("get", func(t *testing.T) {
+		conn := testLegacyPeer(t, client, "get", false, []string{nmdc.ExtMinislots})
+
+		conn.Write(&protonmdc.NmdcGet{Filename: "share\\folder\\test file.txt", Start: 101})
+		msg, err := conn.Read()
+		require.NoError(t, err)
+		// FileLength contains the entire file size
+		require.Equal(t, &protonmdc.NmdcFileLength{Length: uint64(len(content))}, msg)
+
+		// the upload starts when Send is received
+		conn.Write(&protonmdc.NmdcSend{})
+		require.Equal(t, content[100:], string(testReadBinary(t, conn, len(content)-100)))
+		waitUploads(t, 1)
+	})
+
+	t.Run("get missing", func(t *testing.T) {
+		conn := testLegacyPeer(t, client, "getmissing", false, []string{nmdc.ExtMinislots})
+
+		conn.Write(&protonmdc.NmdcGet{Filename: "share\\missing.txt", Start: 1})
+		msg, err := conn.Read()
+		require.NoError(t, err)
+		require.IsType(t, &nmdc.Error{}, msg)
+	})
+
+	t.Run("ugetblock", func(t *testing.T) {
+		conn := testLegacyPeer(t, client, "ugetblock", false,
+			[]string{nmdc.ExtMinislots, nmdc.ExtXmlBZList})
+
+		conn.Write(&protonmdc.NmdcGetBlock{Unicode: true, Start: 100, Length: 1000,
+			Filename: "share\\folder\\test file.txt"})
+		msg, err := conn.Read()
+		require.NoError(t, err)
+		require.Equal(t, &protonmdc.NmdcSending{Length: 1000}, msg)
+		require.Equal(t, content[100:1100], string(testReadBinary(t, conn, 1000)))
+		waitUploads(t, 2)
+	})
+
+	t.Run("ugetzblock", func(t *testing.T) {
+		conn := testLegacyPeer(t, client, "ugetzblock", false,
+			[]string{nmdc.ExtMinislots, nmdc.ExtXmlBZList, nmdc.ExtGetZBlock})
+
+		conn.Write(&protonmdc.NmdcGetBlock{Unicode: true, Compressed: true, Start: 0, Length: -1,
+			Filename: "share\\folder\\test file.txt"})
+		msg, err := conn.Read()
+		require.NoError(t, err)
+		require.Equal(t, &protonmdc.NmdcSending{Length: int64(len(content))}, msg)
+		require.NoError(t, conn.EnableReaderZlib())
+		require.Equal(t, content, string(testReadBinary(t, conn, len(content))))
+
+		// read the end of the compressed stream
+		conn.SetBinaryMode(true)
+		go conn.Read()
+
+		waitUploads(t, 3)
+		require.Equal(t, uint64(1), uploadStats().Compressed)
+	})
+}
+
+// testSlowProvider is a provider whose files are opened after release is
+// closed. opening receives the path of every file that is being opened.
+type testSlowProvider struct {
+	testShareProvider
+	opening chan string
+	release chan struct{}
+}
+
+func (p *testSlowProvider) Open(fpath string) (io.ReaderAt, error) {
+	p.opening <- fpath
+	<-p.release
+	return p.testShareProvider.Open(fpath)
+}
+
+func TestUploadProviderOpen(t *testing.T) {
+	dir := testShareDir(t, nil)
+	defer os.RemoveAll(dir)
+
+	client := testLegacyClient(t, dir)
+
+	provider := &testSlowProvider{
+		testShareProvider: testShareProvider{
+			"slow.txt": []byte(strings.Repeat("A", 1000)),
+		},
+		opening: make(chan string, 1),
+		release: make(chan struct{}),
+	}
+	client.Safe(func() {
+		require.NoError(t, client.ShareAddProvider("virtual", provider))
+	})
+	require.Eventually(t, func() bool {
+		found := false
+		client.Safe(func() { found = (client.shareFileByPath("/virtual/slow.txt") != nil) })
+		return found
+	}, 2*time.Second, 10*time.Millisecond)
+
+	conn := testLegacyPeer(t, client, "provider", false, []string{nmdc.ExtMinislots, nmdc.ExtXmlBZList})
+	conn.Write(&protonmdc.NmdcGetBlock{Unicode: true, Start: 0, Length: -1,
+		Filename: "virtual\\slow.txt"})
+
+	// the file is opened without holding the client mutex
+	require.Equal(t, "slow.txt", <-provider.opening)
+	locked := make(chan struct{})
+	go client.Safe(func() { close(locked) })
+	select {
+	case <-locked:
+	case <-time.After(2 * time.Second):
+		t.Fatal("client mutex is held while opening the file")
+	}
+	close(provider.release)
+
+	msg, err := conn.Read()
+	require.NoError(t, err)
+	require.Equal(t, &protonmdc.NmdcSending{Length: 1000}, msg)
+	require.Equal(t, strings.Repeat("A", 1000), string(testReadBinary(t, conn, 1000)))
+
+	// files that cannot be opened are reported to the peer, and the
+	// connection can be used again
+	delete(provider.testShareProvider, "slow.txt")
+	conn.Write(&protonmdc.NmdcGetBlock{Unicode: true, Start: 0, Length: -1,
+		Filename: "virtual\\slow.txt"})
+	require.Equal(t, "slow.txt", <-provider.opening)
+	msg, err = conn.Read()
+	require.NoError(t, err)
+	require.IsType(t, &nmdc.Failed{}, msg)
+
+	provider.testShareProvider["slow.txt"] = []byte(strings.Repeat("B", 1000))
+	conn.Write(&protonmdc.NmdcGetBlock{Unicode: true, Start: 0, Length: -1,
+		Filename: "virtual\\slow.txt"})
+	require.Equal(t, "slow.txt", <-provider.opening)
+	msg, err = conn.Read()
+	require.NoError(t, err)
+	require.Equal(t, &protonmdc.NmdcSending{Length: 1000}, msg)
+	require.Equal(t, strings.Repeat("B", 1000), string(testReadBinary(t, conn, 1000)))
+
+	// uploads end after the peer has received the content
+	require.Eventually(t, func() bool {
+		var stats UploadStats
+		client.Safe(func() { stats = client.UploadStats() })
+		return stats.Finished == 2
+	}, 2*time.Second, 10*time.Millisecond)
+}
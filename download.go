@@ -7,6 +7,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
@@ -17,6 +18,7 @@ import (
 	"github.com/aler9/dctk/pkg/log"
 	"github.com/aler9/dctk/pkg/protoadc"
 	"github.com/aler9/dctk/pkg/protocommon"
+	"github.com/aler9/dctk/pkg/protonmdc"
 	"github.com/aler9/dctk/pkg/tiger"
 )
 
@@ -30,6 +32,10 @@ type DownloadConf struct {
 	Peer *Peer
 	// the TTH of the file to download
 	TTH tiger.Hash
+	// the path of the file to download inside the peer share, in the format
+	// /alias/dir/name. It can be used in place of TTH when the TTH is unknown.
+	// If TTH is filled too, it is used to validate the file
+	Path string
 	// the starting point of the file part to download, in bytes
 	Start uint64
 	// the length of the file part. Leave zero to download the entire file
@@ -39,7 +45,16 @@ type DownloadConf struct {
 	// after download, do not attempt to validate the file through its TTH
 	SkipValidation bool
 
-	isFilelist bool
+	isFilelist    bool
+	isLeaves      bool
+	listPath      string
+	listRecursive bool
+	// do not decompress the file list
+	listKeepCompressed bool
+	// the file list is saved in the file list cache
+	listCached bool
+	// name of the file, used to decide whether to request compression
+	fileName string
 }
 
 // Download represents an in-progress file download.
@@ -55,10 +70,15 @@ type Download struct {
 	pconn              *peerConn
 	query              string
 	adcToken           string
+	nmdcLegacyRequest  protocommon.MsgEncodable
 	writer             io.WriteCloser
 	content            []byte
+	leaves             tiger.Leaves
+	partialList        *FileListDirectory
 	offset             uint64
 	length             uint64
+	isCompressed       bool
+	wireBytes          uint64
 	lastPrintTime      time.Time
 }
 
@@ -87,9 +107,30 @@ func (c *Client) downloadByAdcToken(adcToken string) *Download {
 }
 
 func (c *Client) downloadPendingByPeer(peer *Peer) *Download {
-	dl, ok := c.activeDownloadsByPeer[peer.Nick]
-	if ok && !dl.terminateRequested && dl.state == "waiting_peer" {
-		return dl
+	for dl := range c.activeDownloadsByPeer[peer.Nick] {
+		if !dl.terminateRequested && dl.state == "waiting_peer" {
+			return dl
+		}
+	}
+	return nil
+}
+
+func (c *Client) downloadSetActive(d *Download) {
+	active, ok := c.activeDownloadsByPeer[d.conf.Peer.Nick]
+	if !ok {
+		active = make(map[*Download]struct{})
+		c.activeDownloadsByPeer[d.conf.Peer.Nick] = active
+	}
+	active[d] = struct{}{}
+}
+
+// downloadIdleConn returns an idle download connection with the given peer.
+func (c *Client) downloadIdleConn(peer *Peer) *peerConn {
+	for key, pconn := range c.peerConnsByKey {
+		if key.nick == peer.Nick && key.direction == "download" &&
+			!pconn.terminateRequested && pconn.state == "wait_download" {
+			return pconn
+		}
 	}
 	return nil
 }
@@ -103,12 +144,56 @@ func (c *Client) DownloadFileList(peer *Peer, savePath string) (*Download, error
 	})
 }
 
+// DownloadFileListCompressed starts downloading the file list of a given peer,
+// without decompressing it. When the download is finished, the file list can
+// be decoded progressively through Download.FileListReader(), with low memory
+// usage. Content() and the saved file contain the compressed file list,
+// unless the peer does not support compression.
+func (c *Client) DownloadFileListCompressed(peer *Peer, savePath string) (*Download, error) {
+	return c.DownloadFile(DownloadConf{
+		Peer:               peer,
+		SavePath:           savePath,
+		isFilelist:         true,
+		listKeepCompressed: true,
+	})
+}
+
+// DownloadLeaves starts downloading the TTH leaves of a file with the given TTH.
+// When the download is finished, leaves are validated against the TTH and
+// are available through Download.Leaves().
+func (c *Client) DownloadLeaves(peer *Peer, tth tiger.Hash) (*Download, error) {
+	return c.DownloadFile(DownloadConf{
+		Peer:     peer,
+		TTH:      tth,
+		isLeaves: true,
+	})
+}
+
+// DownloadPartialList starts downloading a partial file list of a given peer,
+// that contains only the directory with the given path. If recursive is false,
+// subdirectories are returned without their content. When the download is
+// finished, the directory is available through Download.PartialList().
+func (c *Client) DownloadPartialList(peer *Peer, dpath string, recursive bool) (*Download, error) {
+	// path must start and end with a slash
+	dpath = "/" + strings.Trim(dpath, "/") + "/"
+	if dpath == "//" {
+		dpath = "/"
+	}
+
+	return c.DownloadFile(DownloadConf{
+		Peer:          peer,
+		listPath:      dpath,
+		listRecursive: recursive,
+	})
+}
+
 // DownloadFLFile starts downloading a file given a file list entry.
 func (c *Client) DownloadFLFile(peer *Peer, file *FileListFile, savePath string) (*Download, error) {
 	return c.DownloadFile(DownloadConf{
 		Peer:     peer,
 		TTH:      file.TTH,
 		SavePath: savePath,
+		fileName: file.Name,
 	})
 }
 
@@ -142,6 +227,18 @@ func (c *Client) DownloadFile(conf DownloadConf) (*Download, error) {
 	if conf.Length <= 0 {
 		conf.Length = -1
 	}
+	if conf.isLeaves && (conf.Start != 0 || conf.Length != -1 || conf.SavePath != "") {
+		return nil, fmt.Errorf("leaves can only be downloaded entirely and in RAM")
+	}
+	if conf.listPath != "" && (conf.Start != 0 || conf.Length != -1 || conf.SavePath != "") {
+		return nil, fmt.Errorf("partial lists can only be downloaded entirely and in RAM")
+	}
+	if conf.Path != "" && (conf.isFilelist || conf.isLeaves || conf.listPath != "") {
+		return nil, fmt.Errorf("path can only be used with files")
+	}
+	if conf.Path != "" && !strings.HasPrefix(conf.Path, "/") {
+		return nil, fmt.Errorf("path must start with a slash")
+	}
 
 	d := &Download{
 		conf:         conf,
@@ -159,6 +256,15 @@ func (c *Client) DownloadFile(conf DownloadConf) (*Download, error) {
 		if d.conf.isFilelist {
 			return "file files.xml.bz2"
 		}
+		if d.conf.isLeaves {
+			return "tthl TTH/" + d.conf.TTH.String()
+		}
+		if d.conf.listPath != "" {
+			return "list " + d.conf.listPath
+		}
+		if d.conf.Path != "" {
+			return "file " + d.conf.Path
+		}
 		return "file TTH/" + d.conf.TTH.String()
 	}()
 
@@ -181,6 +287,59 @@ func (d *Download) Content() []byte {
 	return d.content
 }
 
+// FileListReader returns a reader that decodes the downloaded file list ONLY
+// if the download was started with DownloadFileList() or
+// DownloadFileListCompressed(). The reader must be closed after use.
+func (d *Download) FileListReader() (*FileListReader, error) {
+	if !d.conf.isFilelist {
+		return nil, fmt.Errorf("download is not a file list")
+	}
+
+	var r io.Reader
+	var closer io.Closer
+	if d.conf.SavePath != "" {
+		f, err := os.Open(d.conf.SavePath)
+		if err != nil {
+			return nil, err
+		}
+		r = f
+		closer = f
+	} else {
+		r = bytes.NewReader(d.content)
+	}
+
+	var flr *FileListReader
+	if d.conf.listKeepCompressed && d.query == "file files.xml.bz2" {
+		flr = NewFileListReaderBzip2(r)
+	} else {
+		flr = NewFileListReader(r)
+	}
+	flr.closer = closer
+	return flr, nil
+}
+
+// PartialList returns the downloaded directory ONLY if the download was started
+// with DownloadPartialList().
+func (d *Download) PartialList() *FileListDirectory {
+	return d.partialList
+}
+
+// Leaves returns the downloaded TTH leaves ONLY if the download was started
+// with DownloadLeaves().
+func (d *Download) Leaves() tiger.Leaves {
+	return d.leaves
+}
+
+// Stats returns statistics about the data received. They are complete when
+// the download has finished.
+func (d *Download) Stats() TransferStats {
+	return TransferStats{
+		Compressed: d.isCompressed,
+		RawBytes:   d.offset,
+		WireBytes:  d.wireBytes,
+	}
+}
+
 // Close stops the download. OnDownloadError and OnDownloadSuccessful are not called.
 func (d *Download) Close() {
 	if d.terminateRequested {
@@ -199,15 +358,15 @@ func (d *Download) do() {
 	defer d.client.wg.Done()
 
 	err := func() error {
-		// check if there are other downloads active on peer and eventually wait
+		// check if there are too many downloads active on peer and eventually wait
 		wait := false
 		d.client.Safe(func() {
-			if _, ok := d.client.activeDownloadsByPeer[d.conf.Peer.Nick]; ok {
+			if uint(len(d.client.activeDownloadsByPeer[d.conf.Peer.Nick])) >= d.client.conf.MaxDownloadConnsPerPeer {
 				d.state = "waiting_activedl"
 				wait = true
 			} else {
 				d.state = "waited_activedl"
-				d.client.activeDownloadsByPeer[d.conf.Peer.Nick] = d
+				d.client.downloadSetActive(d)
 			}
 		})
 		if wait {
@@ -240,13 +399,12 @@ func (d *Download) do() {
 		// check if there is a connection with peer and eventually wait
 		wait = false
 		d.client.Safe(func() {
-			if pconn, ok := d.client.peerConnsByKey[nickDirectionPair{d.conf.Peer.Nick, "download"}]; !ok {
+			if pconn := d.client.downloadIdleConn(d.conf.Peer); pconn == nil {
 				log.Log(d.client.conf.LogLevel, log.LevelDebug, "[download] [%s] requesting new connection", d.conf.Peer.Nick)
 
-				// generate new token
-				if d.client.protoIsAdc() {
-					d.adcToken = protoadc.AdcRandomToken()
-				}
+				// generate new token. In NMDC, it is used only to tell
+				// connections apart, since it can't be sent to the peer
+				d.adcToken = protoadc.AdcRandomToken()
 
 				d.client.peerRequestConnection(d.conf.Peer, d.adcToken)
 				d.state = "waiting_peer"
@@ -254,7 +412,7 @@ func (d *Download) do() {
 
 			} else {
 				log.Log(d.client.conf.LogLevel, log.LevelDebug, "[download] [%s] using existing connection", d.conf.Peer.Nick)
-				pconn.state = "delegated_download"
+				pconn.setBusy("delegated_download")
 				pconn.transfer = d
 				d.pconn = pconn
 				d.state = "processing"
@@ -274,28 +432,57 @@ func (d *Download) do() {
 		// process download
 		log.Log(d.client.conf.LogLevel, log.LevelInfo, "[download] [%s] processing", d.conf.Peer.Nick)
 
+		d.client.Safe(func() {
+			// peers that do not support bzip2 provide only the uncompressed file list
+			if d.conf.isFilelist && !d.pconn.supportsBzipList() {
+				d.query = "file files.xml"
+			}
+		})
+
+		// exclude messages received before the request
+		d.pconn.conn.PullReadCounter()
+
 		if d.client.protoIsAdc() {
-			queryParts := strings.Split(d.query, " ")
+			queryParts := strings.SplitN(d.query, " ", 2)
 			d.pconn.conn.Write(&protoadc.AdcCGetFile{ //nolint:govet
 				&adc.ClientPacket{},
-				&adc.GetRequest{
-					Type:  queryParts[0],
-					Path:  queryParts[1],
-					Start: int64(d.conf.Start),
-					Bytes: d.conf.Length,
-					Compressed: (!d.client.conf.PeerDisableCompression &&
-						(d.conf.Length <= 0 || d.conf.Length >= (1024*10))),
+				&protoadc.AdcGetRequest{
+					GetRequest: adc.GetRequest{
+						Type:       queryParts[0],
+						Path:       queryParts[1],
+						Start:      int64(d.conf.Start),
+						Bytes:      d.conf.Length,
+						Compressed: d.compressionWanted(),
+					},
+					Recursive: d.conf.listRecursive,
 				},
 			})
+		} else if _, ok := d.pconn.remoteFeatures[nmdc.ExtADCGet]; !ok {
+			var err error
+			d.client.Safe(func() {
+				d.nmdcLegacyRequest, err = d.buildNmdcLegacyRequest()
+				if err != nil {
+					// give back the connection
+					d.pconn.transfer = nil
+					d.pconn.setIdle("wait_download")
+				}
+			})
+			if err != nil {
+				return err
+			}
+			d.pconn.conn.Write(d.nmdcLegacyRequest)
+
 		} else {
-			queryParts := strings.Split(d.query, " ")
-			d.pconn.conn.Write(&nmdc.ADCGet{
-				ContentType: nmdc.String(queryParts[0]),
-				Identifier:  nmdc.String(queryParts[1]),
-				Start:       d.conf.Start,
-				Length:      d.conf.Length,
-				Compressed: (!d.client.conf.PeerDisableCompression &&
-					(d.conf.Length <= 0 || d.conf.Length >= (1024*10))),
+			queryParts := strings.SplitN(d.query, " ", 2)
+			d.pconn.conn.Write(&protonmdc.NmdcAdcGet{
+				ADCGet: nmdc.ADCGet{
+					ContentType: nmdc.String(queryParts[0]),
+					Identifier:  nmdc.String(queryParts[1]),
+					Start:       d.conf.Start,
+					Length:      d.conf.Length,
+					Compressed:  d.compressionWanted(),
+				},
+				Recursive: d.conf.listRecursive,
 			})
 		}
 
@@ -309,6 +496,67 @@ func (d *Download) do() {
 	}
 }
 
+// compressionWanted returns whether the content is worth being compressed
+// during the transfer.
+func (d *Download) compressionWanted() bool {
+	switch {
+	case d.client.conf.PeerDisableCompression:
+		return false
+
+	// leaves are hashes, compressed file lists are already compressed
+	case d.conf.isLeaves, d.query == "file files.xml.bz2":
+		return false
+
+	// xml compresses well
+	case d.conf.isFilelist, d.conf.listPath != "":
+		return true
+
+	case compressionSkipByName(d.conf.Path), compressionSkipByName(d.conf.fileName):
+		return false
+	}
+
+	return d.conf.Length <= 0 || d.conf.Length >= compressionMinSize
+}
+
+// buildNmdcLegacyRequest builds a request for NMDC peers that do not support
+// ADCGet. These peers support only file lists and files by path.
+func (d *Download) buildNmdcLegacyRequest() (protocommon.MsgEncodable, error) {
+	var filename string
+	switch {
+	case d.conf.isFilelist:
+		if _, ok := d.pconn.remoteFeatures[nmdc.ExtXmlBZList]; !ok {
+			return nil, fmt.Errorf("peer does not support XML file lists")
+		}
+		filename = "files.xml.bz2"
+
+	case d.conf.Path != "":
+		filename = strings.ReplaceAll(strings.TrimPrefix(d.conf.Path, "/"), "/", "\\")
+
+	default:
+		return nil, fmt.Errorf("peer does not support ADCGet, files can be requested by path only")
+	}
+
+	// UGetBlock support is implied by XmlBZList
+	if _, ok := d.pconn.remoteFeatures[nmdc.ExtXmlBZList]; ok {
+		_, zblock := d.pconn.remoteFeatures[nmdc.ExtGetZBlock]
+		return &protonmdc.NmdcGetBlock{
+			Unicode:    true,
+			Compressed: (zblock && d.compressionWanted()),
+			Start:      d.conf.Start,
+			Length:     d.conf.Length,
+			Filename:   filename,
+		}, nil
+	}
+
+	if d.conf.Length != -1 {
+		return nil, fmt.Errorf("peer does not support partial downloads")
+	}
+	return &protonmdc.NmdcGet{
+		Filename: filename,
+		Start:    d.conf.Start + 1,
+	}, nil
+}
+
 func (d *Download) handleSendFile(reqQuery string,
 	reqStart uint64,
 	reqLength uint64,
@@ -336,6 +584,8 @@ func (d *Download) handleSendFile(reqQuery string,
 		return fmt.Errorf("downloading null files is not supported")
 	}
 
+	d.isCompressed = reqCompressed
+
 	d.pconn.conn.SetBinaryMode(true)
 	if reqCompressed {
 		err := d.pconn.conn.EnableReaderZlib()
@@ -367,19 +617,48 @@ func (d *Download) handleSendFile(reqQuery string,
 func (d *Download) handleDownload(msgi protocommon.MsgDecodable) error {
 	switch msg := msgi.(type) {
 	case *protoadc.AdcCStatus:
-		return fmt.Errorf("error: %+v", msg)
+		if msg.Msg.QueuePosition > 0 {
+			return fmt.Errorf("error (%d): %s (queue position %d)", msg.Msg.Code, msg.Msg.Msg, msg.Msg.QueuePosition)
+		}
+		return fmt.Errorf("error (%d): %s", msg.Msg.Code, msg.Msg.Msg)
 
 	case *protoadc.AdcCSendFile:
 		query := msg.Msg.Type + " " + msg.Msg.Path
 		return d.handleSendFile(query, uint64(msg.Msg.Start), uint64(msg.Msg.Bytes), msg.Msg.Compressed)
 
-	case *nmdc.MaxedOut:
+	case *protonmdc.NmdcMaxedOut:
+		if msg.QueuePosition > 0 {
+			return fmt.Errorf("maxed out (queue position %d)", msg.QueuePosition)
+		}
 		return fmt.Errorf("maxed out")
 
 	case *nmdc.Error:
 		return fmt.Errorf("error: %s", msg.Err)
 
-	case *nmdc.ADCSnd:
+	case *nmdc.Failed:
+		return fmt.Errorf("failed: %s", msg.Err)
+
+	case *protonmdc.NmdcFileLength:
+		if _, ok := d.nmdcLegacyRequest.(*protonmdc.NmdcGet); !ok {
+			return fmt.Errorf("unexpected FileLength")
+		}
+		if msg.Length < d.conf.Start {
+			return fmt.Errorf("uploader returned wrong length: %d", msg.Length)
+		}
+		d.pconn.conn.Write(&protonmdc.NmdcSend{})
+		return d.handleSendFile(d.query, d.conf.Start, msg.Length-d.conf.Start, false)
+
+	case *protonmdc.NmdcSending:
+		req, ok := d.nmdcLegacyRequest.(*protonmdc.NmdcGetBlock)
+		if !ok {
+			return fmt.Errorf("unexpected Sending")
+		}
+		if msg.Length < 0 {
+			return fmt.Errorf("uploader did not return length")
+		}
+		return d.handleSendFile(d.query, d.conf.Start, uint64(msg.Length), req.Compressed)
+
+	case *protonmdc.NmdcAdcSnd:
 		query := string(msg.ContentType) + " " + string(msg.Identifier)
 		return d.handleSendFile(query, msg.Start, msg.Length, msg.Compressed)
 
@@ -399,16 +678,34 @@ func (d *Download) handleDownload(msgi protocommon.MsgDecodable) error {
 		since := time.Since(d.lastPrintTime)
 		if since >= (1 * time.Second) {
 			d.lastPrintTime = time.Now()
-			speed := float64(d.pconn.conn.PullReadCounter()) / 1024 / (float64(since) / float64(time.Second))
+			read := d.pconn.conn.PullReadCounter()
+			d.wireBytes += uint64(read)
+			speed := float64(read) / 1024 / (float64(since) / float64(time.Second))
 			log.Log(d.client.conf.LogLevel, log.LevelInfo, "[recv] %d/%d (%.1f KiB/s)", d.offset, d.length, speed)
 		}
 
 		if d.offset == d.length {
 			d.pconn.conn.SetBinaryMode(false)
 			d.writer.Close()
+			d.wireBytes += uint64(d.pconn.conn.PullReadCounter())
 
-			// file list: unzip in final path
-			if d.conf.isFilelist {
+			// uncompressed file list that must be cached: compress in final path
+			if d.query == "file files.xml" && d.conf.listCached {
+				if err := fileListCacheCompress(d.conf.SavePath+".tmp", d.conf.SavePath); err != nil {
+					return err
+				}
+
+				// uncompressed file list, or file list that must be kept compressed:
+				// move to final path
+			} else if d.query == "file files.xml" || d.conf.listKeepCompressed {
+				if d.conf.SavePath != "" {
+					if err := os.Rename(d.conf.SavePath+".tmp", d.conf.SavePath); err != nil {
+						return err
+					}
+				}
+
+				// file list: unzip in final path
+			} else if d.conf.isFilelist {
 				if d.conf.SavePath != "" {
 					srcf, err := os.Open(d.conf.SavePath + ".tmp")
 					if err != nil {
@@ -440,10 +737,38 @@ func (d *Download) handleDownload(msgi protocommon.MsgDecodable) error {
 					d.content = cnt
 				}
 
+				// partial list: decode
+			} else if d.conf.listPath != "" {
+				fl, err := FileListParse(d.content)
+				if err != nil {
+					return err
+				}
+
+				d.partialList = &FileListDirectory{
+					Name:  strings.TrimPrefix(path.Base(d.conf.listPath), "/"),
+					Files: fl.Files,
+					Dirs:  fl.Dirs,
+				}
+
+				// tth leaves: decode and validate
+			} else if d.conf.isLeaves {
+				leaves, err := tiger.LeavesLoadFromBytes(d.content)
+				if err != nil {
+					return err
+				}
+
+				log.Log(d.client.conf.LogLevel, log.LevelInfo, "[download] [%s] validating", d.conf.Peer.Nick)
+
+				if leaves.TreeHash() != d.conf.TTH {
+					return fmt.Errorf("validation failed")
+				}
+				d.leaves = leaves
+
 				// normal file
 			} else {
-				// validate
-				if !d.conf.SkipValidation && d.conf.Start == 0 && d.conf.Length <= 0 {
+				// validate. Files requested by path are validated only if TTH is provided
+				if !d.conf.SkipValidation && d.conf.Start == 0 && d.conf.Length <= 0 &&
+					(d.conf.Path == "" || d.conf.TTH != tiger.Hash{}) {
 					log.Log(d.client.conf.LogLevel, log.LevelInfo, "[download] [%s] validating", d.conf.Peer.Nick)
 
 					// file in disk
@@ -490,18 +815,33 @@ func (d *Download) handleExit(err error) {
 	delete(d.client.transfers, d)
 
 	// free activedl and unlock next download
-	delete(d.client.activeDownloadsByPeer, d.conf.Peer.Nick)
-	for rot := range d.client.transfers {
-		if od, ok := rot.(*Download); ok {
-			if !od.terminateRequested && od.state == "waiting_activedl" && d.conf.Peer == od.conf.Peer {
-				od.state = "waited_activedl"
-				od.client.activeDownloadsByPeer[od.conf.Peer.Nick] = d
-				od.activeDlChan <- struct{}{}
-				break
+	if active, ok := d.client.activeDownloadsByPeer[d.conf.Peer.Nick]; ok {
+		if _, ok := active[d]; ok {
+			delete(active, d)
+			if len(active) == 0 {
+				delete(d.client.activeDownloadsByPeer, d.conf.Peer.Nick)
+			}
+
+			for rot := range d.client.transfers {
+				if od, ok := rot.(*Download); ok {
+					if !od.terminateRequested && od.state == "waiting_activedl" && d.conf.Peer == od.conf.Peer {
+						od.state = "waited_activedl"
+						od.client.downloadSetActive(od)
+						od.activeDlChan <- struct{}{}
+						break
+					}
+				}
 			}
 		}
 	}
 
+	// an idle connection kept open for this download can now expire
+	for key, pconn := range d.client.peerConnsByKey {
+		if key.nick == d.conf.Peer.Nick && key.direction == "download" && pconn.isIdle() {
+			pconn.armIdleTimeout()
+		}
+	}
+
 	// free slot and unlock next download
 	d.client.downloadSlotAvail++
 	for rot := range d.client.transfers {
@@ -515,6 +855,11 @@ func (d *Download) handleExit(err error) {
 		}
 	}
 
+	// remove outdated lists from the cache
+	if err == nil && d.conf.listCached {
+		d.client.fileListCachePrune(d.conf.Peer, d.conf.SavePath)
+	}
+
 	// call callbacks
 	if err == nil {
 		log.Log(d.client.conf.LogLevel, log.LevelInfo, "[download] [%s] finished %s (s=%d l=%d)",
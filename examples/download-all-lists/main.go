@@ -1,38 +1,80 @@
 package main
 
 import (
+	"fmt"
+	"sync"
+
 	"github.com/aler9/dctk"
 )
 
+// printStats reads a file list and prints its file count. It is called
+// outside the client context, since decoding a large list takes time.
+func printStats(wg *sync.WaitGroup, nick string, fl *dctk.FileListReader) {
+	defer wg.Done()
+	defer fl.Close()
+
+	stats, err := fl.Stats()
+	if err != nil {
+		fmt.Printf("file list of %s is corrupted: %s\n", nick, err)
+		return
+	}
+	fmt.Printf("file list of %s has %d files\n", nick, stats.FileCount)
+}
+
 func main() {
 	// connect to hub in active mode. local ports must be opened and accessible.
+	// file lists are cached on disk, and are downloaded again only when the
+	// share of a peer changes.
 	client, err := dctk.NewClient(dctk.ClientConf{
-		HubURL:  "nmdc://hubip:411",
-		Nick:    "mynick",
-		TCPPort: 3009,
-		UDPPort: 3009,
-		TLSPort: 3010,
+		HubURL:           "nmdc://hubip:411",
+		Nick:             "mynick",
+		TCPPort:          3009,
+		UDPPort:          3009,
+		TLSPort:          3010,
+		FileListCacheDir: "/tmp/filelists",
 	})
 	if err != nil {
 		panic(err)
 	}
 
-	// when we are connected, start downloading the file list of every other peer
+	var wg sync.WaitGroup
+
+	// when we are connected, get the file list of every other peer
 	// who share at least one byte of files and is not ourself
 	client.OnHubConnected = func() {
 		for _, p := range client.Peers() {
 			if p.ShareSize > 0 && p.Nick != client.Conf().Nick {
-				client.DownloadFileList(p, "")
+				fl, _, err := client.GetFileList(p)
+				if err != nil {
+					panic(err)
+				}
+
+				// the file list is in cache
+				if fl != nil {
+					wg.Add(1)
+					go printStats(&wg, p.Nick, fl)
+				}
 			}
 		}
+
+		if client.DownloadCount() == 0 {
+			client.Close()
+		}
 	}
 
-	// a file list has been downloaded. When there are none remaining, close connection
+	// a file list has been downloaded and cached. When there are none remaining, close connection
 	client.OnDownloadSuccessful = func(d *dctk.Download) {
+		fl, _, err := client.GetFileList(d.Conf().Peer)
+		if err == nil && fl != nil {
+			wg.Add(1)
+			go printStats(&wg, d.Conf().Peer.Nick, fl)
+		}
+
 		if client.DownloadCount() == 0 {
 			client.Close()
 		}
 	}
 
 	client.Run()
+	wg.Wait()
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/aler9/dctk"
+	"github.com/aler9/dctk/pkg/tiger"
+)
+
+// memoryProvider shares files stored in memory.
+type memoryProvider map[string][]byte
+
+func (p memoryProvider) Entries() ([]dctk.ShareProviderEntry, error) {
+	var entries []dctk.ShareProviderEntry
+	for fpath, content := range p {
+		tthl, err := tiger.LeavesFromReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, dctk.ShareProviderEntry{
+			Path: fpath,
+			Size: uint64(len(content)),
+			TTH:  tthl.TreeHash(),
+			TTHL: tthl,
+		})
+	}
+	return entries, nil
+}
+
+func (p memoryProvider) Open(fpath string) (io.ReaderAt, error) {
+	content, ok := p[fpath]
+	if !ok {
+		return nil, fmt.Errorf("file not found: %s", fpath)
+	}
+	return bytes.NewReader(content), nil
+}
+
+func main() {
+	// configure hub in active mode but do not connect automatically. local ports must be opened and accessible.
+	client, err := dctk.NewClient(dctk.ClientConf{
+		HubURL:           "nmdc://hubip:411",
+		Nick:             "mynick",
+		TCPPort:          3009,
+		UDPPort:          3009,
+		TLSPort:          3010,
+		HubManualConnect: true,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	// wait initialization and share files that do not exist on disk
+	client.OnInitialized = func() {
+		err := client.ShareAddProvider("virtual", memoryProvider{
+			"hello.txt":      []byte("hello world"),
+			"docs/readme.md": []byte("# generated content"),
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// wait indexing and connect to hub
+	client.OnShareIndexed = func() {
+		client.HubConnect()
+	}
+
+	client.Run()
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package dctk
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileInode returns the inode number of a file.
+func fileInode(finfo os.FileInfo) uint64 {
+	if st, ok := finfo.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
@@ -2,9 +2,13 @@ package dctk
 
 import (
 	"encoding/xml"
+	"errors"
 	"fmt"
-	"path/filepath"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aler9/dctk/pkg/tiger"
 )
@@ -14,6 +18,36 @@ type FileListFile struct {
 	Name string     `xml:"Name,attr"`
 	Size uint64     `xml:"Size,attr"`
 	TTH  tiger.Hash `xml:"TTH,attr"`
+	// the modification time of the file (optional)
+	TS time.Time `xml:"-"`
+}
+
+type fileListFileAlias FileListFile
+
+// the TS attribute is encoded as a unix timestamp
+type fileListFileXML struct {
+	*fileListFileAlias
+	TS string `xml:"TS,attr,omitempty"`
+}
+
+// MarshalXML implements xml.Marshaler.
+func (f *FileListFile) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	aux := fileListFileXML{
+		fileListFileAlias: (*fileListFileAlias)(f),
+		TS:                fileListEncodeTime(f.TS),
+	}
+	return e.EncodeElement(aux, start)
+}
+
+// UnmarshalXML implements xml.Unmarshaler.
+func (f *FileListFile) UnmarshalXML(dec *xml.Decoder, start xml.StartElement) error {
+	aux := fileListFileXML{fileListFileAlias: (*fileListFileAlias)(f)}
+	if err := dec.DecodeElement(&aux, &start); err != nil {
+		return err
+	}
+	var err error
+	f.TS, err = fileListDecodeTime(aux.TS)
+	return err
 }
 
 // FileListDirectory is part of a user file list and represents a shared drectory.
@@ -21,16 +55,99 @@ type FileListDirectory struct {
 	Name  string               `xml:"Name,attr"`
 	Files []*FileListFile      `xml:"File"`
 	Dirs  []*FileListDirectory `xml:"Directory"`
+	// whether the directory content was omitted (partial file lists only)
+	Incomplete bool `xml:"-"`
+	// the modification time of the most recent file in the directory (optional)
+	Date time.Time `xml:"-"`
+}
+
+type fileListDirectoryAlias FileListDirectory
+
+// the Incomplete attribute is encoded as "1" instead of "true",
+// the Date attribute is encoded as a unix timestamp
+type fileListDirectoryXML struct {
+	*fileListDirectoryAlias
+	Incomplete string `xml:"Incomplete,attr,omitempty"`
+	Date       string `xml:"Date,attr,omitempty"`
+}
+
+// MarshalXML implements xml.Marshaler.
+func (d *FileListDirectory) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	aux := fileListDirectoryXML{
+		fileListDirectoryAlias: (*fileListDirectoryAlias)(d),
+		Date:                   fileListEncodeTime(d.Date),
+	}
+	if d.Incomplete {
+		aux.Incomplete = "1"
+	}
+	return e.EncodeElement(aux, start)
+}
+
+// UnmarshalXML implements xml.Unmarshaler.
+func (d *FileListDirectory) UnmarshalXML(dec *xml.Decoder, start xml.StartElement) error {
+	aux := fileListDirectoryXML{fileListDirectoryAlias: (*fileListDirectoryAlias)(d)}
+	if err := dec.DecodeElement(&aux, &start); err != nil {
+		return err
+	}
+	d.Incomplete = (aux.Incomplete == "1")
+	var err error
+	d.Date, err = fileListDecodeTime(aux.Date)
+	return err
+}
+
+func fileListEncodeTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+func fileListDecodeTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp: %s", s)
+	}
+	return time.Unix(v, 0), nil
+}
+
+// fileListNormalizeBase returns the base in the format used by file lists,
+// that is "/" for full lists and "/dir/subdir/" for partial lists.
+func fileListNormalizeBase(base string) string {
+	base = strings.Trim(base, "/")
+	if base == "" {
+		return "/"
+	}
+	return "/" + base + "/"
+}
+
+// fileListSort sorts files and directories by name, recursively.
+func fileListSort(files []*FileListFile, dirs []*FileListDirectory) {
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	sort.Slice(dirs, func(i, j int) bool {
+		return dirs[i].Name < dirs[j].Name
+	})
+	for _, d := range dirs {
+		fileListSort(d.Files, d.Dirs)
+	}
 }
 
 // FileList is a user file list, containing directories and files.
 type FileList struct {
-	XMLName   xml.Name             `xml:"FileListing"`
-	Version   string               `xml:"Version,attr"`
-	CID       string               `xml:"CID,attr"`
-	Base      string               `xml:"Base,attr"`
-	Generator string               `xml:"Generator,attr"`
-	Dirs      []*FileListDirectory `xml:"Directory"`
+	XMLName xml.Name `xml:"FileListing"`
+	Version string   `xml:"Version,attr"`
+	CID     string   `xml:"CID,attr"`
+	// the directory that contains the listed files and directories, in the
+	// format "/" (full lists) or "/dir/subdir/" (partial lists)
+	Base      string `xml:"Base,attr"`
+	Generator string `xml:"Generator,attr"`
+	// files in the base directory (partial file lists only)
+	Files []*FileListFile      `xml:"File"`
+	Dirs  []*FileListDirectory `xml:"Directory"`
 }
 
 // FileListParse parses a given user file list in XML format into a FileList struct.
@@ -44,24 +161,143 @@ func FileListParse(in []byte) (*FileList, error) {
 	return fl, err
 }
 
+// FileListSkipDir can be returned by a FileListWalkFunc in order to skip the
+// content of the directory that has just been visited.
+var FileListSkipDir = errors.New("skip this directory")
+
+// FileListWalkFunc is called for each directory and file visited by a walk.
+// fpath is the absolute path of the entry inside the share. Exactly one of
+// dir and file is not nil. Directories are visited before their content.
+// When the file list is streamed, Files and Dirs of dir are empty.
+type FileListWalkFunc func(fpath string, dir *FileListDirectory, file *FileListFile) error
+
+// FileListMatch is a file found by Find.
+type FileListMatch struct {
+	Path string
+	File *FileListFile
+}
+
+// FileListStats contains statistics about a file list.
+type FileListStats struct {
+	// the number of files
+	FileCount uint64
+	// the number of directories
+	DirCount uint64
+	// the overall size of files, in bytes
+	Size uint64
+}
+
+func fileListBasePath(base string) string {
+	if base == "" {
+		return "/"
+	}
+	return base
+}
+
+func fileListFind(walk func(FileListWalkFunc) error,
+	pred func(fpath string, file *FileListFile) bool) ([]FileListMatch, error) {
+	var ret []FileListMatch
+	err := walk(func(fpath string, dir *FileListDirectory, file *FileListFile) error {
+		if file != nil && pred(fpath, file) {
+			ret = append(ret, FileListMatch{Path: fpath, File: file})
+		}
+		return nil
+	})
+	return ret, err
+}
+
+func fileListStats(walk func(FileListWalkFunc) error) (FileListStats, error) {
+	var st FileListStats
+	err := walk(func(fpath string, dir *FileListDirectory, file *FileListFile) error {
+		if file != nil {
+			st.FileCount++
+			st.Size += file.Size
+		} else {
+			st.DirCount++
+		}
+		return nil
+	})
+	return st, err
+}
+
+func walkFileListDir(dpath string, files []*FileListFile, dirs []*FileListDirectory,
+	fn FileListWalkFunc) error {
+	for _, f := range files {
+		if err := fn(path.Join(dpath, f.Name), nil, f); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range dirs {
+		sub := path.Join(dpath, d.Name)
+		err := fn(sub, d, nil)
+		if err == FileListSkipDir {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := walkFileListDir(sub, d.Files, d.Dirs, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Walk visits all the directories and files of the file list, in depth-first
+// order. If fn returns an error, the walk is stopped and the error is returned,
+// unless the error is FileListSkipDir.
+func (fl *FileList) Walk(fn FileListWalkFunc) error {
+	return walkFileListDir(fileListBasePath(fl.Base), fl.Files, fl.Dirs, fn)
+}
+
+// Find returns all the files of the file list that satisfy the given predicate.
+func (fl *FileList) Find(pred func(fpath string, file *FileListFile) bool) []FileListMatch {
+	ret, _ := fileListFind(fl.Walk, pred)
+	return ret
+}
+
+// Stats returns the number of files and directories and the overall size
+// of the file list.
+func (fl *FileList) Stats() FileListStats {
+	st, _ := fileListStats(fl.Walk)
+	return st
+}
+
+// relPath returns the components of a path relative to the base
+// of the file list.
+func (fl *FileList) relPath(fpath string) ([]string, error) {
+	base := fileListNormalizeBase(fl.Base)
+	fpath = "/" + strings.Trim(fpath, "/")
+	if fpath != strings.TrimSuffix(base, "/") && !strings.HasPrefix(fpath, base) {
+		return nil, fmt.Errorf("path is outside the file list base")
+	}
+
+	rel := strings.Trim(strings.TrimPrefix(fpath, strings.TrimSuffix(base, "/")), "/")
+	if rel == "" {
+		return nil, nil
+	}
+	return strings.Split(rel, "/"), nil
+}
+
 // GetDirectory returns the directory in the file list corresponding to the given path.
+// In case of partial file lists, the path must be inside the base directory,
+// that is returned when the path is the base itself.
 func (fl *FileList) GetDirectory(dpath string) (*FileListDirectory, error) {
-	components := strings.Split(strings.Trim(dpath, "/"), "/")
+	components, err := fl.relPath(dpath)
+	if err != nil {
+		return nil, err
+	}
 
-	curDir, ok := func() (*FileListDirectory, bool) {
-		for _, d := range fl.Dirs {
-			if d.Name == components[0] {
-				return d, true
-			}
-		}
-		return nil, false
-	}()
-	if !ok {
-		return nil, fmt.Errorf("directory not found")
+	curDir := &FileListDirectory{
+		Name:  path.Base("/" + strings.Trim(fl.Base, "/")),
+		Files: fl.Files,
+		Dirs:  fl.Dirs,
 	}
-	components = components[1:]
 
 	for len(components) > 0 {
+		var ok bool
 		curDir, ok = func() (*FileListDirectory, bool) {
 			for _, d := range curDir.Dirs {
 				if d.Name == components[0] {
@@ -80,7 +316,7 @@ func (fl *FileList) GetDirectory(dpath string) (*FileListDirectory, error) {
 
 // GetFile returns the file in the file list corresponding to the given path.
 func (fl *FileList) GetFile(fpath string) (*FileListFile, error) {
-	dpath, fname := filepath.Split(fpath)
+	dpath, fname := path.Split(fpath)
 
 	dir, err := fl.GetDirectory(dpath)
 	if err != nil {
@@ -103,9 +339,7 @@ func (fl *FileList) Export() ([]byte, error) {
 	if fl.CID == "" {
 		return nil, fmt.Errorf("CID is required")
 	}
-	if fl.Base == "" {
-		fl.Base = ""
-	}
+	fl.Base = fileListNormalizeBase(fl.Base)
 	if fl.Generator == "" {
 		return nil, fmt.Errorf("Generator is required")
 	}
@@ -0,0 +1,132 @@
+package dctk
+
+import (
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dsnet/compress/bzip2"
+
+	"github.com/aler9/dctk/pkg/log"
+)
+
+// fileListCacheKey returns the key that identifies the file list of a peer
+// in the cache. The CID is used in ADC, the nick in NMDC.
+func fileListCacheKey(peer *Peer) string {
+	if !peer.adcClientID.IsZero() {
+		return "cid-" + peer.adcClientID.String()
+	}
+	return "nick-" + hex.EncodeToString([]byte(peer.Nick))
+}
+
+// fileListCachePath returns the path of the cached file list of a peer.
+// The announced share size is part of the path, so that the cached list
+// is invalidated as soon as the peer share changes. Lists are stored
+// compressed.
+func (c *Client) fileListCachePath(peer *Peer) string {
+	return filepath.Join(c.conf.FileListCacheDir,
+		fileListCacheKey(peer)+"-"+numtoa(peer.ShareSize)+".xml.bz2")
+}
+
+// fileListCachePrune removes from the cache the file lists of a peer
+// except the given one.
+func (c *Client) fileListCachePrune(peer *Peer, keep string) {
+	cur := filepath.Base(keep)
+	prefix := fileListCacheKey(peer) + "-"
+
+	entries, err := ioutil.ReadDir(c.conf.FileListCacheDir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.Name() != cur && strings.HasPrefix(e.Name(), prefix) &&
+			strings.HasSuffix(e.Name(), ".xml.bz2") {
+			os.Remove(filepath.Join(c.conf.FileListCacheDir, e.Name()))
+		}
+	}
+}
+
+// GetFileList returns the file list of a given peer. If FileListCacheDir is
+// set and the cache contains a list of the peer that was downloaded when its
+// share had the same size, a reader of the cached list is returned. The
+// reader must be read outside the client context, since decoding a large
+// list takes time, and closed. If the cached list turns out to be corrupted,
+// it is removed from the cache and downloaded again the next time
+// GetFileList() is called.
+// Otherwise, the download of the file list is started and returned; when it
+// finishes, the list is stored in the cache, OnDownloadSuccessful is called
+// and the list can be obtained by calling GetFileList() again.
+// If FileListCacheDir is not set, the list is always downloaded and kept
+// in RAM.
+func (c *Client) GetFileList(peer *Peer) (*FileListReader, *Download, error) {
+	if c.conf.FileListCacheDir == "" {
+		d, err := c.DownloadFileList(peer, "")
+		return nil, d, err
+	}
+
+	fpath := c.fileListCachePath(peer)
+
+	if f, err := os.Open(fpath); err == nil {
+		log.Log(c.conf.LogLevel, log.LevelDebug, "[filelist cache] [%s] hit", peer.Nick)
+
+		logLevel := c.conf.LogLevel
+		nick := peer.Nick
+		flr := NewFileListReaderBzip2(f)
+		flr.closer = f
+		flr.onCorrupt = func(err error) {
+			log.Log(logLevel, log.LevelError, "[filelist cache] [%s] removing corrupted list: %s", nick, err)
+			os.Remove(fpath)
+		}
+		return flr, nil, nil
+	}
+
+	// a download of the same list is already in progress
+	for t := range c.transfers {
+		if d, ok := t.(*Download); ok && !d.terminateRequested &&
+			d.conf.isFilelist && d.conf.SavePath == fpath {
+			return nil, d, nil
+		}
+	}
+
+	log.Log(c.conf.LogLevel, log.LevelDebug, "[filelist cache] [%s] miss", peer.Nick)
+	d, err := c.DownloadFile(DownloadConf{
+		Peer:               peer,
+		SavePath:           fpath,
+		isFilelist:         true,
+		listKeepCompressed: true,
+		listCached:         true,
+	})
+	return nil, d, err
+}
+
+// fileListCacheCompress compresses an uncompressed file list into the cache
+// and removes the source.
+func fileListCacheCompress(src string, dest string) error {
+	srcf, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcf.Close()
+
+	destf, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer destf.Close()
+
+	bw, err := bzip2.NewWriter(destf, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(bw, srcf); err != nil {
+		return err
+	}
+	if err := bw.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(src)
+}
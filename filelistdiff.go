@@ -0,0 +1,203 @@
+package dctk
+
+import (
+	"path"
+	"sort"
+
+	"github.com/aler9/dctk/pkg/tiger"
+)
+
+// FileListChangeType is the type of a change between two file lists.
+type FileListChangeType int
+
+const (
+	// the file exists only in the new list
+	FileListAdded FileListChangeType = iota
+	// the file exists only in the old list
+	FileListRemoved
+	// the file exists in both lists with the same content, but in a different path
+	FileListMoved
+	// the file exists in both lists with the same path, but a different content
+	FileListChanged
+)
+
+// String implements fmt.Stringer.
+func (t FileListChangeType) String() string {
+	switch t {
+	case FileListAdded:
+		return "added"
+	case FileListRemoved:
+		return "removed"
+	case FileListMoved:
+		return "moved"
+	case FileListChanged:
+		return "changed"
+	}
+	return "unknown"
+}
+
+// FileListChange is a difference between two file lists.
+type FileListChange struct {
+	Type FileListChangeType
+	// the path of the file in the new list, or in the old list if the file was removed
+	Path string
+	// the path of the file in the old list (moved files only)
+	OldPath string
+	// the file in the old list (nil if the file was added)
+	Old *FileListFile
+	// the file in the new list (nil if the file was removed)
+	New *FileListFile
+}
+
+// FileListDirChanges is a summary of the changes inside a directory,
+// subdirectories included.
+type FileListDirChanges struct {
+	Path    string
+	Added   uint
+	Removed uint
+	Moved   uint
+	Changed uint
+	// the variation of the overall size of files, in bytes
+	SizeDelta int64
+}
+
+// FileListDiffResult contains the differences between two file lists.
+type FileListDiffResult struct {
+	// changes sorted by path
+	Changes []FileListChange
+	// summaries of directories that contain at least one change, sorted by path.
+	// Moved files are accounted in the directories of their new path
+	Dirs []FileListDirChanges
+}
+
+func fileListSameContent(a *FileListFile, b *FileListFile) bool {
+	if a.TTH != (tiger.Hash{}) && b.TTH != (tiger.Hash{}) {
+		return a.TTH == b.TTH
+	}
+	return a.Size == b.Size
+}
+
+func fileListFiles(fl *FileList) map[string]*FileListFile {
+	ret := make(map[string]*FileListFile)
+	fl.Walk(func(fpath string, dir *FileListDirectory, file *FileListFile) error {
+		if file != nil {
+			ret[fpath] = file
+		}
+		return nil
+	})
+	return ret
+}
+
+func sortedPaths(files map[string]*FileListFile) []string {
+	ret := make([]string, 0, len(files))
+	for fpath := range files {
+		ret = append(ret, fpath)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// FileListDiff compares an old file list (a) with a new one (b) and returns
+// the files that were added, removed, moved or changed. Files are compared
+// by path and TTH; a file that disappeared from a path and appeared in
+// another one with the same TTH is reported as moved.
+func FileListDiff(a *FileList, b *FileList) *FileListDiffResult {
+	oldFiles := fileListFiles(a)
+	newFiles := fileListFiles(b)
+
+	res := &FileListDiffResult{}
+
+	// files that exist only in the old list, grouped by TTH
+	removedByTTH := make(map[tiger.Hash][]string)
+	for _, fpath := range sortedPaths(oldFiles) {
+		f := oldFiles[fpath]
+		if nf, ok := newFiles[fpath]; ok {
+			if !fileListSameContent(f, nf) {
+				res.Changes = append(res.Changes, FileListChange{
+					Type: FileListChanged,
+					Path: fpath,
+					Old:  f,
+					New:  nf,
+				})
+			}
+			continue
+		}
+		removedByTTH[f.TTH] = append(removedByTTH[f.TTH], fpath)
+	}
+
+	for _, fpath := range sortedPaths(newFiles) {
+		f := newFiles[fpath]
+		if _, ok := oldFiles[fpath]; ok {
+			continue
+		}
+
+		if f.TTH != (tiger.Hash{}) {
+			if paths := removedByTTH[f.TTH]; len(paths) > 0 {
+				removedByTTH[f.TTH] = paths[1:]
+				res.Changes = append(res.Changes, FileListChange{
+					Type:    FileListMoved,
+					Path:    fpath,
+					OldPath: paths[0],
+					Old:     oldFiles[paths[0]],
+					New:     f,
+				})
+				continue
+			}
+		}
+
+		res.Changes = append(res.Changes, FileListChange{
+			Type: FileListAdded,
+			Path: fpath,
+			New:  f,
+		})
+	}
+
+	for _, paths := range removedByTTH {
+		for _, fpath := range paths {
+			res.Changes = append(res.Changes, FileListChange{
+				Type: FileListRemoved,
+				Path: fpath,
+				Old:  oldFiles[fpath],
+			})
+		}
+	}
+
+	sort.SliceStable(res.Changes, func(i, j int) bool {
+		return res.Changes[i].Path < res.Changes[j].Path
+	})
+
+	// compute directory summaries
+	dirs := make(map[string]*FileListDirChanges)
+	for _, ch := range res.Changes {
+		for dpath := path.Dir(ch.Path); dpath != "/" && dpath != "."; dpath = path.Dir(dpath) {
+			d, ok := dirs[dpath]
+			if !ok {
+				d = &FileListDirChanges{Path: dpath}
+				dirs[dpath] = d
+			}
+
+			switch ch.Type {
+			case FileListAdded:
+				d.Added++
+				d.SizeDelta += int64(ch.New.Size)
+			case FileListRemoved:
+				d.Removed++
+				d.SizeDelta -= int64(ch.Old.Size)
+			case FileListMoved:
+				d.Moved++
+			case FileListChanged:
+				d.Changed++
+				d.SizeDelta += int64(ch.New.Size) - int64(ch.Old.Size)
+			}
+		}
+	}
+
+	for _, d := range dirs {
+		res.Dirs = append(res.Dirs, *d)
+	}
+	sort.Slice(res.Dirs, func(i, j int) bool {
+		return res.Dirs[i].Path < res.Dirs[j].Path
+	})
+
+	return res
+}
@@ -0,0 +1,250 @@
+package dctk
+
+import (
+	"compress/bzip2"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// FileListReader decodes a user file list progressively from a stream,
+// without keeping it in memory. It can be walked only once.
+type FileListReader struct {
+	r      io.Reader
+	closer io.Closer
+	header FileList
+	walked bool
+	// called when the file list cannot be decoded
+	onCorrupt func(err error)
+}
+
+// NewFileListReader allocates a FileListReader that reads a file list in
+// XML format.
+func NewFileListReader(r io.Reader) *FileListReader {
+	return &FileListReader{r: r}
+}
+
+// NewFileListReaderBzip2 allocates a FileListReader that reads a file list
+// in XML format compressed with bzip2 (i.e. files.xml.bz2).
+func NewFileListReaderBzip2(r io.Reader) *FileListReader {
+	return &FileListReader{r: bzip2.NewReader(r)}
+}
+
+// Close closes the underlying source, if it was opened by the library.
+func (r *FileListReader) Close() error {
+	if r.closer != nil {
+		return r.closer.Close()
+	}
+	return nil
+}
+
+// Header returns the attributes of the file list (Version, CID, Base,
+// Generator). They are available after Walk has been called; Files and Dirs
+// are always empty.
+func (r *FileListReader) Header() *FileList {
+	return &r.header
+}
+
+// Walk decodes the file list and visits all its directories and files, in
+// the order in which they appear. See FileList.Walk.
+func (r *FileListReader) Walk(fn FileListWalkFunc) error {
+	return r.walk(func(fpath string, parent *FileListDirectory,
+		dir *FileListDirectory, file *FileListFile) error {
+		return fn(fpath, dir, file)
+	})
+}
+
+// fileListReaderFunc is called for each directory and file visited by the
+// reader. parent is the directory that contains the entry, or nil.
+type fileListReaderFunc func(fpath string, parent *FileListDirectory,
+	dir *FileListDirectory, file *FileListFile) error
+
+func (r *FileListReader) walk(fn fileListReaderFunc) error {
+	if r.walked {
+		return fmt.Errorf("file list has already been read")
+	}
+	r.walked = true
+
+	var fnErr error
+	err := r.decode(func(fpath string, parent *FileListDirectory,
+		dir *FileListDirectory, file *FileListFile) error {
+		fnErr = fn(fpath, parent, dir, file)
+		return fnErr
+	})
+
+	// errors returned by fn do not depend on the file list
+	if err != nil && err != fnErr && r.onCorrupt != nil {
+		r.onCorrupt(err)
+	}
+	return err
+}
+
+// fileListCheckName checks that the name of a directory or file does not
+// refer to another path.
+func fileListCheckName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid name '%s'", name)
+	}
+	return nil
+}
+
+func (r *FileListReader) decode(fn fileListReaderFunc) error {
+	dec := xml.NewDecoder(r.r)
+
+	// the directories that contain the current element
+	type openDir struct {
+		path string
+		dir  *FileListDirectory
+	}
+	var dirs []openDir
+	finished := false
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			if !finished {
+				return io.ErrUnexpectedEOF
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "FileListing":
+				for _, attr := range t.Attr {
+					switch attr.Name.Local {
+					case "Version":
+						r.header.Version = attr.Value
+					case "CID":
+						r.header.CID = attr.Value
+					case "Base":
+						r.header.Base = attr.Value
+					case "Generator":
+						r.header.Generator = attr.Value
+					}
+				}
+				dirs = []openDir{{path: fileListBasePath(r.header.Base)}}
+
+			case "Directory":
+				if dirs == nil {
+					return fmt.Errorf("directory outside file listing")
+				}
+
+				d := &FileListDirectory{}
+				for _, attr := range t.Attr {
+					switch attr.Name.Local {
+					case "Name":
+						d.Name = attr.Value
+					case "Incomplete":
+						d.Incomplete = (attr.Value == "1")
+					case "Date":
+						var err error
+						d.Date, err = fileListDecodeTime(attr.Value)
+						if err != nil {
+							return err
+						}
+					}
+				}
+
+				if err := fileListCheckName(d.Name); err != nil {
+					return err
+				}
+
+				parent := dirs[len(dirs)-1]
+				dpath := path.Join(parent.path, d.Name)
+				err := fn(dpath, parent.dir, d, nil)
+				if err == FileListSkipDir {
+					if err := dec.Skip(); err != nil {
+						return err
+					}
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				dirs = append(dirs, openDir{path: dpath, dir: d})
+
+			case "File":
+				if dirs == nil {
+					return fmt.Errorf("file outside file listing")
+				}
+
+				f := &FileListFile{}
+				if err := dec.DecodeElement(f, &t); err != nil {
+					return err
+				}
+
+				if err := fileListCheckName(f.Name); err != nil {
+					return err
+				}
+
+				parent := dirs[len(dirs)-1]
+				if err := fn(path.Join(parent.path, f.Name), parent.dir, nil, f); err != nil {
+					return err
+				}
+
+			default:
+				if err := dec.Skip(); err != nil {
+					return err
+				}
+			}
+
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "Directory":
+				dirs = dirs[:len(dirs)-1]
+
+			case "FileListing":
+				dirs = nil
+				finished = true
+			}
+		}
+	}
+}
+
+// Find decodes the file list and returns all the files that satisfy the
+// given predicate.
+func (r *FileListReader) Find(pred func(fpath string, file *FileListFile) bool) ([]FileListMatch, error) {
+	return fileListFind(r.Walk, pred)
+}
+
+// Stats decodes the file list and returns the number of files and
+// directories and the overall size.
+func (r *FileListReader) Stats() (FileListStats, error) {
+	return fileListStats(r.Walk)
+}
+
+// ReadAll decodes the entire file list into a FileList.
+func (r *FileListReader) ReadAll() (*FileList, error) {
+	fl := &FileList{}
+
+	err := r.walk(func(fpath string, parent *FileListDirectory,
+		dir *FileListDirectory, file *FileListFile) error {
+		files, subdirs := &fl.Files, &fl.Dirs
+		if parent != nil {
+			files, subdirs = &parent.Files, &parent.Dirs
+		}
+
+		if dir != nil {
+			*subdirs = append(*subdirs, dir)
+		} else {
+			*files = append(*files, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fl.Version = r.header.Version
+	fl.CID = r.header.CID
+	fl.Base = r.header.Base
+	fl.Generator = r.header.Generator
+	return fl, nil
+}
@@ -0,0 +1,268 @@
+package dctk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/aler9/dctk/pkg/tiger"
+)
+
+// the hash database is an append-only file that contains a sequence of
+// records. Each record is prefixed by its length and checksum, therefore
+// a record that was partially written because of a crash is detected and
+// discarded when the database is loaded.
+const hashDBMagic = "DCTKHDB1"
+
+// records that exceed this size are considered corrupted
+const hashDBMaxRecordSize = 64 * 1024
+
+type hashDBEntry struct {
+	size    uint64
+	modTime int64
+	inode   uint64
+	tth     tiger.Hash
+}
+
+type hashDB struct {
+	fpath string
+	f     *os.File
+	// entries are indexed by real path
+	entries map[string]*hashDBEntry
+	// the number of records in the file, including outdated ones
+	records int
+}
+
+func newHashDB(fpath string) (*hashDB, error) {
+	db := &hashDB{
+		fpath:   fpath,
+		entries: make(map[string]*hashDBEntry),
+	}
+
+	f, err := os.OpenFile(fpath, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	validSize, err := db.load(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// write the header of a new database, or discard a partially written record
+	if validSize == 0 {
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if _, err := f.WriteAt([]byte(hashDBMagic), 0); err != nil {
+			f.Close()
+			return nil, err
+		}
+		validSize = int64(len(hashDBMagic))
+	} else if err := f.Truncate(validSize); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if _, err := f.Seek(validSize, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	db.f = f
+	return db, nil
+}
+
+// load reads all the valid records of the database and returns the size of
+// the valid part of the file.
+func (db *hashDB) load(f *os.File) (int64, error) {
+	r := bufio.NewReaderSize(f, 1024*1024)
+
+	magic := make([]byte, len(hashDBMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		// empty or truncated header
+		return 0, nil
+	}
+	if string(magic) != hashDBMagic {
+		return 0, fmt.Errorf("%s is not a hash database", db.fpath)
+	}
+
+	validSize := int64(len(hashDBMagic))
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return validSize, nil
+		}
+
+		size := binary.BigEndian.Uint32(header[:4])
+		sum := binary.BigEndian.Uint32(header[4:])
+		if size > hashDBMaxRecordSize {
+			return validSize, nil
+		}
+
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return validSize, nil
+		}
+		if crc32.ChecksumIEEE(payload) != sum {
+			return validSize, nil
+		}
+
+		rpath, e, err := hashDBDecodeRecord(payload)
+		if err != nil {
+			return validSize, nil
+		}
+
+		db.entries[rpath] = e
+		db.records++
+		validSize += int64(len(header) + len(payload))
+	}
+}
+
+func hashDBEncodeRecord(rpath string, e *hashDBEntry) []byte {
+	var payload bytes.Buffer
+	var tmp [binary.MaxVarintLen64]byte
+
+	n := binary.PutUvarint(tmp[:], uint64(len(rpath)))
+	payload.Write(tmp[:n])
+	payload.WriteString(rpath)
+	binary.Write(&payload, binary.BigEndian, e.size)
+	binary.Write(&payload, binary.BigEndian, e.modTime)
+	binary.Write(&payload, binary.BigEndian, e.inode)
+	payload.Write(e.tth[:])
+
+	rec := make([]byte, 8+payload.Len())
+	binary.BigEndian.PutUint32(rec[:4], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.ChecksumIEEE(payload.Bytes()))
+	copy(rec[8:], payload.Bytes())
+	return rec
+}
+
+func hashDBDecodeRecord(payload []byte) (string, *hashDBEntry, error) {
+	r := bytes.NewReader(payload)
+
+	plen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", nil, err
+	}
+	if plen > uint64(r.Len()) {
+		return "", nil, fmt.Errorf("invalid path length")
+	}
+	rpath := make([]byte, plen)
+	if _, err := io.ReadFull(r, rpath); err != nil {
+		return "", nil, err
+	}
+
+	e := &hashDBEntry{}
+	if err := binary.Read(r, binary.BigEndian, &e.size); err != nil {
+		return "", nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &e.modTime); err != nil {
+		return "", nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &e.inode); err != nil {
+		return "", nil, err
+	}
+	if _, err := io.ReadFull(r, e.tth[:]); err != nil {
+		return "", nil, err
+	}
+
+	if r.Len() != 0 {
+		return "", nil, fmt.Errorf("invalid record size")
+	}
+
+	return string(rpath), e, nil
+}
+
+func (db *hashDB) close() {
+	db.f.Close()
+}
+
+// get returns the entry of a file, if the file was not modified since it
+// was hashed.
+func (db *hashDB) get(rpath string, size uint64, modTime int64, inode uint64) (*hashDBEntry, bool) {
+	e, ok := db.entries[rpath]
+	if !ok || e.size != size || e.modTime != modTime || e.inode != inode {
+		return nil, false
+	}
+	return e, true
+}
+
+// put stores the entry of a file.
+func (db *hashDB) put(rpath string, e *hashDBEntry) error {
+	if _, err := db.f.Write(hashDBEncodeRecord(rpath, e)); err != nil {
+		return err
+	}
+	db.entries[rpath] = e
+	db.records++
+	return nil
+}
+
+// compact removes the entries of files that were deleted or modified, and
+// rewrites the database when it contains too many outdated records. Files in
+// the given set have just been indexed and are not checked again. The new
+// database is written into a temporary file that replaces the current one,
+// therefore a crash during compaction does not cause any data loss.
+func (db *hashDB) compact(live map[string]struct{}) error {
+	for rpath, e := range db.entries {
+		if _, ok := live[rpath]; ok {
+			continue
+		}
+		finfo, err := os.Stat(rpath)
+		if err != nil || uint64(finfo.Size()) != e.size ||
+			finfo.ModTime().UnixNano() != e.modTime || fileInode(finfo) != e.inode {
+			delete(db.entries, rpath)
+		}
+	}
+
+	if (db.records - len(db.entries)) <= len(db.entries)/2 {
+		return nil
+	}
+
+	tmpPath := db.fpath + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	err = func() error {
+		w := bufio.NewWriterSize(tmp, 1024*1024)
+		if _, err := w.WriteString(hashDBMagic); err != nil {
+			return err
+		}
+		for rpath, e := range db.entries {
+			if _, err := w.Write(hashDBEncodeRecord(rpath, e)); err != nil {
+				return err
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		return tmp.Sync()
+	}()
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, db.fpath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	f, err := os.OpenFile(db.fpath, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	db.f.Close()
+	db.f = f
+	db.records = len(db.entries)
+	return nil
+}
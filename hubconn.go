@@ -73,6 +73,8 @@ type conn interface {
 	Close() error
 	SetSyncMode(val bool)
 	SetBinaryMode(val bool)
+	SetReadTimeout(val time.Duration)
+	ResetReadTimeout()
 	Read() (protocommon.MsgDecodable, error)
 	Write(msg protocommon.MsgEncodable)
 	WriteSync(in []byte) error
@@ -80,6 +82,7 @@ type conn interface {
 	PullWriteCounter() uint
 	EnableReaderZlib() error
 	EnableWriterZlib() error
+	EnableWriterZlibLevel(lvl int) error
 	DisableWriterZlib() error
 }
 
@@ -393,7 +396,7 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 			p.Version = msg.Msg.Version
 		}
 		if msg.Msg.KP != "" {
-			p.adcFingerprint = msg.Msg.KP
+			p.fingerprint = msg.Msg.KP
 		}
 		if len(msg.Msg.Features) > 0 {
 			p.adcFeatures = msg.Msg.Features
@@ -401,6 +404,8 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 		if adc.UserTypeBot != 0 {
 			p.IsBot = (msg.Msg.Type & adc.UserTypeBot) != 0
 			p.IsOperator = (msg.Msg.Type & adc.UserTypeOperator) != 0
+			p.IsRegistered = (msg.Msg.Type & (adc.UserTypeRegistered | adc.UserTypeOperator |
+				adc.UserTypeSuperUser | adc.UserTypeHubOwner)) != 0
 		}
 
 		// a peer is active if it supports udp4, exposes udp port and ip
@@ -527,6 +532,9 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 			return nil
 		}
 
+		if !h.client.peerConnAllow(p.IP, false) {
+			return nil
+		}
 		newPeerConn(h.client, (msg.Msg.Proto == adc.ProtoADCS), false, nil, p.IP, uint(msg.Msg.Port), msg.Msg.Token)
 
 	case *protoadc.AdcDRevConnectToMe:
@@ -668,6 +676,7 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 		p.Client = msg.Client.Name
 		p.Version = msg.Client.Version
 		p.IsPassive = (msg.Mode == nmdc.UserModePassive)
+		p.fingerprint = msg.Extra[nmdcTagKeyprint]
 
 		if !exists {
 			h.client.handlePeerConnected(p)
@@ -700,11 +709,13 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 			if p.IsOperator {
 				updatedPeers[p.Nick] = struct{}{}
 				p.IsOperator = false
+				p.IsRegistered = false
 			}
 		}
 
 		for _, name := range msg.Names {
 			h.client.peers[name].IsOperator = true
+			h.client.peers[name].IsRegistered = true
 			if _, ok := updatedPeers[name]; ok {
 				delete(updatedPeers, name)
 			} else {
@@ -797,6 +808,8 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 		case !msg.Secure && h.client.conf.PeerEncryptionMode == ForceEncryption:
 			log.Log(h.client.conf.LogLevel, log.LevelInfo, "received plain connect to me request but encryption is forced, skipping")
 
+		case !h.client.peerConnAllow(ip, false):
+
 		default:
 			newPeerConn(h.client, msg.Secure, false, nil, ip, port, "")
 		}
@@ -0,0 +1,116 @@
+package dctk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aler9/dctk/pkg/tiger"
+)
+
+const leavesStoreTmpSuffix = ".tmp"
+
+// leavesStore stores the TTH leaves of shared files on disk, one file per
+// TTH, in order not to keep them in memory. Files are written into a unique
+// temporary file and then renamed, therefore they can be read at any time
+// and saved concurrently.
+type leavesStore struct {
+	dir string
+}
+
+func newLeavesStore(dir string) (*leavesStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &leavesStore{dir: dir}, nil
+}
+
+// path returns the path of the leaves with the given TTH. Files are split
+// into subdirectories in order to avoid huge directories.
+func (s *leavesStore) path(tth tiger.Hash) string {
+	name := tth.String()
+	return filepath.Join(s.dir, name[:2], name)
+}
+
+// load returns the leaves of the given TTH, if they are stored and valid.
+func (s *leavesStore) load(tth tiger.Hash) (tiger.Leaves, bool) {
+	tthl, err := tiger.LeavesLoadFromFile(s.path(tth))
+	if err != nil || len(tthl) == 0 || tthl.TreeHash() != tth {
+		return nil, false
+	}
+	return tthl, true
+}
+
+// save stores the leaves of the given TTH.
+func (s *leavesStore) save(tth tiger.Hash, tthl tiger.Leaves) error {
+	fpath := s.path(tth)
+	if err := os.MkdirAll(filepath.Dir(fpath), 0o755); err != nil {
+		return err
+	}
+
+	buf, err := tthl.SaveToBytes()
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(fpath), filepath.Base(fpath)+".*"+leavesStoreTmpSuffix)
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Chmod(0o644)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, fpath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// prune removes the leaves whose TTH is not in the given set. Temporary files
+// are skipped, since they may belong to a save in progress.
+func (s *leavesStore) prune(keep map[tiger.Hash][]*shareFile) error {
+	subdirs, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, subdir := range subdirs {
+		if !subdir.IsDir() {
+			continue
+		}
+
+		dpath := filepath.Join(s.dir, subdir.Name())
+		files, err := ioutil.ReadDir(dpath)
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			if strings.HasSuffix(file.Name(), leavesStoreTmpSuffix) {
+				continue
+			}
+
+			tth, err := tiger.HashFromBase32(file.Name())
+			if err == nil {
+				if _, ok := keep[tth]; ok {
+					continue
+				}
+			}
+			os.Remove(filepath.Join(dpath, file.Name()))
+		}
+	}
+	return nil
+}
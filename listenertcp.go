@@ -20,46 +20,56 @@ type listenerTCP struct {
 	listener           net.Listener
 }
 
-func newListenerTCP(client *Client, isEncrypted bool) error {
-	var listener net.Listener
-	if isEncrypted {
-		var err error
-		priv, err := rsa.GenerateKey(crand.Reader, 1024)
-		if err != nil {
-			return err
-		}
+// newTLSCertificate generates a self-signed certificate and its keyprint,
+// that is used to identify the client on encrypted connections.
+func newTLSCertificate() (tls.Certificate, string, error) {
+	priv, err := rsa.GenerateKey(crand.Reader, 1024)
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
 
-		serialNumber, err := crand.Int(crand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
-		if err != nil {
-			return err
-		}
+	serialNumber, err := crand.Int(crand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
 
-		template := x509.Certificate{
-			SerialNumber: serialNumber,
-		}
-		bcert, err := x509.CreateCertificate(crand.Reader, &template, &template, &priv.PublicKey, priv)
-		if err != nil {
-			return err
-		}
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+	}
+	bcert, err := x509.CreateCertificate(crand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
 
-		if client.protoIsAdc() {
-			xcert, err := x509.ParseCertificate(bcert)
-			if err != nil {
-				return err
-			}
-			client.adcFingerprint = protoadc.AdcCertFingerprint(xcert)
-		}
+	xcert, err := x509.ParseCertificate(bcert)
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
 
-		certPEMBlock := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: bcert})
-		keyPEMBlock := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+	certPEMBlock := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: bcert})
+	keyPEMBlock := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
 
-		tcert, err := tls.X509KeyPair(certPEMBlock, keyPEMBlock)
-		if err != nil {
-			return err
+	tcert, err := tls.X509KeyPair(certPEMBlock, keyPEMBlock)
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+
+	return tcert, protoadc.AdcCertFingerprint(xcert), nil
+}
+
+func newListenerTCP(client *Client, isEncrypted bool) error {
+	var listener net.Listener
+	if isEncrypted {
+		conf := &tls.Config{Certificates: []tls.Certificate{client.tlsCert}}
+
+		// client certificates are self-signed, they are validated against
+		// keyprints after the peer has been identified
+		if client.conf.PeerEncryptionStrict {
+			conf.ClientAuth = tls.RequireAnyClientCert
 		}
 
-		listener, err = tls.Listen("tcp4", fmt.Sprintf(":%d", client.conf.TLSPort),
-			&tls.Config{Certificates: []tls.Certificate{tcert}})
+		var err error
+		listener, err = tls.Listen("tcp4", fmt.Sprintf(":%d", client.conf.TLSPort), conf)
 		if err != nil {
 			return err
 		}
@@ -104,6 +114,11 @@ func (t *listenerTCP) do() {
 		}
 
 		t.client.Safe(func() {
+			ip, _, _ := net.SplitHostPort(rawconn.RemoteAddr().String())
+			if !t.client.peerConnAllow(ip, true) {
+				rawconn.Close()
+				return
+			}
 			newPeerConn(t.client, t.isEncrypted, true, rawconn, "", 0, "")
 		})
 	}
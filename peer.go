@@ -23,6 +23,8 @@ type Peer struct {
 	IsBot bool
 	// whether peer is a operator
 	IsOperator bool
+	// whether peer is registered (in NMDC only operators are known to be registered)
+	IsRegistered bool
 	// client used by peer (in NMDC this could be hidden)
 	Client string
 	// version of client (in NMDC this could be hidden)
@@ -34,9 +36,11 @@ type Peer struct {
 	// peer ip (if provided by both peer and hub)
 	IP string
 
+	// keyprint of the peer certificate. In NMDC it is available only
+	// if the hub does not hide tags
+	fingerprint    string
 	adcSessionID   atypes.SID
 	adcClientID    atypes.CID
-	adcFingerprint string
 	adcFeatures    adc.ExtFeatures
 	adcUDPPort     uint
 	nmdcConnection string
@@ -79,7 +83,7 @@ func (c *Client) peerSupportsAdc(p *Peer, f adc.Feature) bool {
 
 func (c *Client) peerSupportsEncryption(p *Peer) bool {
 	if c.protoIsAdc() {
-		if p.adcFingerprint != "" {
+		if p.fingerprint != "" {
 			return true
 		}
 		if c.peerSupportsAdc(p, adc.FeaADCS) {
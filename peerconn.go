@@ -17,9 +17,12 @@ import (
 
 var errorDelegatedUpload = fmt.Errorf("delegated upload")
 
-type nickDirectionPair struct {
+// peerConnKey identifies a connection with a peer. Multiple connections
+// with the same peer and direction are told apart by their token.
+type peerConnKey struct {
 	nick      string
 	direction string
+	token     string
 }
 
 type peerConn struct {
@@ -34,10 +37,14 @@ type peerConn struct {
 	adcToken           string
 	passiveIP          string
 	passivePort        uint
+	remoteIP           string
+	idleSince          time.Time
+	used               bool
 	peer               *Peer
 	localDirection     string
 	localBet           uint
 	remoteIsUpload     bool
+	remoteFeatures     map[string]struct{}
 	remoteBet          uint
 	direction          string
 	transfer           transfer
@@ -53,6 +60,7 @@ func newPeerConn(client *Client, isEncrypted bool, isActive bool,
 		adcToken:    adcToken,
 	}
 	p.client.peerConns[p] = struct{}{}
+	p.client.peerConnStats.Opened++
 
 	if isActive {
 		log.Log(client.conf.LogLevel, log.LevelInfo, "[peer] incoming %s%s", rawconn.RemoteAddr(), func() string {
@@ -62,6 +70,7 @@ func newPeerConn(client *Client, isEncrypted bool, isActive bool,
 			return ""
 		}())
 		p.state = "connected"
+		p.remoteIP, _, _ = net.SplitHostPort(rawconn.RemoteAddr().String())
 		if p.isEncrypted {
 			p.tlsConn = rawconn.(*tls.Conn)
 		}
@@ -78,6 +87,7 @@ func newPeerConn(client *Client, isEncrypted bool, isActive bool,
 			return ""
 		}())
 		p.state = "connecting"
+		p.remoteIP = ip
 		p.passiveIP = ip
 		p.passivePort = port
 	}
@@ -123,7 +133,12 @@ func (p *peerConn) do() {
 
 			rawconn := ce.Conn
 			if p.isEncrypted {
-				p.tlsConn = tls.Client(rawconn, &tls.Config{InsecureSkipVerify: true})
+				// the server certificate is validated against the keyprint
+				// after the peer has been identified
+				p.tlsConn = tls.Client(rawconn, &tls.Config{
+					InsecureSkipVerify: true,
+					Certificates:       []tls.Certificate{p.client.tlsCert},
+				})
 				rawconn = p.tlsConn
 			}
 
@@ -187,7 +202,7 @@ func (p *peerConn) do() {
 							err = d.handleDownload(msg)
 							if err == protocommon.ErrorTerminated {
 								p.transfer = nil
-								p.state = "wait_download"
+								p.setIdle("wait_download")
 								d.handleExit(nil)
 								err = nil // do not close connection
 							}
@@ -199,14 +214,14 @@ func (p *peerConn) do() {
 						u := p.transfer.(*upload)
 
 						err := u.handleUpload()
-						if err != nil {
+						if err != nil && err != errorFileNotAvailable {
 							return err
 						}
 
 						p.client.Safe(func() {
 							p.transfer = nil
-							p.state = "wait_upload"
-							u.handleExit(nil)
+							p.setIdle("wait_upload")
+							u.handleExit(err)
 						})
 
 					} else if err != nil {
@@ -229,13 +244,18 @@ func (p *peerConn) do() {
 	}()
 
 	p.client.Safe(func() {
-		if !p.terminateRequested {
+		switch {
+		case p.isIdle() && isTimeoutError(err):
+			log.Log(p.client.conf.LogLevel, log.LevelInfo, "[peer] idle timeout")
+			p.client.peerConnStats.ClosedIdle++
+
+		case !p.terminateRequested:
 			log.Log(p.client.conf.LogLevel, log.LevelInfo, "ERR (peerConn): %s", err)
 		}
 
 		// transfer abruptly interrupted, doesnt care if the conn was terminated or not
 		switch p.state {
-		case "delegated_upload", "delegated_download":
+		case "delegated_upload", "delegated_download", "wait_send":
 			p.transfer.handleExit(err)
 		}
 
@@ -246,13 +266,67 @@ func (p *peerConn) do() {
 		delete(p.client.peerConns, p)
 
 		if p.peer != nil && p.direction != "" {
-			delete(p.client.peerConnsByKey, nickDirectionPair{p.peer.Nick, p.direction})
+			key := peerConnKey{p.peer.Nick, p.direction, p.adcToken}
+			// the key may have been released and taken by another connection
+			if p.client.peerConnsByKey[key] == p {
+				delete(p.client.peerConnsByKey, key)
+			}
 		}
 
 		log.Log(p.client.conf.LogLevel, log.LevelInfo, "[peer] disconnected")
 	})
 }
 
+// supportsBzipList returns whether the peer provides its file list compressed
+// with bzip2.
+func (p *peerConn) supportsBzipList() bool {
+	if p.client.protoIsAdc() {
+		_, ok := p.remoteFeatures[adc.FeaBZIP.String()]
+		return ok
+	}
+	_, ok := p.remoteFeatures[nmdc.ExtXmlBZList]
+	return ok
+}
+
+// validateTLS checks the certificate of an identified peer against its keyprint.
+// In strict mode, unencrypted connections are refused.
+func (p *peerConn) validateTLS() error {
+	if !p.isEncrypted {
+		if p.client.conf.PeerEncryptionStrict {
+			return fmt.Errorf("peer connection is not encrypted")
+		}
+		return nil
+	}
+
+	st := p.tlsConn.ConnectionState()
+
+	switch {
+	// many clients do not send their certificate when connecting to us
+	case len(st.PeerCertificates) == 0:
+		if p.client.conf.PeerEncryptionStrict {
+			return fmt.Errorf("peer did not provide a certificate")
+		}
+
+	case p.peer.fingerprint == "":
+		if p.client.conf.PeerEncryptionStrict {
+			return fmt.Errorf("peer did not publish a keyprint")
+		}
+
+	default:
+		connFingerprint := protoadc.AdcCertFingerprint(st.PeerCertificates[0])
+		if connFingerprint != p.peer.fingerprint {
+			return fmt.Errorf("unable to validate peer fingerprint (%s vs %s)",
+				connFingerprint, p.peer.fingerprint)
+		}
+		log.Log(p.client.conf.LogLevel, log.LevelInfo, "[peer] fingerprint validated")
+	}
+
+	if p.client.OnPeerTLS != nil {
+		p.client.OnPeerTLS(p.peer, st)
+	}
+	return nil
+}
+
 func (p *peerConn) handleMessage(msgi protocommon.MsgDecodable) error {
 	switch msg := msgi.(type) {
 	case *protoadc.AdcCStatus:
@@ -265,6 +339,12 @@ func (p *peerConn) handleMessage(msgi protocommon.MsgDecodable) error {
 			return fmt.Errorf("[Supports] invalid state: %s", p.state)
 		}
 		p.state = "supports"
+		p.remoteFeatures = make(map[string]struct{})
+		for fea, on := range msg.Msg.Features {
+			if on {
+				p.remoteFeatures[fea.String()] = struct{}{}
+			}
+		}
 		if p.isActive {
 			p.conn.Write(&protoadc.AdcCSupports{ //nolint:govet
 				&adc.ClientPacket{},
@@ -298,6 +378,10 @@ func (p *peerConn) handleMessage(msgi protocommon.MsgDecodable) error {
 			return fmt.Errorf("unknown client id (%s)", msg.Msg.Id)
 		}
 
+		if err := p.validateTLS(); err != nil {
+			return err
+		}
+
 		if p.isActive {
 			if msg.Msg.Token == "" {
 				return fmt.Errorf("token not provided")
@@ -312,47 +396,35 @@ func (p *peerConn) handleMessage(msgi protocommon.MsgDecodable) error {
 				&adc.ClientPacket{},
 				info,
 			})
-
-			// validate peer fingerprint
-			// can be performed on client-side only since many clients do not send
-			// their certificate when in passive mode
-		} else if p.client.protoIsAdc() && p.isEncrypted &&
-			p.peer.adcFingerprint != "" {
-
-			connFingerprint := protoadc.AdcCertFingerprint(
-				p.tlsConn.ConnectionState().PeerCertificates[0])
-
-			if connFingerprint != p.peer.adcFingerprint {
-				return fmt.Errorf("unable to validate peer fingerprint (%s vs %s)",
-					connFingerprint, p.peer.adcFingerprint)
-			}
-			log.Log(p.client.conf.LogLevel, log.LevelInfo, "[peer] fingerprint validated")
 		}
 
 		dl := p.client.downloadByAdcToken(p.adcToken)
 		if dl != nil {
-			key := nickDirectionPair{p.peer.Nick, "download"}
+			key := peerConnKey{p.peer.Nick, "download", p.adcToken}
 			if _, ok := p.client.peerConnsByKey[key]; ok {
-				return fmt.Errorf("a connection with this peer and direction already exists")
+				return fmt.Errorf("a connection with this peer, direction and token already exists")
 			}
 			p.client.peerConnsByKey[key] = p
 
 			p.direction = "download"
-			p.state = "delegated_download"
+			p.setBusy("delegated_download")
 			p.transfer = dl
 			dl.pconn = p
 			dl.state = "processing"
 			dl.peerChan <- struct{}{}
 
 		} else {
-			key := nickDirectionPair{p.peer.Nick, "upload"}
+			key := peerConnKey{p.peer.Nick, "upload", p.adcToken}
 			if _, ok := p.client.peerConnsByKey[key]; ok {
-				return fmt.Errorf("a connection with this peer and direction already exists")
+				return fmt.Errorf("a connection with this peer, direction and token already exists")
+			}
+			if !p.client.peerConnUploadAllow(p.peer) {
+				return fmt.Errorf("too many upload connections with this peer")
 			}
 			p.client.peerConnsByKey[key] = p
 
 			p.direction = "upload"
-			p.state = "wait_upload"
+			p.setIdle("wait_upload")
 		}
 
 	case *protoadc.AdcCGetFile:
@@ -360,8 +432,8 @@ func (p *peerConn) handleMessage(msgi protocommon.MsgDecodable) error {
 			return fmt.Errorf("[AdcGet] invalid state: %s", p.state)
 		}
 		query := msg.Msg.Type + " " + msg.Msg.Path
-		ok := newUpload(p.client, p, query, uint64(msg.Msg.Start),
-			msg.Msg.Bytes, msg.Msg.Compressed)
+		ok := newUpload(p.client, p, uploadCmdGet, query, uint64(msg.Msg.Start),
+			msg.Msg.Bytes, msg.Msg.Compressed, msg.Msg.Recursive)
 		if ok {
 			return errorDelegatedUpload
 		}
@@ -376,6 +448,10 @@ func (p *peerConn) handleMessage(msgi protocommon.MsgDecodable) error {
 			return fmt.Errorf("peer not connected to hub (%s)", msg.Name)
 		}
 
+		if err := p.validateTLS(); err != nil {
+			return err
+		}
+
 	case *nmdc.Lock:
 		if p.state != "mynick" {
 			return fmt.Errorf("[Lock] invalid state: %s", p.state)
@@ -399,7 +475,7 @@ func (p *peerConn) handleMessage(msgi protocommon.MsgDecodable) error {
 			nmdc.ExtTTHF,
 		}
 		if !p.client.conf.PeerDisableCompression {
-			features = append(features, nmdc.ExtZLIG)
+			features = append(features, nmdc.ExtZLIG, nmdc.ExtGetZBlock)
 		}
 		p.conn.Write(&nmdc.Supports{features}) //nolint:govet
 
@@ -428,6 +504,10 @@ func (p *peerConn) handleMessage(msgi protocommon.MsgDecodable) error {
 			return fmt.Errorf("[Supports] invalid state: %s", p.state)
 		}
 		p.state = "supports"
+		p.remoteFeatures = make(map[string]struct{})
+		for _, ext := range msg.Ext {
+			p.remoteFeatures[ext] = struct{}{}
+		}
 
 	case *nmdc.Direction:
 		if p.state != "supports" {
@@ -475,9 +555,25 @@ func (p *peerConn) handleMessage(msgi protocommon.MsgDecodable) error {
 			return fmt.Errorf("double upload request")
 		}
 
-		key := nickDirectionPair{p.peer.Nick, direction}
+		// NMDC does not provide tokens: download connections take the token
+		// of the download, upload connections a random one
+		var dl *Download
+		if direction == "download" {
+			dl = p.client.downloadPendingByPeer(p.peer)
+			if dl == nil {
+				return fmt.Errorf("download connection but cannot find download")
+			}
+			p.adcToken = dl.adcToken
+		} else {
+			if !p.client.peerConnUploadAllow(p.peer) {
+				return fmt.Errorf("too many upload connections with this peer")
+			}
+			p.adcToken = protoadc.AdcRandomToken()
+		}
+
+		key := peerConnKey{p.peer.Nick, direction, p.adcToken}
 		if _, ok := p.client.peerConnsByKey[key]; ok {
-			return fmt.Errorf("a connection with this peer and direction already exists")
+			return fmt.Errorf("a connection with this peer, direction and token already exists")
 		}
 
 		p.client.peerConnsByKey[key] = p
@@ -485,32 +581,59 @@ func (p *peerConn) handleMessage(msgi protocommon.MsgDecodable) error {
 
 		// upload
 		if p.direction == "upload" {
-			p.state = "wait_upload"
+			p.setIdle("wait_upload")
 
 			// download
 		} else {
-			dl := p.client.downloadPendingByPeer(p.peer)
-			if dl == nil {
-				return fmt.Errorf("download connection but cannot find download")
-			}
-
-			p.state = "delegated_download"
+			p.setBusy("delegated_download")
 			p.transfer = dl
 			dl.pconn = p
 			dl.state = "processing"
 			dl.peerChan <- struct{}{}
 		}
 
-	case *nmdc.ADCGet:
+	case *protonmdc.NmdcAdcGet:
 		if p.state != "wait_upload" {
 			return fmt.Errorf("[AdcGet] invalid state: %s", p.state)
 		}
 		query := string(msg.ContentType) + " " + string(msg.Identifier)
-		ok := newUpload(p.client, p, query, msg.Start, msg.Length, msg.Compressed)
+		ok := newUpload(p.client, p, uploadCmdGet, query, msg.Start, msg.Length, msg.Compressed, msg.Recursive)
 		if ok {
 			return errorDelegatedUpload
 		}
 
+	case *protonmdc.NmdcGet:
+		if p.state != "wait_upload" {
+			return fmt.Errorf("[Get] invalid state: %s", p.state)
+		}
+		// the upload starts when Send is received
+		newUpload(p.client, p, uploadCmdNmdcGet, nmdcLegacyQuery(msg.Filename),
+			msg.Start-1, -1, false, false)
+
+	case *protonmdc.NmdcSend:
+		if p.state != "wait_send" {
+			return fmt.Errorf("[Send] invalid state: %s", p.state)
+		}
+		p.setBusy("delegated_upload")
+		return errorDelegatedUpload
+
+	case *protonmdc.NmdcGetBlock:
+		if p.state != "wait_upload" {
+			return fmt.Errorf("[%s] invalid state: %s", msg.Type(), p.state)
+		}
+		ok := newUpload(p.client, p, uploadCmdNmdcGetBlock, nmdcLegacyQuery(msg.Filename),
+			msg.Start, msg.Length, msg.Compressed, false)
+		if ok {
+			return errorDelegatedUpload
+		}
+
+	case *protonmdc.NmdcGetListLen:
+		if p.state != "wait_upload" {
+			return fmt.Errorf("[GetListLen] invalid state: %s", p.state)
+		}
+		fileList := p.client.shareProfileFor(p.peer).fileList
+		p.conn.Write(&protonmdc.NmdcListLen{Length: uint64(len(fileList))})
+
 	default:
 		return fmt.Errorf("unhandled: %T %+v", msgi, msgi)
 	}
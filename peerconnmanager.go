@@ -0,0 +1,162 @@
+package dctk
+
+import (
+	"net"
+	"time"
+
+	"github.com/aler9/dctk/pkg/log"
+)
+
+// PeerConnStats contains statistics about connections with other peers.
+type PeerConnStats struct {
+	// the number of open connections
+	Open uint
+	// the number of open connections that are waiting for a transfer
+	Idle uint
+	// the number of connections opened since the client started
+	Opened uint64
+	// the number of transfers that used an existing connection instead of a new one
+	Reused uint64
+	// the number of connections closed because they were idle for too long
+	// or to make room for new ones
+	ClosedIdle uint64
+	// the number of connections refused because of the connection limits
+	Rejected uint64
+}
+
+// PeerConnStats returns statistics about connections with other peers.
+func (c *Client) PeerConnStats() PeerConnStats {
+	st := c.peerConnStats
+	for p := range c.peerConns {
+		if p.terminateRequested {
+			continue
+		}
+		st.Open++
+		if p.isIdle() {
+			st.Idle++
+		}
+	}
+	return st
+}
+
+// peerConnAllow checks whether a new connection with a peer can be opened.
+// When the connection limit is reached, the oldest idle connection is
+// closed to make room for the new one.
+func (c *Client) peerConnAllow(ip string, incoming bool) bool {
+	if incoming {
+		count := uint(0)
+		for p := range c.peerConns {
+			if !p.terminateRequested && p.remoteIP == ip {
+				count++
+			}
+		}
+		if count >= c.conf.PeerConnMaxPerIP {
+			log.Log(c.conf.LogLevel, log.LevelInfo, "[peer] too many connections from %s, rejecting", ip)
+			c.peerConnStats.Rejected++
+			return false
+		}
+	}
+
+	count := uint(0)
+	var oldest *peerConn
+	for p := range c.peerConns {
+		if p.terminateRequested {
+			continue
+		}
+		count++
+		if p.isIdle() && !p.keptForQueuedDownload() &&
+			(oldest == nil || p.idleSince.Before(oldest.idleSince)) {
+			oldest = p
+		}
+	}
+	if count < c.conf.PeerConnMax {
+		return true
+	}
+
+	if oldest == nil {
+		log.Log(c.conf.LogLevel, log.LevelInfo, "[peer] too many connections, rejecting")
+		c.peerConnStats.Rejected++
+		return false
+	}
+
+	log.Log(c.conf.LogLevel, log.LevelInfo, "[peer] too many connections, closing idle connection with %s",
+		oldest.peer.Nick)
+	c.peerConnStats.ClosedIdle++
+	// release the key immediately, in order to allow a new connection to take it
+	delete(c.peerConnsByKey, peerConnKey{oldest.peer.Nick, oldest.direction, oldest.adcToken})
+	oldest.close()
+	return true
+}
+
+// peerConnUploadAllow checks whether a new upload connection with a peer can
+// be opened.
+func (c *Client) peerConnUploadAllow(peer *Peer) bool {
+	count := uint(0)
+	for key, p := range c.peerConnsByKey {
+		if !p.terminateRequested && key.nick == peer.Nick && key.direction == "upload" {
+			count++
+		}
+	}
+	if count >= c.conf.MaxUploadConnsPerPeer {
+		log.Log(c.conf.LogLevel, log.LevelInfo, "[peer] too many upload connections with %s, rejecting", peer.Nick)
+		c.peerConnStats.Rejected++
+		return false
+	}
+	return true
+}
+
+// downloadQueuedByPeer returns whether there are downloads from a given peer
+// that are still waiting for a connection.
+func (c *Client) downloadQueuedByPeer(peer *Peer) bool {
+	for t := range c.transfers {
+		if d, ok := t.(*Download); ok && !d.terminateRequested &&
+			d.conf.Peer == peer && d.pconn == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *peerConn) isIdle() bool {
+	return p.state == "wait_upload" || p.state == "wait_download"
+}
+
+// keptForQueuedDownload returns whether the connection must be kept open
+// since queued downloads are going to use it.
+func (p *peerConn) keptForQueuedDownload() bool {
+	return p.direction == "download" && p.client.downloadQueuedByPeer(p.peer)
+}
+
+// setIdle puts the connection in a waiting state and starts the idle timeout.
+func (p *peerConn) setIdle(state string) {
+	p.state = state
+	p.idleSince = time.Now()
+	p.armIdleTimeout()
+}
+
+// armIdleTimeout sets the read timeout of an idle connection. Connections
+// that are waiting for queued downloads do not expire.
+func (p *peerConn) armIdleTimeout() {
+	if p.keptForQueuedDownload() {
+		p.conn.SetReadTimeout(0)
+	} else {
+		p.conn.SetReadTimeout(p.client.conf.PeerConnIdleTimeout)
+	}
+}
+
+// setBusy assigns the connection to a transfer.
+func (p *peerConn) setBusy(state string) {
+	if p.isIdle() {
+		if p.used {
+			p.client.peerConnStats.Reused++
+		}
+		p.conn.ResetReadTimeout()
+	}
+	p.used = true
+	p.state = state
+}
+
+func isTimeoutError(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}
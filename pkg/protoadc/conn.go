@@ -9,6 +9,7 @@ import (
 	"math/rand"
 	"net"
 	"reflect"
+	"strconv"
 	"strings"
 
 	"github.com/aler9/go-dc/adc"
@@ -19,6 +20,7 @@ import (
 
 // standard ADC status codes.
 const (
+	AdcCodeAccessDenied        = 25
 	AdcCodeProtocolUnsupported = 41
 	AdcCodeFileNotAvailable    = 51
 	AdcCodeSlotsFull           = 53
@@ -74,17 +76,52 @@ func (p *Conn) Read() (protocommon.MsgDecodable, error) {
 				return &AdcKeepAlive{}, nil
 			}
 
-			pkt, err := adc.DecodePacket([]byte(msgStr + "\n"))
+			pkt, err := adc.DecodePacketRaw([]byte(msgStr + "\n"))
 			if err != nil {
 				return nil, err
 			}
 
+			// GET, STA and BINF are decoded separately since they can contain
+			// parameters that are not supported by adc.GetRequest, adc.Status
+			// and adc.UserInfo
+			if tpkt, ok := pkt.(*adc.BroadcastPacket); ok {
+				if raw, ok := tpkt.Msg.(*adc.RawMessage); ok && raw.Type == (adc.UserInfo{}).Cmd() {
+					msg := &AdcUserInfo{}
+					if err := tpkt.DecodeMessageTo(msg); err != nil {
+						return nil, err
+					}
+					return &AdcBInfos{tpkt, msg}, nil
+				}
+			}
+
+			if tpkt, ok := pkt.(*adc.ClientPacket); ok {
+				if raw, ok := tpkt.Msg.(*adc.RawMessage); ok {
+					switch raw.Type {
+					case (adc.GetRequest{}).Cmd():
+						msg := &AdcGetRequest{}
+						if err := tpkt.DecodeMessageTo(msg); err != nil {
+							return nil, err
+						}
+						return &AdcCGetFile{tpkt, msg}, nil
+
+					case (adc.Status{}).Cmd():
+						msg := &AdcStatus{}
+						if err := tpkt.DecodeMessageTo(msg); err != nil {
+							return nil, err
+						}
+						return &AdcCStatus{tpkt, msg}, nil
+					}
+				}
+			}
+
+			if err := pkt.DecodeMessage(); err != nil {
+				return nil, err
+			}
+
 			msg := func() interface{} {
 				switch tpkt := pkt.(type) {
 				case *adc.BroadcastPacket:
 					switch msg := pkt.Message().(type) {
-					case adc.UserInfo:
-						return &AdcBInfos{tpkt, &msg}
 					case adc.ChatMessage:
 						return &AdcBMessage{tpkt, &msg}
 					case adc.SearchRequest:
@@ -93,16 +130,12 @@ func (p *Conn) Read() (protocommon.MsgDecodable, error) {
 
 				case *adc.ClientPacket:
 					switch msg := pkt.Message().(type) {
-					case adc.GetRequest:
-						return &AdcCGetFile{tpkt, &msg}
 					case adc.UserInfo:
 						return &AdcCInfos{tpkt, &msg}
 					case adc.GetResponse:
 						return &AdcCSendFile{tpkt, &msg}
 					case adc.Supported:
 						return &AdcCSupports{tpkt, &msg}
-					case adc.Status:
-						return &AdcCStatus{tpkt, &msg}
 					}
 
 				case *adc.DirectPacket:
@@ -192,6 +225,134 @@ func (p *Conn) Write(pktMsg protocommon.MsgEncodable) {
 	p.BaseConn.Write(buf.Bytes())
 }
 
+// AdcGetRequest is a GET request. Unlike adc.GetRequest, it supports
+// the RE1 flag, used to request recursive partial file lists.
+type AdcGetRequest struct {
+	adc.GetRequest
+	Recursive bool
+}
+
+// MarshalADC implements adc.Marshaler.
+func (m AdcGetRequest) MarshalADC(buf *bytes.Buffer) error {
+	if err := m.GetRequest.MarshalADC(buf); err != nil {
+		return err
+	}
+	if m.Recursive {
+		buf.WriteString(" RE1")
+	}
+	return nil
+}
+
+// UnmarshalADC implements adc.Unmarshaler.
+func (m *AdcGetRequest) UnmarshalADC(data []byte) error {
+	fields := bytes.Split(data, []byte(" "))
+	if len(fields) < 4 {
+		return fmt.Errorf("GET: missing fields")
+	}
+
+	// strip flags, that are parsed here
+	for _, flag := range fields[4:] {
+		switch string(flag) {
+		case "ZL1":
+			m.Compressed = true
+		case "RE1":
+			m.Recursive = true
+		}
+	}
+
+	if err := m.GetRequest.UnmarshalADC(bytes.Join(fields[:4], []byte(" "))); err != nil {
+		return err
+	}
+	return nil
+}
+
+// AdcStatus is a STA message. Unlike adc.Status, it supports the QP
+// parameter, that contains the position in the upload queue.
+type AdcStatus struct {
+	adc.Status
+	// position in the upload queue, zero if not provided
+	QueuePosition int
+}
+
+// MarshalADC implements adc.Marshaler.
+func (m AdcStatus) MarshalADC(buf *bytes.Buffer) error {
+	if err := m.Status.MarshalADC(buf); err != nil {
+		return err
+	}
+	if m.QueuePosition > 0 {
+		buf.WriteString(" QP" + strconv.Itoa(m.QueuePosition))
+	}
+	return nil
+}
+
+// UnmarshalADC implements adc.Unmarshaler.
+func (m *AdcStatus) UnmarshalADC(data []byte) error {
+	fields := bytes.Split(data, []byte(" "))
+
+	// strip parameters, that are parsed here
+	m.QueuePosition = 0
+	if len(fields) > 2 {
+		for _, param := range fields[2:] {
+			if bytes.HasPrefix(param, []byte("QP")) {
+				pos, err := strconv.Atoi(string(param[2:]))
+				if err != nil {
+					return fmt.Errorf("STA: invalid queue position: %v", err)
+				}
+				m.QueuePosition = pos
+			}
+		}
+		fields = fields[:2]
+	}
+
+	return m.Status.UnmarshalADC(bytes.Join(fields, []byte(" ")))
+}
+
+// AdcUserInfo is an INF message. Unlike adc.UserInfo, it supports the MS
+// parameter, that contains the number of free mini slots.
+type AdcUserInfo struct {
+	adc.UserInfo
+	// free mini slots, zero if not provided
+	MiniSlotsFree int
+}
+
+// MarshalADC implements adc.Marshaler.
+func (m AdcUserInfo) MarshalADC(buf *bytes.Buffer) error {
+	start := buf.Len()
+	if err := adc.Marshal(buf, &m.UserInfo); err != nil {
+		return err
+	}
+	if m.MiniSlotsFree > 0 {
+		if buf.Len() > start {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString("MS" + strconv.Itoa(m.MiniSlotsFree))
+	}
+	return nil
+}
+
+// UnmarshalADC implements adc.Unmarshaler.
+func (m *AdcUserInfo) UnmarshalADC(data []byte) error {
+	fields := bytes.Split(data, []byte(" "))
+
+	// strip parameters, that are parsed here
+	m.MiniSlotsFree = 0
+	n := 0
+	for _, param := range fields {
+		if bytes.HasPrefix(param, []byte("MS")) {
+			slots, err := strconv.Atoi(string(param[2:]))
+			if err != nil {
+				return fmt.Errorf("INF: invalid mini slots: %v", err)
+			}
+			m.MiniSlotsFree = slots
+			continue
+		}
+		fields[n] = param
+		n++
+	}
+
+	return adc.Unmarshal(bytes.Join(fields[:n], []byte(" ")), &m.UserInfo)
+}
+
 // AdcKeepAlive is an ADC keepalive.
 type AdcKeepAlive struct{}
 
@@ -208,7 +369,7 @@ func (*AdcKeepAlive) AdcTypeEncode(keyEncoded string) string {
 // AdcBInfos is the BINF message.
 type AdcBInfos struct {
 	Pkt *adc.BroadcastPacket
-	Msg *adc.UserInfo
+	Msg *AdcUserInfo
 }
 
 // AdcBMessage is the BMSG message.
@@ -226,7 +387,7 @@ type AdcBSearchRequest struct {
 // AdcCGetFile is the CGET message.
 type AdcCGetFile struct {
 	Pkt *adc.ClientPacket
-	Msg *adc.GetRequest
+	Msg *AdcGetRequest
 }
 
 // AdcCInfos is the CINF message.
@@ -244,7 +405,7 @@ type AdcCSendFile struct {
 // AdcCStatus is the CSTA message.
 type AdcCStatus struct {
 	Pkt *adc.ClientPacket
-	Msg *adc.Status
+	Msg *AdcStatus
 }
 
 // AdcCSupports is the CSUP message.
@@ -0,0 +1,41 @@
+package protoadc
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/aler9/go-dc/adc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdcUserInfo(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		msg  AdcUserInfo
+		enc  string
+	}{
+		{
+			"without mini slots",
+			AdcUserInfo{UserInfo: adc.UserInfo{Name: "user", Version: "1.0", Slots: 2, SlotsFree: 1}},
+			"NIuser SS0 SF0 VE1.0 SL2 FS1 HN0 HR0 HO0 SU",
+		},
+		{
+			"with mini slots",
+			AdcUserInfo{UserInfo: adc.UserInfo{Name: "user", Version: "1.0", Slots: 2, SlotsFree: 1}, MiniSlotsFree: 3},
+			"NIuser SS0 SF0 VE1.0 SL2 FS1 HN0 HR0 HO0 SU MS3",
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, adc.Marshal(&buf, c.msg))
+			require.Equal(t, c.enc, buf.String())
+
+			var dec AdcUserInfo
+			require.NoError(t, adc.Unmarshal(buf.Bytes(), &dec))
+			require.Equal(t, c.msg, dec)
+		})
+	}
+
+	var dec AdcUserInfo
+	require.Error(t, adc.Unmarshal([]byte("SS0 SF0 MSabc"), &dec))
+}
@@ -53,6 +53,8 @@ type BaseConn struct {
 	msgDelim    byte
 	sendChan    chan []byte
 	closer      io.Closer
+	timedConn   *timedConn
+	readTimeout time.Duration
 	monitoredConnIntf
 	reader       *lineproto.Reader
 	writer       *lineproto.Writer
@@ -92,6 +94,8 @@ func NewBaseConn(logLevel log.Level,
 		msgDelim:          msgDelim,
 		writerJoined:      make(chan struct{}),
 		closer:            mc,
+		timedConn:         tc,
+		readTimeout:       readTimeout,
 		monitoredConnIntf: mc,
 		reader:            rdr,
 		writer:            wri,
@@ -136,6 +140,17 @@ func (c *BaseConn) BinaryMode() bool {
 	return c.binaryMode
 }
 
+// SetReadTimeout overrides the read timeout. A zero value disables the timeout.
+// It can be called while a read is in progress.
+func (c *BaseConn) SetReadTimeout(val time.Duration) {
+	c.timedConn.setReadTimeout(val)
+}
+
+// ResetReadTimeout restores the read timeout set when the connection was created.
+func (c *BaseConn) ResetReadTimeout() {
+	c.timedConn.setReadTimeout(c.readTimeout)
+}
+
 // SetSyncMode sets the sync mode.
 func (c *BaseConn) SetSyncMode(val bool) {
 	if val == c.syncMode {
@@ -229,6 +244,11 @@ func (c *BaseConn) EnableWriterZlib() error {
 	return c.writer.EnableZlib()
 }
 
+// EnableWriterZlibLevel enables zlib on writings with a given compression level.
+func (c *BaseConn) EnableWriterZlibLevel(lvl int) error {
+	return c.writer.EnableZlibLevel(lvl)
+}
+
 // DisableWriterZlib disables zlib on writings.
 func (c *BaseConn) DisableWriterZlib() error {
 	return c.writer.DisableZlib()
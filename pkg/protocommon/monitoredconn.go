@@ -2,15 +2,16 @@ package protocommon
 
 import (
 	"io"
+	"sync/atomic"
 )
 
 // monitoredConn implements a read and a writer counter, that computes the
-// connection speed.
+// connection speed. Counters can be pulled from any goroutine.
 type monitoredConn struct {
 	io.Closer
 	in           io.ReadWriteCloser
-	readCounter  uint
-	writeCounter uint
+	readCounter  uint64 // atomic
+	writeCounter uint64 // atomic
 }
 
 func newMonitoredConn(in io.ReadWriteCloser) *monitoredConn {
@@ -22,24 +23,20 @@ func newMonitoredConn(in io.ReadWriteCloser) *monitoredConn {
 
 func (c *monitoredConn) Read(buf []byte) (int, error) {
 	n, err := c.in.Read(buf)
-	c.readCounter += uint(n)
+	atomic.AddUint64(&c.readCounter, uint64(n))
 	return n, err
 }
 
 func (c *monitoredConn) Write(buf []byte) (int, error) {
 	n, err := c.in.Write(buf)
-	c.writeCounter += uint(n)
+	atomic.AddUint64(&c.writeCounter, uint64(n))
 	return n, err
 }
 
 func (c *monitoredConn) PullReadCounter() uint {
-	ret := c.readCounter
-	c.readCounter = 0
-	return ret
+	return uint(atomic.SwapUint64(&c.readCounter, 0))
 }
 
 func (c *monitoredConn) PullWriteCounter() uint {
-	ret := c.writeCounter
-	c.writeCounter = 0
-	return ret
+	return uint(atomic.SwapUint64(&c.writeCounter, 0))
 }
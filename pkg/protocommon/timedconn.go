@@ -3,6 +3,7 @@ package protocommon
 import (
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
@@ -10,23 +11,34 @@ import (
 type timedConn struct {
 	io.Closer
 	conn         net.Conn
-	readTimeout  time.Duration
+	readTimeout  int64 // atomic
 	writeTimeout time.Duration
 }
 
 func newTimedConn(conn net.Conn, readTimeout time.Duration,
-	writeTimeout time.Duration) io.ReadWriteCloser {
+	writeTimeout time.Duration) *timedConn {
 	return &timedConn{
 		Closer:       conn,
 		conn:         conn,
-		readTimeout:  readTimeout,
+		readTimeout:  int64(readTimeout),
 		writeTimeout: writeTimeout,
 	}
 }
 
+// setReadTimeout changes the read timeout. It can be called while a Read is
+// in progress, since the new timeout is applied immediately.
+func (c *timedConn) setReadTimeout(readTimeout time.Duration) {
+	atomic.StoreInt64(&c.readTimeout, int64(readTimeout))
+	if readTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(readTimeout))
+	} else {
+		c.conn.SetReadDeadline(time.Time{})
+	}
+}
+
 func (c *timedConn) Read(buf []byte) (int, error) {
-	if c.readTimeout > 0 {
-		if err := c.conn.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
+	if readTimeout := time.Duration(atomic.LoadInt64(&c.readTimeout)); readTimeout > 0 {
+		if err := c.conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
 			return 0, err
 		}
 	}
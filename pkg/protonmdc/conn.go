@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net"
 	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/aler9/go-dc/nmdc"
 
@@ -54,9 +56,9 @@ func (p *Conn) Read() (protocommon.MsgDecodable, error) {
 				cmd := func() nmdc.Message {
 					switch key {
 					case "ADCGET":
-						return &nmdc.ADCGet{}
+						return &NmdcAdcGet{}
 					case "ADCSND":
-						return &nmdc.ADCSnd{}
+						return &NmdcAdcSnd{}
 					case "BadPass":
 						return &nmdc.BadPass{}
 					case "BotList":
@@ -67,8 +69,18 @@ func (p *Conn) Read() (protocommon.MsgDecodable, error) {
 						return &nmdc.Direction{}
 					case "Error":
 						return &nmdc.Error{}
+					case "Failed":
+						return &nmdc.Failed{}
+					case "FileLength":
+						return &NmdcFileLength{}
 					case "ForceMove":
 						return &nmdc.ForceMove{}
+					case "Get":
+						return &NmdcGet{}
+					case "GetListLen":
+						return &NmdcGetListLen{}
+					case "GetZBlock":
+						return &NmdcGetBlock{Compressed: true}
 					case "GetPass":
 						return &nmdc.GetPass{}
 					case "Hello":
@@ -81,12 +93,14 @@ func (p *Conn) Read() (protocommon.MsgDecodable, error) {
 						return &nmdc.HubTopic{}
 					case "Key":
 						return &nmdc.Key{}
+					case "ListLen":
+						return &NmdcListLen{}
 					case "Lock":
 						return &nmdc.Lock{}
 					case "LogedIn":
 						return &nmdc.LogedIn{}
 					case "MaxedOut":
-						return &nmdc.MaxedOut{}
+						return &NmdcMaxedOut{}
 					case "MyINFO":
 						return &nmdc.MyINFO{}
 					case "MyNick":
@@ -99,12 +113,20 @@ func (p *Conn) Read() (protocommon.MsgDecodable, error) {
 						return &nmdc.RevConnectToMe{}
 					case "Search":
 						return &nmdc.Search{}
+					case "Send":
+						return &NmdcSend{}
+					case "Sending":
+						return &NmdcSending{}
 					case "SR":
 						return &nmdc.SR{}
 					case "Supports":
 						return &nmdc.Supports{}
 					case "To:":
 						return &nmdc.PrivateMessage{}
+					case "UGetBlock":
+						return &NmdcGetBlock{Unicode: true}
+					case "UGetZBlock":
+						return &NmdcGetBlock{Unicode: true, Compressed: true}
 					case "UserCommand":
 						return &nmdc.UserCommand{}
 					case "UserIP":
@@ -193,3 +215,309 @@ func (p *Conn) Write(msg protocommon.MsgEncodable) {
 
 // NmdcKeepAlive is a NMDC keepalive.
 type NmdcKeepAlive struct{}
+
+// identifiers of ADCGET and ADCSND are escaped like in ADC, since they can
+// contain spaces.
+var adcIdentifierEscaper = strings.NewReplacer(`\`, `\\`, " ", `\s`, "\n", `\n`)
+
+var adcIdentifierUnescaper = strings.NewReplacer(`\\`, `\`, `\s`, " ", `\n`, "\n")
+
+// NmdcAdcGet is the ADCGET command. Unlike nmdc.ADCGet, it supports
+// the RE1 flag, used to request recursive partial file lists, and
+// identifiers that contain spaces.
+type NmdcAdcGet struct {
+	nmdc.ADCGet
+	Recursive bool
+}
+
+// MarshalNMDC implements nmdc.Message.
+func (m *NmdcAdcGet) MarshalNMDC(enc *nmdc.TextEncoder, buf *bytes.Buffer) error {
+	escaped := m.ADCGet
+	escaped.Identifier = nmdc.String(adcIdentifierEscaper.Replace(string(m.Identifier)))
+	if err := escaped.MarshalNMDC(enc, buf); err != nil {
+		return err
+	}
+	if m.Recursive {
+		buf.WriteString(" RE1")
+	}
+	return nil
+}
+
+// UnmarshalNMDC implements nmdc.Message.
+func (m *NmdcAdcGet) UnmarshalNMDC(dec *nmdc.TextDecoder, data []byte) error {
+	if err := m.ADCGet.UnmarshalNMDC(dec, data); err != nil {
+		return err
+	}
+	m.Identifier = nmdc.String(adcIdentifierUnescaper.Replace(string(m.Identifier)))
+	fields := bytes.Split(data, []byte(" "))
+	if len(fields) > 4 {
+		for _, flag := range fields[4:] {
+			if string(flag) == "RE1" {
+				m.Recursive = true
+			}
+		}
+	}
+	return nil
+}
+
+// NmdcAdcSnd is the ADCSND command. Unlike nmdc.ADCSnd, it supports
+// identifiers that contain spaces.
+type NmdcAdcSnd struct {
+	nmdc.ADCSnd
+}
+
+// MarshalNMDC implements nmdc.Message.
+func (m *NmdcAdcSnd) MarshalNMDC(enc *nmdc.TextEncoder, buf *bytes.Buffer) error {
+	escaped := m.ADCSnd
+	escaped.Identifier = nmdc.String(adcIdentifierEscaper.Replace(string(m.Identifier)))
+	return escaped.MarshalNMDC(enc, buf)
+}
+
+// UnmarshalNMDC implements nmdc.Message.
+func (m *NmdcAdcSnd) UnmarshalNMDC(dec *nmdc.TextDecoder, data []byte) error {
+	if err := m.ADCSnd.UnmarshalNMDC(dec, data); err != nil {
+		return err
+	}
+	m.Identifier = nmdc.String(adcIdentifierUnescaper.Replace(string(m.Identifier)))
+	return nil
+}
+
+// NmdcMaxedOut is the MaxedOut command. Unlike nmdc.MaxedOut, it supports
+// the queue position, that is sent by clients with an upload queue.
+type NmdcMaxedOut struct {
+	nmdc.MaxedOut
+	// position in the upload queue, zero if not provided
+	QueuePosition int
+}
+
+// MarshalNMDC implements nmdc.Message.
+func (m *NmdcMaxedOut) MarshalNMDC(enc *nmdc.TextEncoder, buf *bytes.Buffer) error {
+	if m.QueuePosition > 0 {
+		buf.WriteString(strconv.Itoa(m.QueuePosition))
+	}
+	return nil
+}
+
+// UnmarshalNMDC implements nmdc.Message.
+func (m *NmdcMaxedOut) UnmarshalNMDC(dec *nmdc.TextDecoder, data []byte) error {
+	m.QueuePosition = 0
+	if len(data) > 0 {
+		pos, err := strconv.Atoi(string(data))
+		if err != nil {
+			return fmt.Errorf("MaxedOut: invalid queue position: %v", err)
+		}
+		m.QueuePosition = pos
+	}
+	return nil
+}
+
+// NmdcGet is the Get command, the legacy way to request a file.
+type NmdcGet struct {
+	// path of the file, with backslashes as separators
+	Filename string
+	// offset of the first byte to send, starting from 1
+	Start uint64
+}
+
+// Type implements nmdc.Message.
+func (m *NmdcGet) Type() string {
+	return "Get"
+}
+
+// MarshalNMDC implements nmdc.Message.
+func (m *NmdcGet) MarshalNMDC(enc *nmdc.TextEncoder, buf *bytes.Buffer) error {
+	if err := nmdc.String(m.Filename).MarshalNMDC(enc, buf); err != nil {
+		return err
+	}
+	buf.WriteString("$" + strconv.FormatUint(m.Start, 10))
+	return nil
+}
+
+// UnmarshalNMDC implements nmdc.Message.
+func (m *NmdcGet) UnmarshalNMDC(dec *nmdc.TextDecoder, data []byte) error {
+	i := bytes.LastIndexByte(data, '$')
+	if i < 0 {
+		return fmt.Errorf("Get: missing start")
+	}
+
+	var filename nmdc.String
+	if err := filename.UnmarshalNMDC(dec, data[:i]); err != nil {
+		return err
+	}
+	m.Filename = string(filename)
+
+	start, err := strconv.ParseUint(string(data[i+1:]), 10, 64)
+	if err != nil {
+		return fmt.Errorf("Get: invalid start: %v", err)
+	}
+	if start == 0 {
+		return fmt.Errorf("Get: start must be greater than zero")
+	}
+	m.Start = start
+	return nil
+}
+
+// NmdcFileLength is the FileLength command, sent in reply to Get.
+type NmdcFileLength struct {
+	Length uint64
+}
+
+// Type implements nmdc.Message.
+func (m *NmdcFileLength) Type() string {
+	return "FileLength"
+}
+
+// MarshalNMDC implements nmdc.Message.
+func (m *NmdcFileLength) MarshalNMDC(enc *nmdc.TextEncoder, buf *bytes.Buffer) error {
+	buf.WriteString(strconv.FormatUint(m.Length, 10))
+	return nil
+}
+
+// UnmarshalNMDC implements nmdc.Message.
+func (m *NmdcFileLength) UnmarshalNMDC(dec *nmdc.TextDecoder, data []byte) error {
+	length, err := strconv.ParseUint(string(data), 10, 64)
+	if err != nil {
+		return fmt.Errorf("FileLength: invalid length: %v", err)
+	}
+	m.Length = length
+	return nil
+}
+
+// NmdcSend is the Send command, that starts a transfer requested with Get.
+type NmdcSend struct {
+	nmdc.NoArgs
+}
+
+// Type implements nmdc.Message.
+func (m *NmdcSend) Type() string {
+	return "Send"
+}
+
+// NmdcGetBlock is the UGetBlock command, or, if compressed, the GetZBlock
+// or UGetZBlock command.
+type NmdcGetBlock struct {
+	// whether the filename is encoded in UTF-8 (UGetBlock, UGetZBlock)
+	Unicode bool
+	// whether the content is compressed with zlib (GetZBlock, UGetZBlock)
+	Compressed bool
+	// offset of the first byte to send, starting from 0
+	Start uint64
+	// number of bytes to send, -1 means until the end of the file
+	Length int64
+	// path of the file, with backslashes as separators
+	Filename string
+}
+
+// Type implements nmdc.Message.
+func (m *NmdcGetBlock) Type() string {
+	switch {
+	case m.Unicode && m.Compressed:
+		return "UGetZBlock"
+	case m.Compressed:
+		return "GetZBlock"
+	}
+	return "UGetBlock"
+}
+
+// MarshalNMDC implements nmdc.Message.
+func (m *NmdcGetBlock) MarshalNMDC(enc *nmdc.TextEncoder, buf *bytes.Buffer) error {
+	buf.WriteString(strconv.FormatUint(m.Start, 10) + " " + strconv.FormatInt(m.Length, 10) + " ")
+	return nmdc.String(m.Filename).MarshalNMDC(enc, buf)
+}
+
+// UnmarshalNMDC implements nmdc.Message.
+func (m *NmdcGetBlock) UnmarshalNMDC(dec *nmdc.TextDecoder, data []byte) error {
+	fields := bytes.SplitN(data, []byte(" "), 3)
+	if len(fields) != 3 {
+		return fmt.Errorf("%s: missing fields", m.Type())
+	}
+
+	start, err := strconv.ParseUint(string(fields[0]), 10, 64)
+	if err != nil {
+		return fmt.Errorf("%s: invalid start: %v", m.Type(), err)
+	}
+	m.Start = start
+
+	length, err := strconv.ParseInt(string(fields[1]), 10, 64)
+	if err != nil {
+		return fmt.Errorf("%s: invalid length: %v", m.Type(), err)
+	}
+	m.Length = length
+
+	var filename nmdc.String
+	if err := filename.UnmarshalNMDC(dec, fields[2]); err != nil {
+		return err
+	}
+	m.Filename = string(filename)
+	return nil
+}
+
+// NmdcSending is the Sending command, sent in reply to UGetBlock,
+// GetZBlock and UGetZBlock.
+type NmdcSending struct {
+	// number of bytes that are going to be sent, -1 if not provided
+	Length int64
+}
+
+// Type implements nmdc.Message.
+func (m *NmdcSending) Type() string {
+	return "Sending"
+}
+
+// MarshalNMDC implements nmdc.Message.
+func (m *NmdcSending) MarshalNMDC(enc *nmdc.TextEncoder, buf *bytes.Buffer) error {
+	if m.Length >= 0 {
+		buf.WriteString(strconv.FormatInt(m.Length, 10))
+	}
+	return nil
+}
+
+// UnmarshalNMDC implements nmdc.Message.
+func (m *NmdcSending) UnmarshalNMDC(dec *nmdc.TextDecoder, data []byte) error {
+	m.Length = -1
+	if len(data) > 0 {
+		length, err := strconv.ParseInt(string(data), 10, 64)
+		if err != nil {
+			return fmt.Errorf("Sending: invalid length: %v", err)
+		}
+		m.Length = length
+	}
+	return nil
+}
+
+// NmdcGetListLen is the GetListLen command, that requests the size of the
+// file list.
+type NmdcGetListLen struct {
+	nmdc.NoArgs
+}
+
+// Type implements nmdc.Message.
+func (m *NmdcGetListLen) Type() string {
+	return "GetListLen"
+}
+
+// NmdcListLen is the ListLen command, sent in reply to GetListLen.
+type NmdcListLen struct {
+	Length uint64
+}
+
+// Type implements nmdc.Message.
+func (m *NmdcListLen) Type() string {
+	return "ListLen"
+}
+
+// MarshalNMDC implements nmdc.Message.
+func (m *NmdcListLen) MarshalNMDC(enc *nmdc.TextEncoder, buf *bytes.Buffer) error {
+	buf.WriteString(strconv.FormatUint(m.Length, 10))
+	return nil
+}
+
+// UnmarshalNMDC implements nmdc.Message.
+func (m *NmdcListLen) UnmarshalNMDC(dec *nmdc.TextDecoder, data []byte) error {
+	length, err := strconv.ParseUint(string(data), 10, 64)
+	if err != nil {
+		return fmt.Errorf("ListLen: invalid length: %v", err)
+	}
+	m.Length = length
+	return nil
+}
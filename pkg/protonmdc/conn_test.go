@@ -0,0 +1,127 @@
+package protonmdc
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/aler9/go-dc/nmdc"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/dctk/pkg/log"
+)
+
+func TestMessages(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		msg  nmdc.Message
+		enc  string
+		dec  nmdc.Message
+	}{
+		{
+			"get",
+			&NmdcGet{Filename: "dir\\file $1.txt", Start: 1},
+			"dir\\file &#36;1.txt$1",
+			&NmdcGet{},
+		},
+		{
+			"getzblock",
+			&NmdcGetBlock{Compressed: true, Start: 100, Length: 200, Filename: "dir\\file.txt"},
+			"100 200 dir\\file.txt",
+			&NmdcGetBlock{Compressed: true},
+		},
+		{
+			"ugetblock",
+			&NmdcGetBlock{Unicode: true, Start: 0, Length: -1, Filename: "dir\\日本 file.txt"},
+			"0 -1 dir\\日本 file.txt",
+			&NmdcGetBlock{Unicode: true},
+		},
+		{
+			"ugetzblock",
+			&NmdcGetBlock{Unicode: true, Compressed: true, Start: 5, Length: 10, Filename: "file.txt"},
+			"5 10 file.txt",
+			&NmdcGetBlock{Unicode: true, Compressed: true},
+		},
+		{
+			"sending",
+			&NmdcSending{Length: 12345},
+			"12345",
+			&NmdcSending{},
+		},
+		{
+			"sending without length",
+			&NmdcSending{Length: -1},
+			"",
+			&NmdcSending{},
+		},
+		{
+			"filelength",
+			&NmdcFileLength{Length: 12345},
+			"12345",
+			&NmdcFileLength{},
+		},
+		{
+			"listlen",
+			&NmdcListLen{Length: 54321},
+			"54321",
+			&NmdcListLen{},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, c.msg.MarshalNMDC(nil, &buf))
+			require.Equal(t, c.enc, buf.String())
+
+			require.NoError(t, c.dec.UnmarshalNMDC(nil, buf.Bytes()))
+			require.Equal(t, c.msg, c.dec)
+		})
+	}
+}
+
+func TestMessagesMalformed(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		msg  nmdc.Message
+		enc  string
+	}{
+		{"get missing start", &NmdcGet{}, "file.txt"},
+		{"get invalid start", &NmdcGet{}, "file.txt$abc"},
+		{"get zero start", &NmdcGet{}, "file.txt$0"},
+		{"getblock missing fields", &NmdcGetBlock{Unicode: true}, "0 -1"},
+		{"getblock invalid start", &NmdcGetBlock{Unicode: true}, "-1 -1 file.txt"},
+		{"getblock invalid length", &NmdcGetBlock{Unicode: true, Compressed: true}, "0 abc file.txt"},
+		{"getblock invalid filename", &NmdcGetBlock{Unicode: true}, "0 -1 file\x00.txt"},
+		{"sending invalid length", &NmdcSending{}, "abc"},
+		{"filelength empty", &NmdcFileLength{}, ""},
+		{"filelength negative", &NmdcFileLength{}, "-1"},
+		{"listlen invalid length", &NmdcListLen{}, "abc"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			require.Error(t, c.msg.UnmarshalNMDC(nil, []byte(c.enc)))
+		})
+	}
+}
+
+func TestConnRead(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	conn := NewConn(log.LevelError, "p", local, true, true)
+	defer conn.Close()
+
+	go remote.Write([]byte("$Get dir\\file.txt$5|$Send|$UGetZBlock 0 -1 file.txt|" +
+		"$GetZBlock 1 2 file.txt|$Sending|$FileLength 10|$ListLen 20|"))
+
+	for _, expected := range []interface{}{
+		&NmdcGet{Filename: "dir\\file.txt", Start: 5},
+		&NmdcSend{},
+		&NmdcGetBlock{Unicode: true, Compressed: true, Start: 0, Length: -1, Filename: "file.txt"},
+		&NmdcGetBlock{Compressed: true, Start: 1, Length: 2, Filename: "file.txt"},
+		&NmdcSending{Length: -1},
+		&NmdcFileLength{Length: 10},
+		&NmdcListLen{Length: 20},
+	} {
+		msg, err := conn.Read()
+		require.NoError(t, err)
+		require.Equal(t, expected, msg)
+	}
+}
@@ -133,3 +133,43 @@ func (l Leaves) TreeHash() Hash {
 	h := ttl.TreeHash()
 	return Hash(h)
 }
+
+// blockSize is the size of the data blocks whose hashes are the TTH leaves.
+const blockSize = 1024
+
+// LeavesCount returns the number of TTH leaves of a file with the given size,
+// reduced to the given tree depth (see Leaves.Reduce).
+func LeavesCount(size uint64, depth uint) int {
+	n := uint64(1)
+	if size > blockSize {
+		n = (size + blockSize - 1) / blockSize
+	}
+	for n > 1<<depth {
+		n = (n + 1) / 2
+	}
+	return int(n)
+}
+
+// Reduce converts TTH leaves into the nodes of the tree at the given depth,
+// that are at most 2^depth. This is used to limit the size of the leaves
+// that are stored and sent to peers. The TTH of the reduced leaves is the
+// same of the original ones.
+func (l Leaves) Reduce(depth uint) Leaves {
+	lvl := append(Leaves{}, l...)
+	buf := make([]byte, 2*len(Hash{})+1)
+
+	for len(lvl) > 1<<depth {
+		for i := 0; i < len(lvl); i += 2 {
+			if i+1 >= len(lvl) {
+				lvl[i/2] = lvl[i]
+			} else {
+				buf[0] = 0x01
+				copy(buf[1:], lvl[i][:])
+				copy(buf[1+len(Hash{}):], lvl[i+1][:])
+				lvl[i/2] = Hash(godctiger.HashBytes(buf))
+			}
+		}
+		lvl = lvl[:(len(lvl)+1)/2]
+	}
+	return lvl
+}
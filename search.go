@@ -3,6 +3,7 @@ package dctk
 import (
 	"fmt"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/aler9/dctk/pkg/log"
 	"github.com/aler9/dctk/pkg/tiger"
@@ -54,6 +55,8 @@ type SearchConf struct {
 }
 
 type searchIncomingRequest struct {
+	// the author of the request, if known
+	peer     *Peer
 	isActive bool
 	stype    SearchType
 	minSize  uint64
@@ -71,78 +74,103 @@ func (c *Client) Search(conf SearchConf) error {
 }
 
 func (c *Client) handleSearchIncomingRequest(req *searchIncomingRequest) ([]interface{}, error) {
+	// Implementations should send a maximum of 5 search results to passive users
+	// and 10 search results to active users
+	maxResults := 5
+	if req.isActive {
+		maxResults = 10
+	}
+
+	// only directories of the share profile of the author are searched
+	results, err := c.shareSearch(req, c.shareProfileFor(req.peer), maxResults)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Log(c.conf.LogLevel, log.LevelInfo, "[search] req: %+v | sent %d results", req, len(results))
+	return results, nil
+}
+
+// shareSearch returns the shared files and directories that match a search
+// request. If profile is nil, all directories are searched. If maxResults
+// is zero, results are not limited.
+func (c *Client) shareSearch(req *searchIncomingRequest, profile *shareProfile,
+	maxResults int) ([]interface{}, error) {
 	var results []interface{}
-	var scanDir func(dname string, dir *shareDirectory, dirAddToResults bool)
+	added := make(map[interface{}]struct{})
+
+	// addResult adds a file or directory and returns whether more results can be added
+	addResult := func(res interface{}) bool {
+		if profile != nil {
+			apath := func() string {
+				if f, ok := res.(*shareFile); ok {
+					return f.aliasPath
+				}
+				return res.(*shareDirectory).aliasPath
+			}()
+			if !profile.visible(apath) {
+				return true
+			}
+		}
+
+		if _, ok := added[res]; !ok {
+			added[res] = struct{}{}
+			results = append(results, res)
+		}
+		return maxResults == 0 || len(results) < maxResults
+	}
 
 	// search file or directory by name
 	if req.stype == SearchAny || req.stype == SearchDirectory {
-		if len(req.query) < 3 {
+		if utf8.RuneCountInString(req.query) < shareIndexTokenLen {
 			return nil, fmt.Errorf("query too short: %s", req.query)
 		}
 
 		// normalize query
 		req.query = strings.ToLower(req.query)
 
-		scanDir = func(dname string, dir *shareDirectory, dirAddToResults bool) {
-			// always add directories
-			if !dirAddToResults {
-				dirAddToResults = strings.Contains(strings.ToLower(dname), req.query)
-			}
-			if dirAddToResults {
-				results = append(results, dir)
+		// add a matching directory and all its content
+		var addDir func(dir *shareDirectory) bool
+		addDir = func(dir *shareDirectory) bool {
+			if !addResult(dir) {
+				return false
 			}
-
 			if req.stype != SearchDirectory {
-				for fname, file := range dir.files {
-					fileAddToResults := dirAddToResults
-					if !fileAddToResults {
-						fileAddToResults = strings.Contains(strings.ToLower(fname), req.query) &&
-							(req.minSize == 0 || file.size > req.minSize) &&
-							(req.maxSize == 0 || file.size < req.maxSize)
-					}
-					if fileAddToResults {
-						results = append(results, file)
+				for _, file := range dir.files {
+					if !addResult(file) {
+						return false
 					}
 				}
 			}
-
-			for sname, sdir := range dir.dirs {
-				scanDir(sname, sdir, dirAddToResults)
+			for _, sdir := range dir.dirs {
+				if !addDir(sdir) {
+					return false
+				}
 			}
+			return true
 		}
 
-		// search file by TTH
-	} else {
-		scanDir = func(dname string, dir *shareDirectory, dirAddToResults bool) {
-			for _, file := range dir.files {
-				if file.tth == req.tth {
-					results = append(results, file)
-				}
+		c.shareIndex.entriesByName(req.query, func(e *shareIndexEntry) bool {
+			if e.dir != nil {
+				return addDir(e.dir)
 			}
-			for sname, sdir := range dir.dirs {
-				scanDir(sname, sdir, false)
+			if req.stype == SearchDirectory ||
+				(req.minSize != 0 && e.file.size <= req.minSize) ||
+				(req.maxSize != 0 && e.file.size >= req.maxSize) {
+				return true
 			}
-		}
-	}
+			return addResult(e.file)
+		})
 
-	// start searching
-	for alias, dir := range c.shareTree {
-		scanDir(alias, dir, false)
-	}
-
-	// Implementations should send a maximum of 5 search results to passive users
-	// and 10 search results to active users
-	if req.isActive {
-		if len(results) > 10 {
-			results = results[:10]
-		}
+		// search file by TTH
 	} else {
-		if len(results) > 5 {
-			results = results[:5]
+		for _, file := range c.shareIndex.filesByTTH(req.tth) {
+			if !addResult(file) {
+				break
+			}
 		}
 	}
 
-	log.Log(c.conf.LogLevel, log.LevelInfo, "[search] req: %+v | sent %d results", req, len(results))
 	return results, nil
 }
 
@@ -117,6 +117,7 @@ func (c *Client) handleAdcSearchIncomingRequest(id adc.SID, req *adc.SearchReque
 		}
 
 		sr := &searchIncomingRequest{
+			peer:     peer,
 			isActive: !peer.IsPassive,
 			stype: func() SearchType {
 				if req.TTH != nil {
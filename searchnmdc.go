@@ -83,6 +83,31 @@ func (c *Client) handleNmdcSearchOutgoingRequest(conf SearchConf) error {
 	return nil
 }
 
+// peerBySearchAuthor returns the author of a search request, if it can be
+// identified. Active requests contain only the author address, therefore
+// the author is found by ip, and only if a single peer uses that ip.
+func (c *Client) peerBySearchAuthor(req *nmdc.Search) *Peer {
+	if req.Address == "" {
+		return c.peerByNick(req.User)
+	}
+
+	host, _, err := net.SplitHostPort(req.Address)
+	if err != nil {
+		return nil
+	}
+
+	var ret *Peer
+	for _, p := range c.peers {
+		if p.IP == host {
+			if ret != nil {
+				return nil
+			}
+			ret = p
+		}
+	}
+	return ret
+}
+
 func (c *Client) handleNmdcSearchIncomingRequest(req *nmdc.Search) {
 	results, err := func() ([]interface{}, error) {
 		// we do not support search by type
@@ -95,6 +120,7 @@ func (c *Client) handleNmdcSearchIncomingRequest(req *nmdc.Search) {
 		}
 
 		sr := &searchIncomingRequest{
+			peer:     c.peerBySearchAuthor(req),
 			isActive: req.Address != "",
 			stype: func() SearchType {
 				switch req.DataType {
@@ -159,7 +185,7 @@ func (c *Client) handleNmdcSearchIncomingRequest(req *nmdc.Search) {
 				return nil
 			}(),
 			From:       c.conf.Nick,
-			FreeSlots:  int(c.uploadSlotAvail),
+			FreeSlots:  int(c.uploadPublicSlotAvail()),
 			TotalSlots: int(c.conf.UploadMaxParallel),
 			HubAddress: fmt.Sprintf("%s:%d", c.hubSolvedIP, c.hubPort),
 		}
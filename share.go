@@ -1,15 +1,14 @@
 package dctk
 
 import (
-	"bytes"
-	"io"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
-	"github.com/dsnet/compress/bzip2"
-
+	"github.com/aler9/dctk/pkg/log"
 	"github.com/aler9/dctk/pkg/tiger"
 )
 
@@ -20,6 +19,9 @@ type shareFile struct {
 	tthl      tiger.Leaves
 	realPath  string
 	aliasPath string
+	// set when the file is provided by a ShareProvider
+	provider     ShareProvider
+	providerPath string
 }
 
 type shareDirectory struct {
@@ -27,6 +29,8 @@ type shareDirectory struct {
 	files     map[string]*shareFile
 	aliasPath string
 	size      uint64
+	// the modification time of the most recent file
+	modTime time.Time
 }
 
 type shareIndexer struct {
@@ -35,16 +39,51 @@ type shareIndexer struct {
 	terminate          chan struct{}
 	indexChan          chan struct{}
 	indexRequested     bool
+	hashDB             *hashDB
+	leaves             *leavesStore
+	watcher            *shareWatcher
+	// aliases whose directory must be scanned entirely
+	rescanRoots map[string]struct{}
+	// directories that must be scanned again, in the format /alias/dir.
+	// Their subdirectories are scanned only if they are new
+	rescanDirs map[string]struct{}
+	// whether the undefined profile of the hub has been reported
+	hubProfileWarned bool
 }
 
 func newshareIndexer(client *Client) error {
 	client.shareIndexer = &shareIndexer{
-		client: client,
+		client:    client,
+		terminate: make(chan struct{}),
 		// must be buffered since it could otherwise cause a deadlock:
 		// - after <-indexChan and before Safe()
-		terminate: make(chan struct{}),
-		indexChan: make(chan struct{}),
+		indexChan:   make(chan struct{}, 1),
+		rescanRoots: make(map[string]struct{}),
+		rescanDirs:  make(map[string]struct{}),
+	}
+
+	if client.conf.HashDBPath != "" {
+		db, err := newHashDB(client.conf.HashDBPath)
+		if err != nil {
+			return err
+		}
+		client.shareIndexer.hashDB = db
+
+		leaves, err := newLeavesStore(client.conf.HashDBPath + ".leaves")
+		if err != nil {
+			return err
+		}
+		client.shareIndexer.leaves = leaves
+	}
+
+	if client.conf.ShareWatch {
+		w, err := newShareWatcher(client)
+		if err != nil {
+			return err
+		}
+		client.shareIndexer.watcher = w
 	}
+
 	client.shareIndexer.index()
 	return nil
 }
@@ -55,11 +94,18 @@ func (sm *shareIndexer) close() {
 	}
 	sm.terminateRequested = true
 	close(sm.terminate)
+	if sm.watcher != nil {
+		sm.watcher.close()
+	}
 }
 
 func (sm *shareIndexer) do() {
 	defer sm.client.wg.Done()
 
+	if sm.hashDB != nil {
+		defer sm.hashDB.close()
+	}
+
 	for {
 		select {
 		case <-sm.terminate:
@@ -71,201 +117,561 @@ func (sm *shareIndexer) do() {
 	}
 }
 
+// schedule starts a new indexing, if it was not already requested.
+func (sm *shareIndexer) schedule() {
+	if !sm.indexRequested {
+		sm.indexRequested = true
+		sm.indexChan <- struct{}{}
+	}
+}
+
+// scanDir scans a directory on disk and returns its content. Hashes of
+// files that were not modified are recovered from oldDir or from the hash
+// database. If recursive is false, the content of subdirectories that
+// exist in oldDir is not scanned again. Files and directories excluded by
+// share rules are skipped.
+func (sm *shareIndexer) scanDir(apath string, dpath string, oldDir *shareDirectory,
+	recursive bool, scan *shareScan) (*shareDirectory, error) {
+	dir := &shareDirectory{
+		dirs:      make(map[string]*shareDirectory),
+		files:     make(map[string]*shareFile),
+		aliasPath: apath,
+	}
+
+	// solve symlinks
+	realDir, err := filepath.EvalSymlinks(dpath)
+	if err != nil {
+		return nil, err
+	}
+	scan.parents[realDir] = struct{}{}
+	defer delete(scan.parents, realDir)
+
+	files, err := ioutil.ReadDir(dpath)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		aliasPath := filepath.Join(apath, file.Name())
+		origPath := filepath.Join(dpath, file.Name())
+		realPath := filepath.Join(realDir, file.Name())
+		finfo := file
+
+		isSymlink := (file.Mode()&os.ModeSymlink != 0)
+		if isSymlink {
+			policy := sm.client.shareSymlinkPolicy(scan.root)
+			if policy == SymlinkSkip {
+				continue
+			}
+
+			// solve symlinks
+			realPath, err = filepath.EvalSymlinks(origPath)
+			if err != nil {
+				log.Log(sm.client.conf.LogLevel, log.LevelDebug, "[share] skipping broken link %s", origPath)
+				continue
+			}
+
+			// get real file info
+			finfo, err = os.Stat(realPath)
+			if err != nil {
+				scan.addError(origPath, err)
+				continue
+			}
+
+			if policy == SymlinkInsideRoot && !pathIsInside(realPath, scan.rootRealPath) {
+				log.Log(sm.client.conf.LogLevel, log.LevelDebug, "[share] skipping link outside share %s", origPath)
+				continue
+			}
+		}
+
+		// skip special files
+		if !finfo.IsDir() && !finfo.Mode().IsRegular() {
+			continue
+		}
+
+		if sm.client.shareExcludes(scan.root, aliasPath, finfo.IsDir(), uint64(finfo.Size())) {
+			continue
+		}
+
+		if finfo.IsDir() {
+			if _, ok := scan.parents[realPath]; ok {
+				log.Log(sm.client.conf.LogLevel, log.LevelDebug, "[share] skipping link to parent directory %s", origPath)
+				continue
+			}
+
+			subOldDir := func() *shareDirectory {
+				if oldDir == nil {
+					return nil
+				}
+				return oldDir.dirs[file.Name()]
+			}()
+
+			subdir := subOldDir
+			if recursive || subOldDir == nil {
+				subdir, err = sm.scanDir(aliasPath, origPath, subOldDir, true, scan)
+				if err != nil {
+					scan.addError(origPath, err)
+					continue
+				}
+			}
+			dir.dirs[file.Name()] = subdir
+
+		} else {
+			fileSize := uint64(finfo.Size())
+			fileModTime := finfo.ModTime()
+			fileIno := fileInode(finfo)
+
+			sfile := &shareFile{
+				size:      fileSize,
+				modTime:   fileModTime,
+				aliasPath: aliasPath,
+				realPath:  realPath,
+			}
+
+			// recover tth if size and mtime are the same
+			if oldDir != nil && oldDir.files[file.Name()] != nil &&
+				fileSize == oldDir.files[file.Name()].size &&
+				fileModTime.Equal(oldDir.files[file.Name()].modTime) {
+				sfile.tth = oldDir.files[file.Name()].tth
+				sfile.tthl = oldDir.files[file.Name()].tthl
+
+				// recover tth from the hash database
+			} else if e, ok := sm.hashDBGet(realPath, fileSize, fileModTime, fileIno); ok {
+				sfile.tth = e.tth
+
+				// hash the file later
+			} else {
+				scan.jobs = append(scan.jobs, &shareHashJob{
+					file:  sfile,
+					inode: fileIno,
+					dir:   dir,
+					name:  file.Name(),
+				})
+			}
+			scan.live[realPath] = struct{}{}
+
+			dir.files[file.Name()] = sfile
+			dir.size += fileSize
+		}
+	}
+
+	dir.updateModTime()
+	return dir, nil
+}
+
+// rescanSubdir scans again the directory of the share with the given path
+// components, relative to dir, and returns a copy of dir that contains the
+// new directory. dir is not modified, since it can be in use by other routines.
+func (sm *shareIndexer) rescanSubdir(dir *shareDirectory, dpath string,
+	components []string, scan *shareScan) (*shareDirectory, error) {
+	if len(components) == 0 {
+		return sm.scanDir(dir.aliasPath, dpath, dir, false, scan)
+	}
+
+	sub, ok := dir.dirs[components[0]]
+	if !ok {
+		// the directory was created after the last scan, and is going
+		// to be scanned together with its parent
+		return dir, nil
+	}
+
+	newSub, err := sm.rescanSubdir(sub, filepath.Join(dpath, components[0]), components[1:], scan)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := *dir
+	ret.dirs = make(map[string]*shareDirectory, len(dir.dirs))
+	for name, d := range dir.dirs {
+		ret.dirs[name] = d
+	}
+	ret.dirs[components[0]] = newSub
+	ret.updateModTime()
+	return &ret, nil
+}
+
+// updateModTime sets the modification time of the directory to the one of
+// the most recent file.
+func (dir *shareDirectory) updateModTime() {
+	dir.modTime = time.Time{}
+	for _, f := range dir.files {
+		if f.modTime.After(dir.modTime) {
+			dir.modTime = f.modTime
+		}
+	}
+	for _, d := range dir.dirs {
+		if d.modTime.After(dir.modTime) {
+			dir.modTime = d.modTime
+		}
+	}
+}
+
+// shareTreeStats returns the number of files and the overall size of a share tree.
+func shareTreeStats(tree map[string]*shareDirectory) (uint, uint64) {
+	count := uint(0)
+	size := uint64(0)
+	var scanDir func(dir *shareDirectory)
+	scanDir = func(dir *shareDirectory) {
+		count += uint(len(dir.files))
+		size += dir.size
+		for _, sdir := range dir.dirs {
+			scanDir(sdir)
+		}
+	}
+	for _, dir := range tree {
+		scanDir(dir)
+	}
+	return count, size
+}
+
 func (sm *shareIndexer) index() {
-	copyRoots := make(map[string]string)
+	copyRoots := make(map[string]shareRoot)
+	var rescanRoots map[string]struct{}
+	var rescanDirs map[string]struct{}
+	profileDefs := make(map[string][]string)
 	sm.client.Safe(func() {
 		sm.indexRequested = false
 
 		// create a copy of shareRoots
 		for k, v := range sm.client.shareRoots {
-			copyRoots[k] = v
+			copyRoots[k] = *v
 		}
+
+		// create a copy of shareProfileDefs
+		for k, v := range sm.client.shareProfileDefs {
+			profileDefs[k] = v
+		}
+
+		rescanRoots = sm.rescanRoots
+		rescanDirs = sm.rescanDirs
+		sm.rescanRoots = make(map[string]struct{})
+		sm.rescanDirs = make(map[string]struct{})
 	})
 
+	scan := &shareScan{
+		live:    make(map[string]struct{}),
+		parents: make(map[string]struct{}),
+	}
+	fullScan := false
+
 	// generate new tree
-	shareTree, shareCount, shareSize := func() (map[string]*shareDirectory, uint, uint64) {
-		tree := make(map[string]*shareDirectory)
-		count := uint(0)
-		size := uint64(0)
-		var scanDir func(apath string, dpath string, oldDir *shareDirectory) (*shareDirectory, error)
-		scanDir = func(apath string, dpath string, oldDir *shareDirectory) (*shareDirectory, error) {
-			dir := &shareDirectory{
-				dirs:      make(map[string]*shareDirectory),
-				files:     make(map[string]*shareFile),
-				aliasPath: apath,
+	shareTree := make(map[string]*shareDirectory)
+	for alias, root := range copyRoots {
+		root := root
+		oldDir, ok := sm.client.shareTree[alias]
+		_, rescan := rescanRoots[alias]
+
+		// list provider entries
+		if root.provider != nil {
+			if ok && !rescan {
+				shareTree[alias] = oldDir
+				continue
 			}
-
-			files, err := ioutil.ReadDir(dpath)
+			rdir, err := sm.scanProvider(alias, &root, scan)
 			if err != nil {
-				return nil, err
+				scan.addError("/"+alias, err)
+				continue
 			}
-			for _, file := range files {
-				if file.IsDir() {
-					subOldDir := func() *shareDirectory {
-						if oldDir == nil {
-							return nil
-						}
-						return oldDir.dirs[file.Name()]
-					}()
-					subdir, err := scanDir(filepath.Join(apath, file.Name()), filepath.Join(dpath, file.Name()), subOldDir)
-					if err != nil {
-						return nil, err
-					}
-					dir.dirs[file.Name()] = subdir
-
-				} else {
-					var tthl tiger.Leaves
-					var tth tiger.Hash
-
-					aliasPath := filepath.Join(apath, file.Name())
-					origPath := filepath.Join(dpath, file.Name())
-
-					// solve symlinks
-					realPath, err := filepath.EvalSymlinks(origPath)
-					if err != nil {
-						return nil, err
-					}
-
-					// get real file info
-					var finfo os.FileInfo
-					finfo, err = os.Stat(realPath)
-					if err != nil {
-						return nil, err
-					}
-
-					fileSize := uint64(finfo.Size())
-					fileModTime := finfo.ModTime()
-
-					// recover tth if size and mtime are the same
-					if oldDir != nil && oldDir.files[file.Name()] != nil &&
-						fileSize == oldDir.files[file.Name()].size &&
-						fileModTime.Equal(oldDir.files[file.Name()].modTime) {
-						tth = oldDir.files[file.Name()].tth
-					} else {
-						var err error
-						tthl, err = tiger.LeavesFromFile(realPath)
-						if err != nil {
-							return nil, err
-						}
-
-						tth = tthl.TreeHash()
-					}
-
-					dir.files[file.Name()] = &shareFile{
-						size:      fileSize,
-						modTime:   fileModTime,
-						tthl:      tthl,
-						tth:       tth,
-						aliasPath: aliasPath,
-						realPath:  realPath,
-					}
-					dir.size += fileSize
-					count++
-					size += fileSize
-				}
-			}
-			return dir, nil
+			shareTree[alias] = rdir
+			continue
 		}
-		for alias, root := range copyRoots {
-			oldDir := func() *shareDirectory {
-				if t, ok := sm.client.shareTree[alias]; ok {
-					return t
-				}
-				return nil
-			}()
-			rdir, err := scanDir("/"+alias, root, oldDir)
+
+		rootRealPath, err := filepath.EvalSymlinks(root.path)
+		if err != nil {
+			scan.addError(root.path, err)
+			continue
+		}
+		scan.root = &root
+		scan.rootRealPath = rootRealPath
+
+		// scan the entire directory
+		if !ok || rescan {
+			rdir, err := sm.scanDir("/"+alias, root.path, oldDir, true, scan)
 			if err != nil {
-				panic(err)
+				scan.addError(root.path, err)
+				continue
 			}
-			tree[alias] = rdir
-		}
-		return tree, count, size
-	}()
-
-	// generate new file list
-	fileList, err := func() ([]byte, error) {
-		fl := &FileList{
-			CID:       sm.client.clientID.String(),
-			Generator: sm.client.conf.ListGenerator,
+			shareTree[alias] = rdir
+			fullScan = true
+			continue
 		}
 
-		var scanDir func(dir *shareDirectory) *FileListDirectory
-		scanDir = func(dir *shareDirectory) *FileListDirectory {
-			fd := &FileListDirectory{}
-			for name, file := range dir.files {
-				fd.Files = append(fd.Files, &FileListFile{
-					Name: name,
-					Size: file.size,
-					TTH:  file.tth,
-				})
+		// scan only the modified directories
+		for dpath := range rescanDirs {
+			components := strings.Split(strings.Trim(dpath, "/"), "/")
+			if components[0] != alias {
+				continue
 			}
-			for name, sdir := range dir.dirs {
-				sfd := scanDir(sdir)
-				sfd.Name = name
-				fd.Dirs = append(fd.Dirs, sfd)
+
+			rdir, err := sm.rescanSubdir(oldDir, root.path, components[1:], scan)
+			if err != nil {
+				// the directory was removed after the change notification
+				log.Log(sm.client.conf.LogLevel, log.LevelDebug, "[share] unable to scan %s: %s", dpath, err)
+				continue
 			}
-			return fd
-		}
-		for alias, dir := range shareTree {
-			fld := scanDir(dir)
-			fld.Name = alias
-			fl.Dirs = append(fl.Dirs, fld)
+			oldDir = rdir
 		}
+		shareTree[alias] = oldDir
+	}
 
-		return fl.Export()
-	}()
-	if err != nil {
-		panic(err)
+	// hash new and modified files. Files that cannot be read are removed
+	if err := sm.hashFiles(shareTree, scan); err != nil {
+		return
 	}
 
-	// compress file list
-	fileList, err = func() ([]byte, error) {
-		var out bytes.Buffer
-		bw, err := bzip2.NewWriter(&out, nil)
-		if err != nil {
-			return nil, err
+	// build lookup tables
+	shareIndex := newShareIndex(shareTree)
+
+	// remove deleted or modified files from the hash database
+	if sm.hashDB != nil && fullScan {
+		if err := sm.hashDB.compact(scan.live); err != nil {
+			log.Log(sm.client.conf.LogLevel, log.LevelError, "[share] unable to compact hash database: %s", err)
+		}
+	}
+
+	// remove leaves of files that are not shared anymore
+	if sm.leaves != nil && fullScan {
+		if err := sm.leaves.prune(shareIndex.byTTH); err != nil {
+			log.Log(sm.client.conf.LogLevel, log.LevelError, "[share] unable to prune leaves: %s", err)
 		}
-		in := bytes.NewReader(fileList)
-		if _, err = io.Copy(bw, in); err != nil {
-			return nil, err
+	}
+
+	// watch the new directories
+	if sm.watcher != nil {
+		rootPaths := make(map[string]string)
+		for alias, root := range copyRoots {
+			if root.provider == nil {
+				rootPaths[alias] = root.path
+			}
 		}
-		bw.Close()
-		return out.Bytes(), nil
-	}()
+		sm.watcher.sync(shareTree, rootPaths)
+	}
+
+	// generate the file lists of profiles
+	shareProfiles, err := sm.buildProfiles(shareTree, profileDefs)
 	if err != nil {
-		panic(err)
+		sm.reportErrors(append(scan.errors, shareIndexError{err: err}))
+		return
 	}
+	hubProfile := shareProfiles[sm.client.conf.ShareProfile]
 
 	sm.client.Safe(func() {
 		// override atomically
 		sm.client.shareTree = shareTree
-		sm.client.fileList = fileList
-		sm.client.shareCount = shareCount
-		sm.client.shareSize = shareSize
+		sm.client.shareIndex = shareIndex
+		sm.client.shareProfiles = shareProfiles
+		sm.client.fileList = hubProfile.fileList
+		sm.client.shareCount = hubProfile.count
+		sm.client.shareSize = hubProfile.size
 
 		// inform hub
 		if !sm.client.hubConn.terminateRequested && sm.client.hubConn.state == hubInitialized {
 			sm.client.sendInfos(false)
 		}
 
+		sm.client.shareReportErrors(scan.errors)
+
 		if sm.client.OnShareIndexed != nil {
 			sm.client.OnShareIndexed()
 		}
 	})
 }
 
+// reportErrors reports errors of an indexing that could not be completed.
+func (sm *shareIndexer) reportErrors(errs []shareIndexError) {
+	sm.client.Safe(func() {
+		sm.client.shareReportErrors(errs)
+	})
+}
+
+func (c *Client) shareReportErrors(errs []shareIndexError) {
+	for _, e := range errs {
+		if e.path != "" {
+			log.Log(c.conf.LogLevel, log.LevelError, "[share] unable to index %s: %s", e.path, e.err)
+		} else {
+			log.Log(c.conf.LogLevel, log.LevelError, "[share] unable to generate file list: %s", e.err)
+		}
+		if c.OnShareIndexError != nil {
+			c.OnShareIndexError(e.path, e.err)
+		}
+	}
+}
+
+func (sm *shareIndexer) hashDBGet(realPath string, size uint64,
+	modTime time.Time, inode uint64) (*hashDBEntry, bool) {
+	if sm.hashDB == nil {
+		return nil, false
+	}
+	return sm.hashDB.get(realPath, size, modTime.UnixNano(), inode)
+}
+
+func (sm *shareIndexer) hashDBPut(realPath string, e *hashDBEntry) {
+	if sm.hashDB == nil {
+		return
+	}
+	if err := sm.hashDB.put(realPath, e); err != nil {
+		log.Log(sm.client.conf.LogLevel, log.LevelError, "[share] unable to write hash database: %s", err)
+	}
+}
+
+// shareDirToFileList converts a share directory into a file list directory.
+// If recursive is false, subdirectories are listed without their content
+// and are marked as incomplete.
+func shareDirToFileList(dir *shareDirectory, name string, recursive bool) *FileListDirectory {
+	fd := &FileListDirectory{
+		Name: name,
+		Date: dir.modTime,
+	}
+	for fname, file := range dir.files {
+		fd.Files = append(fd.Files, &FileListFile{
+			Name: fname,
+			Size: file.size,
+			TTH:  file.tth,
+			TS:   file.modTime,
+		})
+	}
+	for sname, sdir := range dir.dirs {
+		if recursive {
+			fd.Dirs = append(fd.Dirs, shareDirToFileList(sdir, sname, true))
+		} else {
+			fd.Dirs = append(fd.Dirs, &FileListDirectory{
+				Name:       sname,
+				Incomplete: (len(sdir.files) > 0 || len(sdir.dirs) > 0),
+				Date:       sdir.modTime,
+			})
+		}
+	}
+	return fd
+}
+
+// sharePartialList generates a partial file list, that contains the content
+// of the share directory with the given path, as seen by the given profile.
+func (c *Client) sharePartialList(p *shareProfile, dpath string, recursive bool) ([]byte, error) {
+	// the root contains the share aliases
+	dir := &shareDirectory{
+		dirs:  make(map[string]*shareDirectory),
+		files: make(map[string]*shareFile),
+	}
+	for alias, sdir := range c.shareTree {
+		if _, ok := p.roots[alias]; ok {
+			dir.dirs[alias] = sdir
+		}
+	}
+
+	for _, component := range strings.Split(strings.Trim(dpath, "/"), "/") {
+		if component == "" {
+			continue
+		}
+		sdir, ok := dir.dirs[component]
+		if !ok {
+			return nil, fmt.Errorf("directory not found")
+		}
+		dir = sdir
+	}
+
+	fd := shareDirToFileList(dir, "", recursive)
+	fileListSort(fd.Files, fd.Dirs)
+
+	fl := &FileList{
+		CID:       c.clientID.String(),
+		Base:      fileListNormalizeBase(dpath),
+		Generator: c.conf.ListGenerator,
+		Files:     fd.Files,
+		Dirs:      fd.Dirs,
+	}
+	return fl.Export()
+}
+
+// fileLeaves returns the TTH leaves of a shared file, reduced to the configured
+// depth. Leaves are read from memory or from the leaves store, and are computed
+// again if they are missing. It can be called without holding the client mutex.
+func (sm *shareIndexer) fileLeaves(sfile *shareFile) (tiger.Leaves, error) {
+	depth := sm.client.conf.ShareTTHLDepth
+
+	if sfile.tthl != nil {
+		return sfile.tthl.Reduce(depth), nil
+	}
+	if sfile.provider != nil {
+		return nil, fmt.Errorf("tthl is not available")
+	}
+
+	if sm.leaves != nil {
+		// leaves stored with a lower depth cannot be used
+		if tthl, ok := sm.leaves.load(sfile.tth); ok && len(tthl) >= tiger.LeavesCount(sfile.size, depth) {
+			return tthl.Reduce(depth), nil
+		}
+	}
+
+	tthl, err := tiger.LeavesFromFile(sfile.realPath)
+	if err != nil {
+		return nil, err
+	}
+	if tthl.TreeHash() != sfile.tth {
+		return nil, fmt.Errorf("file has been modified since it was indexed")
+	}
+	tthl = tthl.Reduce(depth)
+
+	if sm.leaves != nil {
+		if err := sm.leaves.save(sfile.tth, tthl); err != nil {
+			log.Log(sm.client.conf.LogLevel, log.LevelError, "[share] unable to save leaves: %s", err)
+		}
+	}
+	return tthl, nil
+}
+
+// shareFileByPath returns the shared file with the given path, in the format
+// /alias/dir/name, or nil.
+func (c *Client) shareFileByPath(fpath string) *shareFile {
+	parts := strings.Split(strings.TrimPrefix(fpath, "/"), "/")
+
+	dir, ok := c.shareTree[parts[0]]
+	if !ok || len(parts) < 2 {
+		return nil
+	}
+
+	for _, component := range parts[1 : len(parts)-1] {
+		dir, ok = dir.dirs[component]
+		if !ok {
+			return nil
+		}
+	}
+
+	return dir.files[parts[len(parts)-1]]
+}
+
 // ShareAdd adds a given directory (dpath) to the client share, with the given
 // alias, and starts indexing its subdirectories and files.
 // if a directory with the same alias was added previously, it is replaced with
-// the new one. OnShareIndexed is called when the indexing is finished.
-func (c *Client) ShareAdd(alias string, dpath string) {
-	c.shareRoots[alias] = dpath
+// the new one. OnShareIndexed is called when the indexing is finished, while
+// OnShareIndexError is called for every file or directory that cannot be indexed.
+func (c *Client) ShareAdd(alias string, dpath string) error {
+	return c.ShareAddWithRules(alias, dpath, ShareRules{})
+}
 
-	// always schedule indexing
-	if !c.shareIndexer.indexRequested {
-		c.shareIndexer.indexRequested = true
-		c.shareIndexer.indexChan <- struct{}{}
+// ShareAddWithRules adds a given directory (dpath) to the client share, like
+// ShareAdd(), and excludes the files and directories that do not satisfy
+// the given rules, in addition to the ones in ClientConf.ShareRules.
+func (c *Client) ShareAddWithRules(alias string, dpath string, rules ShareRules) error {
+	if err := rules.validate(); err != nil {
+		return err
+	}
+
+	finfo, err := os.Stat(dpath)
+	if err != nil {
+		return err
 	}
+	if !finfo.IsDir() {
+		return fmt.Errorf("%s is not a directory", dpath)
+	}
+
+	c.shareRoots[alias] = &shareRoot{
+		path:  dpath,
+		rules: rules,
+	}
+	c.shareIndexer.rescanRoots[alias] = struct{}{}
+
+	// always schedule indexing
+	c.shareIndexer.schedule()
+	return nil
 }
 
 // ShareDel removes a directory with the given alias from the client share, and
@@ -278,8 +684,17 @@ func (c *Client) ShareDel(alias string) {
 	delete(c.shareRoots, alias)
 
 	// always schedule indexing
-	if !c.shareIndexer.indexRequested {
-		c.shareIndexer.indexRequested = true
-		c.shareIndexer.indexChan <- struct{}{}
+	c.shareIndexer.schedule()
+}
+
+// ShareRefresh starts scanning again the directory with the given alias, in
+// order to detect files that were added, removed or modified. Only modified
+// files are hashed again. OnShareIndexed is called when the indexing is finished.
+func (c *Client) ShareRefresh(alias string) {
+	if _, ok := c.shareRoots[alias]; !ok {
+		return
 	}
+
+	c.shareIndexer.rescanRoots[alias] = struct{}{}
+	c.shareIndexer.schedule()
 }
@@ -0,0 +1,311 @@
+package dctk
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aler9/dctk/pkg/log"
+	"github.com/aler9/dctk/pkg/tiger"
+)
+
+// interval between two calls to OnShareIndexProgress. It is a variable in
+// order to allow tests to shorten it.
+var shareIndexProgressPeriod = 1 * time.Second
+
+var errShareIndexCanceled = fmt.Errorf("indexing canceled")
+
+// ShareIndexProgress contains the progress of the share indexing. Only files
+// that must be hashed are taken into account.
+type ShareIndexProgress struct {
+	// the number of files that have been hashed
+	FilesDone uint
+	// the number of files that must be hashed
+	FilesTotal uint
+	// the number of bytes that have been hashed
+	BytesDone uint64
+	// the overall size of files that must be hashed
+	BytesTotal uint64
+	// the path of the file that is being hashed, in the format /alias/dir/name
+	Path string
+}
+
+type shareIndexError struct {
+	// the path on disk of the faulty file or directory. It is empty when
+	// the error is not related to a specific path
+	path string
+	err  error
+}
+
+// shareScan contains the results of a share scan.
+type shareScan struct {
+	// real paths of indexed files
+	live map[string]struct{}
+	// files that must be hashed
+	jobs []*shareHashJob
+	// files and directories that could not be indexed
+	errors []shareIndexError
+	// the root that is being scanned, and its real path
+	root         *shareRoot
+	rootRealPath string
+	// real paths of the directories that are being scanned, used to detect
+	// symbolic links that point to a parent directory
+	parents map[string]struct{}
+}
+
+func (scan *shareScan) addError(fpath string, err error) {
+	scan.errors = append(scan.errors, shareIndexError{path: fpath, err: err})
+}
+
+type shareHashJob struct {
+	file  *shareFile
+	inode uint64
+	// the directory that contains the file
+	dir  *shareDirectory
+	name string
+	err  error
+}
+
+// rateLimiter limits the speed of one or more readers.
+type rateLimiter struct {
+	mutex sync.Mutex
+	rate  uint
+	next  time.Time
+}
+
+// wait waits until n bytes can be read, or until terminate is closed.
+func (l *rateLimiter) wait(n int, terminate chan struct{}) error {
+	l.mutex.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(n) * time.Second / time.Duration(l.rate))
+	l.mutex.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-terminate:
+		return errShareIndexCanceled
+	}
+}
+
+// shareHashReader counts the bytes read from a file, limits the read speed
+// and stops reading when indexing is canceled.
+type shareHashReader struct {
+	r         io.Reader
+	limiter   *rateLimiter
+	terminate chan struct{}
+	count     *uint64
+}
+
+func (r *shareHashReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.terminate:
+		return 0, errShareIndexCanceled
+	default:
+	}
+
+	n, err := r.r.Read(p)
+	atomic.AddUint64(r.count, uint64(n))
+
+	if r.limiter != nil && n > 0 {
+		if err := r.limiter.wait(n, r.terminate); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// hashFiles computes the TTH of files in parallel, with a speed limit,
+// and calls OnShareIndexProgress periodically. Files that cannot be read
+// are removed from their directory, and the modification time of the
+// directory and of its ancestors in tree is computed again. An error is
+// returned only if the indexing is canceled.
+func (sm *shareIndexer) hashFiles(tree map[string]*shareDirectory, scan *shareScan) error {
+	jobs := scan.jobs
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	progress := ShareIndexProgress{FilesTotal: uint(len(jobs))}
+	for _, job := range jobs {
+		progress.BytesTotal += job.file.size
+	}
+
+	var limiter *rateLimiter
+	if sm.client.conf.ShareHashMaxSpeed > 0 {
+		limiter = &rateLimiter{rate: sm.client.conf.ShareHashMaxSpeed}
+	}
+
+	var bytesDone uint64
+	var curPath atomic.Value
+	curPath.Store("")
+
+	jobChan := make(chan *shareHashJob)
+	doneChan := make(chan *shareHashJob)
+
+	// stop workers when indexing is canceled
+	terminate := sm.terminate
+
+	var wg sync.WaitGroup
+	for i := uint(0); i < sm.client.conf.ShareHashWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobChan {
+				curPath.Store(job.file.aliasPath)
+				job.err = func() error {
+					f, err := os.Open(job.file.realPath)
+					if err != nil {
+						return err
+					}
+					defer f.Close()
+
+					// buffer to optimize disk read
+					r := bufio.NewReaderSize(&shareHashReader{
+						r:         f,
+						limiter:   limiter,
+						terminate: terminate,
+						count:     &bytesDone,
+					}, 1024*1024)
+
+					tthl, err := tiger.LeavesFromReader(r)
+					if err != nil {
+						return err
+					}
+
+					job.file.tth = tthl.TreeHash()
+					tthl = tthl.Reduce(sm.client.conf.ShareTTHLDepth)
+
+					// keep leaves in memory only if they cannot be stored
+					if sm.leaves != nil {
+						err := sm.leaves.save(job.file.tth, tthl)
+						if err == nil {
+							return nil
+						}
+						log.Log(sm.client.conf.LogLevel, log.LevelError, "[share] unable to save leaves: %s", err)
+					}
+					job.file.tthl = tthl
+					return nil
+				}()
+				doneChan <- job
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobChan)
+		for _, job := range jobs {
+			select {
+			case jobChan <- job:
+			case <-terminate:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(doneChan)
+	}()
+
+	sendProgress := func() {
+		progress.BytesDone = atomic.LoadUint64(&bytesDone)
+		progress.Path = curPath.Load().(string)
+		sm.client.Safe(func() {
+			if sm.client.OnShareIndexProgress != nil {
+				sm.client.OnShareIndexProgress(progress)
+			}
+		})
+	}
+
+	sendProgress()
+
+	ticker := time.NewTicker(shareIndexProgressPeriod)
+	defer ticker.Stop()
+
+	canceled := false
+	for done := false; !done; {
+		select {
+		case job, ok := <-doneChan:
+			if !ok {
+				done = true
+				break
+			}
+
+			if job.err == errShareIndexCanceled {
+				canceled = true
+				continue
+			}
+
+			progress.FilesDone++
+
+			if job.err != nil {
+				scan.addError(job.file.realPath, job.err)
+				delete(job.dir.files, job.name)
+				job.dir.size -= job.file.size
+				shareTreeUpdateModTime(tree, job.dir.aliasPath)
+				delete(scan.live, job.file.realPath)
+				continue
+			}
+
+			sm.hashDBPut(job.file.realPath, &hashDBEntry{
+				size:    job.file.size,
+				modTime: job.file.modTime.UnixNano(),
+				inode:   job.inode,
+				tth:     job.file.tth,
+			})
+
+		case <-ticker.C:
+			if !canceled {
+				sendProgress()
+			}
+		}
+	}
+
+	// indexing was canceled before all files were hashed
+	if canceled || progress.FilesDone < progress.FilesTotal {
+		return errShareIndexCanceled
+	}
+
+	sendProgress()
+	return nil
+}
+
+// shareTreeUpdateModTime computes again the modification time of the
+// directory with the given path, in the format /alias/dir, and of its
+// ancestors. Directories in the path must not be in use by other routines.
+func shareTreeUpdateModTime(tree map[string]*shareDirectory, dpath string) {
+	parts := strings.Split(strings.TrimPrefix(dpath, "/"), "/")
+
+	dir, ok := tree[parts[0]]
+	if !ok {
+		return
+	}
+	chain := []*shareDirectory{dir}
+	for _, component := range parts[1:] {
+		dir, ok = dir.dirs[component]
+		if !ok {
+			return
+		}
+		chain = append(chain, dir)
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		chain[i].updateModTime()
+	}
+}
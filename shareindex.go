@@ -0,0 +1,113 @@
+package dctk
+
+import (
+	"strings"
+
+	"github.com/aler9/dctk/pkg/tiger"
+)
+
+// names are indexed by trigrams, that allow to find names that contain a
+// given substring without scanning the entire share.
+const shareIndexTokenLen = 3
+
+type shareIndexEntry struct {
+	// lowercase name
+	name string
+	// either dir or file is set
+	dir  *shareDirectory
+	file *shareFile
+}
+
+// shareIndex contains the lookup tables of a share tree. It is built by
+// the indexer together with the tree and is never modified afterwards.
+type shareIndex struct {
+	byTTH   map[tiger.Hash][]*shareFile
+	entries []shareIndexEntry
+	// indexes of entries, indexed by token
+	tokens map[string][]uint32
+}
+
+func newShareIndex(tree map[string]*shareDirectory) *shareIndex {
+	idx := &shareIndex{
+		byTTH:  make(map[tiger.Hash][]*shareFile),
+		tokens: make(map[string][]uint32),
+	}
+
+	var scanDir func(dname string, dir *shareDirectory)
+	scanDir = func(dname string, dir *shareDirectory) {
+		idx.add(shareIndexEntry{name: dname, dir: dir})
+		for fname, file := range dir.files {
+			idx.byTTH[file.tth] = append(idx.byTTH[file.tth], file)
+			idx.add(shareIndexEntry{name: fname, file: file})
+		}
+		for sname, sdir := range dir.dirs {
+			scanDir(sname, sdir)
+		}
+	}
+	for alias, dir := range tree {
+		scanDir(alias, dir)
+	}
+
+	return idx
+}
+
+// shareIndexTokens returns the distinct tokens of a lowercase string.
+func shareIndexTokens(s string) []string {
+	runes := []rune(s)
+	if len(runes) < shareIndexTokenLen {
+		return nil
+	}
+
+	var ret []string
+	seen := make(map[string]struct{})
+	for i := 0; i+shareIndexTokenLen <= len(runes); i++ {
+		token := string(runes[i : i+shareIndexTokenLen])
+		if _, ok := seen[token]; ok {
+			continue
+		}
+		seen[token] = struct{}{}
+		ret = append(ret, token)
+	}
+	return ret
+}
+
+func (idx *shareIndex) add(e shareIndexEntry) {
+	e.name = strings.ToLower(e.name)
+	id := uint32(len(idx.entries))
+	idx.entries = append(idx.entries, e)
+	for _, token := range shareIndexTokens(e.name) {
+		idx.tokens[token] = append(idx.tokens[token], id)
+	}
+}
+
+// filesByTTH returns the files with the given TTH.
+func (idx *shareIndex) filesByTTH(tth tiger.Hash) []*shareFile {
+	return idx.byTTH[tth]
+}
+
+// entriesByName calls cb for each entry whose name contains the given
+// lowercase query, until cb returns false. The query must contain at least
+// shareIndexTokenLen characters.
+func (idx *shareIndex) entriesByName(query string, cb func(e *shareIndexEntry) bool) {
+	// pick the token with the fewest entries
+	var candidates []uint32
+	for i, token := range shareIndexTokens(query) {
+		ids, ok := idx.tokens[token]
+		if !ok {
+			return
+		}
+		if i == 0 || len(ids) < len(candidates) {
+			candidates = ids
+		}
+	}
+
+	for _, id := range candidates {
+		e := &idx.entries[id]
+		if !strings.Contains(e.name, query) {
+			continue
+		}
+		if !cb(e) {
+			return
+		}
+	}
+}
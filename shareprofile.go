@@ -0,0 +1,201 @@
+package dctk
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"github.com/dsnet/compress/bzip2"
+
+	"github.com/aler9/dctk/pkg/log"
+	"github.com/aler9/dctk/pkg/tiger"
+)
+
+// shareProfile contains the shared directories that are visible to a group
+// of peers, and their file list.
+type shareProfile struct {
+	// aliases of the visible directories
+	roots map[string]struct{}
+	// compressed file list
+	fileList []byte
+	count    uint
+	size     uint64
+}
+
+// visible returns whether a file or directory with the given path, in the
+// format /alias/dir/name, is visible in the profile.
+func (p *shareProfile) visible(apath string) bool {
+	alias := strings.SplitN(strings.TrimPrefix(apath, "/"), "/", 2)[0]
+	_, ok := p.roots[alias]
+	return ok
+}
+
+// ShareProfileSet defines a share profile, i.e. a named set of shared
+// directories (identified by their alias) with its own file list. Peers see
+// only the directories of their profile in file lists and search results,
+// and can download only files inside them. The profile of a peer is chosen
+// with ClientConf.ShareProfile and ClientConf.SharePeerProfile.
+// The profile with empty name contains all shared directories, unless it is
+// defined explicitly.
+func (c *Client) ShareProfileSet(name string, aliases []string) {
+	c.shareProfileDefs[name] = append([]string(nil), aliases...)
+
+	// always schedule indexing, in order to generate the file list
+	c.shareIndexer.schedule()
+}
+
+// ShareProfileDel removes a share profile defined with ShareProfileSet().
+func (c *Client) ShareProfileDel(name string) {
+	if _, ok := c.shareProfileDefs[name]; !ok {
+		return
+	}
+
+	delete(c.shareProfileDefs, name)
+
+	// always schedule indexing
+	c.shareIndexer.schedule()
+}
+
+// shareProfileFor returns the profile of a peer. If the peer is nil or its
+// profile is not defined, the profile of the hub is returned.
+func (c *Client) shareProfileFor(peer *Peer) *shareProfile {
+	if peer != nil && c.conf.SharePeerProfile != nil {
+		if name := c.conf.SharePeerProfile(peer); name != "" {
+			if p, ok := c.shareProfiles[name]; ok {
+				return p
+			}
+
+			// profiles that are defined but not indexed yet are not reported
+			if _, ok := c.shareProfileDefs[name]; !ok {
+				if _, ok := c.shareProfileWarned[name]; !ok {
+					c.shareProfileWarned[name] = struct{}{}
+					log.Log(c.conf.LogLevel, log.LevelError,
+						"[share] profile '%s' of peer %s is not defined, using the profile of the hub",
+						name, peer.Nick)
+				}
+			}
+		}
+	}
+
+	if p, ok := c.shareProfiles[c.conf.ShareProfile]; ok {
+		return p
+	}
+
+	// the share has not been indexed yet
+	return &shareProfile{}
+}
+
+// shareVisibleFileByTTH returns a file with the given TTH that is visible in
+// the given profile, or nil.
+func (c *Client) shareVisibleFileByTTH(p *shareProfile, tth tiger.Hash) *shareFile {
+	for _, sfile := range c.shareIndex.filesByTTH(tth) {
+		if p.visible(sfile.aliasPath) {
+			return sfile
+		}
+	}
+	return nil
+}
+
+// buildProfiles generates the file lists of the given profile definitions.
+// The profile with empty name and the profile of the hub are always generated.
+// If the profile of the hub is not defined, the profile with empty name is
+// used in its place.
+func (sm *shareIndexer) buildProfiles(tree map[string]*shareDirectory,
+	defs map[string][]string) (map[string]*shareProfile, error) {
+	hubProfile := sm.client.conf.ShareProfile
+	if _, ok := defs[hubProfile]; !ok && hubProfile != "" {
+		if !sm.hubProfileWarned {
+			sm.hubProfileWarned = true
+			log.Log(sm.client.conf.LogLevel, log.LevelError,
+				"[share] profile '%s' of the hub is not defined, using the profile with empty name",
+				hubProfile)
+		}
+		hubProfile = ""
+	}
+
+	names := map[string]struct{}{
+		"": {},
+	}
+	for name := range defs {
+		names[name] = struct{}{}
+	}
+
+	ret := make(map[string]*shareProfile)
+	for name := range names {
+		p := &shareProfile{
+			roots: make(map[string]struct{}),
+		}
+
+		// the profile with empty name contains all directories by default
+		aliases, ok := defs[name]
+		if !ok && name == "" {
+			for alias := range tree {
+				aliases = append(aliases, alias)
+			}
+		}
+
+		subtree := make(map[string]*shareDirectory)
+		for _, alias := range aliases {
+			if dir, ok := tree[alias]; ok {
+				p.roots[alias] = struct{}{}
+				subtree[alias] = dir
+			}
+		}
+		p.count, p.size = shareTreeStats(subtree)
+
+		// profiles with the same directories share the same file list
+		for _, other := range ret {
+			if shareProfileSameRoots(p, other) {
+				p.fileList = other.fileList
+				break
+			}
+		}
+
+		if p.fileList == nil {
+			var err error
+			p.fileList, err = sm.generateFileList(subtree)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		ret[name] = p
+	}
+
+	ret[sm.client.conf.ShareProfile] = ret[hubProfile]
+	return ret, nil
+}
+
+func shareProfileSameRoots(a *shareProfile, b *shareProfile) bool {
+	if len(a.roots) != len(b.roots) {
+		return false
+	}
+	for alias := range a.roots {
+		if _, ok := b.roots[alias]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// generateFileList generates the compressed file list of a share tree.
+func (sm *shareIndexer) generateFileList(tree map[string]*shareDirectory) ([]byte, error) {
+	content, err := sm.client.shareFileList(tree).Export()
+	if err != nil {
+		return nil, err
+	}
+
+	// compress file list
+	var out bytes.Buffer
+	bw, err := bzip2.NewWriter(&out, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(bw, bytes.NewReader(content)); err != nil {
+		return nil, err
+	}
+	if err := bw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
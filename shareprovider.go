@@ -0,0 +1,201 @@
+package dctk
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aler9/dctk/pkg/tiger"
+)
+
+// ShareProviderEntry is a file exposed by a ShareProvider.
+type ShareProviderEntry struct {
+	// the path of the file, relative to the provider, in the format dir/name
+	Path string
+	// the size of the file, in bytes
+	Size uint64
+	// the TTH of the file
+	TTH tiger.Hash
+	// (optional) the leaves of the TTH tree. If not provided, peers
+	// are not able to download the tthl of the file. They must contain at
+	// least the leaves required by ClientConf.ShareTTHLDepth
+	TTHL tiger.Leaves
+	// (optional) the modification time of the file
+	ModTime time.Time
+}
+
+// ShareProvider allows to share content that is not stored in the filesystem,
+// i.e. generated content, files inside archives or objects of a blob store.
+// Entries are listed every time the share is indexed, and are never hashed,
+// since their TTH is provided.
+type ShareProvider interface {
+	// Entries returns the files of the provider.
+	Entries() ([]ShareProviderEntry, error)
+	// Open opens the file with the given path, in the format dir/name. If the
+	// returned reader implements io.Closer, it is closed when the upload ends.
+	Open(fpath string) (io.ReaderAt, error)
+}
+
+// ShareAddProvider adds the entries of a ShareProvider to the client share,
+// with the given alias, and starts indexing the share. Entries are filtered
+// with ClientConf.ShareRules.
+// if a directory or provider with the same alias was added previously, it is
+// replaced with the new one. Call ShareRefresh() to list the entries again.
+func (c *Client) ShareAddProvider(alias string, provider ShareProvider) error {
+	if provider == nil {
+		return fmt.Errorf("provider is nil")
+	}
+
+	c.shareRoots[alias] = &shareRoot{
+		provider: provider,
+	}
+	c.shareIndexer.rescanRoots[alias] = struct{}{}
+
+	// always schedule indexing
+	c.shareIndexer.schedule()
+	return nil
+}
+
+// scanProvider builds the directory tree of a provider. Entries are filtered
+// with the global share rules.
+func (sm *shareIndexer) scanProvider(alias string, root *shareRoot,
+	scan *shareScan) (*shareDirectory, error) {
+	provider := root.provider
+	entries, err := provider.Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	newDir := func(apath string) *shareDirectory {
+		return &shareDirectory{
+			dirs:      make(map[string]*shareDirectory),
+			files:     make(map[string]*shareFile),
+			aliasPath: apath,
+		}
+	}
+	rdir := newDir("/" + alias)
+
+	// entries inside an excluded directory are excluded too
+	excludes := func(parts []string, size uint64) bool {
+		apath := rdir.aliasPath
+		for i, component := range parts {
+			apath = path.Join(apath, component)
+			isDir := (i < len(parts)-1)
+			if sm.client.shareExcludes(root, apath, isDir, size) {
+				return true
+			}
+		}
+		return false
+	}
+
+outer:
+	for _, e := range entries {
+		ppath := path.Clean(strings.TrimPrefix(e.Path, "/"))
+		if ppath == "." || ppath == ".." || strings.HasPrefix(ppath, "../") {
+			scan.addError("/"+alias+"/"+e.Path, fmt.Errorf("invalid path"))
+			continue
+		}
+
+		parts := strings.Split(ppath, "/")
+		if excludes(parts, e.Size) {
+			continue
+		}
+
+		var tthl tiger.Leaves
+		if len(e.TTHL) > 0 {
+			if e.TTHL.TreeHash() != e.TTH {
+				scan.addError("/"+alias+"/"+ppath, fmt.Errorf("tthl does not match tth"))
+				continue
+			}
+
+			// leaves with a lower depth cannot be served
+			count := tiger.LeavesCount(e.Size, sm.client.conf.ShareTTHLDepth)
+			if len(e.TTHL) < count {
+				scan.addError("/"+alias+"/"+ppath, fmt.Errorf("tthl contains %d leaves instead of %d", len(e.TTHL), count))
+				continue
+			}
+			tthl = e.TTHL.Reduce(sm.client.conf.ShareTTHLDepth)
+		}
+
+		dir := rdir
+		for _, component := range parts[:len(parts)-1] {
+			if _, ok := dir.files[component]; ok {
+				scan.addError(path.Join("/"+alias, ppath), fmt.Errorf("a file with the same path of a parent directory exists"))
+				continue outer
+			}
+
+			sub, ok := dir.dirs[component]
+			if !ok {
+				sub = newDir(path.Join(dir.aliasPath, component))
+				dir.dirs[component] = sub
+			}
+			dir = sub
+		}
+
+		name := parts[len(parts)-1]
+		if _, ok := dir.dirs[name]; ok {
+			scan.addError(path.Join("/"+alias, ppath), fmt.Errorf("a directory with the same path exists"))
+			continue
+		}
+		if old, ok := dir.files[name]; ok {
+			dir.size -= old.size
+		}
+
+		dir.files[name] = &shareFile{
+			size:         e.Size,
+			modTime:      e.ModTime,
+			tth:          e.TTH,
+			tthl:         tthl,
+			aliasPath:    path.Join(dir.aliasPath, name),
+			provider:     provider,
+			providerPath: ppath,
+		}
+		dir.size += e.Size
+	}
+
+	var updateModTime func(dir *shareDirectory)
+	updateModTime = func(dir *shareDirectory) {
+		for _, sub := range dir.dirs {
+			updateModTime(sub)
+		}
+		dir.updateModTime()
+	}
+	updateModTime(rdir)
+
+	return rdir, nil
+}
+
+// open opens a shared file, starting from the given offset.
+func (f *shareFile) open(start uint64) (io.ReadCloser, error) {
+	if f.provider == nil {
+		fh, err := os.Open(f.realPath)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = fh.Seek(int64(start), io.SeekStart)
+		if err != nil {
+			fh.Close()
+			return nil, err
+		}
+		return fh, nil
+	}
+
+	ra, err := f.provider.Open(f.providerPath)
+	if err != nil {
+		return nil, err
+	}
+
+	r := io.NewSectionReader(ra, int64(start), int64(f.size-start))
+	if c, ok := ra.(io.Closer); ok {
+		return struct {
+			io.Reader
+			io.Closer
+		}{r, c}, nil
+	}
+	return ioutil.NopCloser(r), nil
+}
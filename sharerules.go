@@ -0,0 +1,111 @@
+package dctk
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// SymlinkPolicy contains the options regarding symbolic links inside the share.
+type SymlinkPolicy int
+
+const (
+	// SymlinkFollow shares the files and directories pointed by symbolic links.
+	// Links that point to one of their parent directories are skipped
+	SymlinkFollow SymlinkPolicy = iota
+	// SymlinkInsideRoot follows symbolic links only if they point to a file or
+	// directory inside the shared directory
+	SymlinkInsideRoot
+	// SymlinkSkip does not share symbolic links
+	SymlinkSkip
+)
+
+// ShareRules allows to exclude files and directories from the share.
+type ShareRules struct {
+	// glob patterns (see path.Match) matched against the names of files
+	// and directories that must not be shared, i.e. "*.tmp"
+	ExcludeGlobs []string
+	// regular expressions matched against the paths of files and directories
+	// that must not be shared, in the format /alias/dir/name
+	ExcludeRegexps []*regexp.Regexp
+	// the minimum size of a shared file, in bytes. Set it to 1 to skip empty files
+	MinSize uint64
+	// the maximum size of a shared file, in bytes. If zero, there is no limit
+	MaxSize uint64
+	// do not share files and directories whose name starts with a dot
+	SkipHidden bool
+	// the policy regarding symbolic links. See SymlinkPolicy for options
+	Symlinks SymlinkPolicy
+}
+
+func (r *ShareRules) validate() error {
+	for _, pattern := range r.ExcludeGlobs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid glob pattern: %s", pattern)
+		}
+	}
+	return nil
+}
+
+// excludes returns whether a file or directory is excluded by the rules.
+func (r *ShareRules) excludes(apath string, isDir bool, size uint64) bool {
+	name := path.Base(apath)
+
+	if r.SkipHidden && strings.HasPrefix(name, ".") {
+		return true
+	}
+
+	for _, pattern := range r.ExcludeGlobs {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	for _, re := range r.ExcludeRegexps {
+		if re.MatchString(apath) {
+			return true
+		}
+	}
+
+	if !isDir {
+		if size < r.MinSize {
+			return true
+		}
+		if r.MaxSize != 0 && size > r.MaxSize {
+			return true
+		}
+	}
+
+	return false
+}
+
+// shareRoot is a directory or provider added to the share.
+type shareRoot struct {
+	path     string
+	rules    ShareRules
+	provider ShareProvider
+}
+
+// shareExcludes returns whether a file or directory is excluded by the
+// global rules or by the rules of its root.
+func (c *Client) shareExcludes(root *shareRoot, apath string, isDir bool, size uint64) bool {
+	return c.conf.ShareRules.excludes(apath, isDir, size) ||
+		root.rules.excludes(apath, isDir, size)
+}
+
+// shareSymlinkPolicy returns the strictest policy between the global one
+// and the one of the root.
+func (c *Client) shareSymlinkPolicy(root *shareRoot) SymlinkPolicy {
+	if root.rules.Symlinks > c.conf.ShareRules.Symlinks {
+		return root.rules.Symlinks
+	}
+	return c.conf.ShareRules.Symlinks
+}
+
+// pathIsInside returns whether fpath is equal to dpath or is inside it.
+func pathIsInside(fpath string, dpath string) bool {
+	rel, err := filepath.Rel(dpath, fpath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
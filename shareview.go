@@ -0,0 +1,167 @@
+package dctk
+
+import (
+	"sort"
+	"time"
+
+	"github.com/aler9/dctk/pkg/tiger"
+)
+
+// ShareFile is a read-only view of a shared file.
+type ShareFile struct {
+	// the path of the file inside the share, in the format /alias/dir/name
+	Path string
+	// the path of the file on disk (empty for entries of a ShareProvider)
+	RealPath string
+	Size     uint64
+	ModTime  time.Time
+	TTH      tiger.Hash
+}
+
+// ShareDirectory is a read-only view of a shared directory.
+type ShareDirectory struct {
+	Name string
+	// the path of the directory inside the share, in the format /alias/dir
+	Path string
+	// the overall size of files, subdirectories included
+	Size uint64
+	// the modification time of the most recent file
+	ModTime time.Time
+	// files sorted by name
+	Files []*ShareFile
+	// subdirectories sorted by name
+	Dirs []*ShareDirectory
+}
+
+func newShareFileView(f *shareFile) *ShareFile {
+	return &ShareFile{
+		Path:     f.aliasPath,
+		RealPath: f.realPath,
+		Size:     f.size,
+		ModTime:  f.modTime,
+		TTH:      f.tth,
+	}
+}
+
+func newShareDirectoryView(dir *shareDirectory, name string) *ShareDirectory {
+	ret := &ShareDirectory{
+		Name:    name,
+		Path:    dir.aliasPath,
+		Size:    dir.size,
+		ModTime: dir.modTime,
+	}
+
+	for _, file := range dir.files {
+		ret.Files = append(ret.Files, newShareFileView(file))
+	}
+	sort.Slice(ret.Files, func(i, j int) bool {
+		return ret.Files[i].Path < ret.Files[j].Path
+	})
+
+	for sname, sdir := range dir.dirs {
+		sub := newShareDirectoryView(sdir, sname)
+		ret.Size += sub.Size
+		ret.Dirs = append(ret.Dirs, sub)
+	}
+	sortShareDirectories(ret.Dirs)
+
+	return ret
+}
+
+func sortShareDirectories(dirs []*ShareDirectory) {
+	sort.Slice(dirs, func(i, j int) bool {
+		return dirs[i].Name < dirs[j].Name
+	})
+}
+
+// ShareTree returns a snapshot of the share, i.e. the shared directories
+// sorted by alias, with their content. Profiles are not taken into account.
+// The snapshot is not updated when the share is indexed again.
+func (c *Client) ShareTree() []*ShareDirectory {
+	var ret []*ShareDirectory
+	for alias, dir := range c.shareTree {
+		ret = append(ret, newShareDirectoryView(dir, alias))
+	}
+	sortShareDirectories(ret)
+	return ret
+}
+
+// ShareLookup returns the shared files with the given TTH, sorted by path.
+// The result is empty if the TTH is not shared.
+func (c *Client) ShareLookup(tth tiger.Hash) []*ShareFile {
+	var ret []*ShareFile
+	for _, file := range c.shareIndex.filesByTTH(tth) {
+		ret = append(ret, newShareFileView(file))
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Path < ret[j].Path
+	})
+	return ret
+}
+
+// ShareSearch searches the share for files and directories, with the same
+// rules used to reply to search requests of other peers, except that the
+// number of results is not limited and profiles are not taken into account.
+// Results are sorted by path; Peer is nil.
+func (c *Client) ShareSearch(conf SearchConf) ([]*SearchResult, error) {
+	results, err := c.shareSearch(&searchIncomingRequest{
+		stype:   conf.Type,
+		minSize: conf.MinSize,
+		maxSize: conf.MaxSize,
+		query:   conf.Query,
+		tth:     conf.TTH,
+	}, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*SearchResult, len(results))
+	for i, res := range results {
+		switch o := res.(type) {
+		case *shareFile:
+			tth := o.tth
+			ret[i] = &SearchResult{
+				Path: o.aliasPath,
+				Size: o.size,
+				TTH:  &tth,
+			}
+
+		case *shareDirectory:
+			ret[i] = &SearchResult{
+				Path:  o.aliasPath,
+				IsDir: true,
+				Size:  o.size,
+			}
+		}
+		ret[i].SlotAvail = c.uploadPublicSlotAvail()
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Path < ret[j].Path
+	})
+	return ret, nil
+}
+
+// OwnFileList returns the file list that is sent to peers with the share
+// profile of the hub, as it was generated after the last indexing.
+func (c *Client) OwnFileList() *FileList {
+	tree := make(map[string]*shareDirectory)
+	for alias := range c.shareProfileFor(nil).roots {
+		tree[alias] = c.shareTree[alias]
+	}
+	return c.shareFileList(tree)
+}
+
+// shareFileList generates the file list of a share tree.
+func (c *Client) shareFileList(tree map[string]*shareDirectory) *FileList {
+	fl := &FileList{
+		CID:       c.clientID.String(),
+		Generator: c.conf.ListGenerator,
+	}
+
+	for alias, dir := range tree {
+		fl.Dirs = append(fl.Dirs, shareDirToFileList(dir, alias, true))
+	}
+	fileListSort(fl.Files, fl.Dirs)
+	return fl
+}
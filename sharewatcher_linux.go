@@ -0,0 +1,210 @@
+package dctk
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/aler9/dctk/pkg/log"
+)
+
+const (
+	// the share is indexed again when no changes happen for this period
+	shareWatchDebounce = 2 * time.Second
+	// or when changes have been pending for this period
+	shareWatchMaxDelay = 30 * time.Second
+
+	shareWatchMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB |
+		syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+)
+
+// shareWatcher watches the directories of the share through inotify, and
+// schedules the indexing of the directories that changed.
+type shareWatcher struct {
+	client *Client
+	f      *os.File
+	fd     int
+
+	mutex  sync.Mutex
+	closed bool
+	// watch descriptors and alias paths, indexed by real path
+	watches map[string]int32
+	// alias paths, indexed by watch descriptor
+	paths map[int32]string
+}
+
+func newShareWatcher(client *Client) (*shareWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	return &shareWatcher{
+		client: client,
+		// a non-blocking file can be closed while a read is in progress
+		f:       os.NewFile(uintptr(fd), "inotify"),
+		fd:      fd,
+		watches: make(map[string]int32),
+		paths:   make(map[int32]string),
+	}, nil
+}
+
+func (w *shareWatcher) close() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.closed = true
+	w.f.Close()
+}
+
+// sync adds watches for the directories of the share tree, and removes
+// watches of directories that are not shared anymore.
+func (w *shareWatcher) sync(tree map[string]*shareDirectory, roots map[string]string) {
+	wanted := make(map[string]string)
+	var scanDir func(dir *shareDirectory, dpath string)
+	scanDir = func(dir *shareDirectory, dpath string) {
+		wanted[dpath] = dir.aliasPath
+		for name, sdir := range dir.dirs {
+			scanDir(sdir, filepath.Join(dpath, name))
+		}
+	}
+	for alias, dir := range tree {
+		// providers are not watched
+		if dpath, ok := roots[alias]; ok {
+			scanDir(dir, dpath)
+		}
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return
+	}
+
+	for dpath, wd := range w.watches {
+		if _, ok := wanted[dpath]; !ok {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.watches, dpath)
+			delete(w.paths, wd)
+		}
+	}
+
+	for dpath, apath := range wanted {
+		if wd, ok := w.watches[dpath]; ok {
+			w.paths[wd] = apath
+			continue
+		}
+
+		wd, err := syscall.InotifyAddWatch(w.fd, dpath, shareWatchMask)
+		if err != nil {
+			log.Log(w.client.conf.LogLevel, log.LevelError, "[share] unable to watch %s: %s", dpath, err)
+			continue
+		}
+		w.watches[dpath] = int32(wd)
+		w.paths[int32(wd)] = apath
+	}
+}
+
+func (w *shareWatcher) do() {
+	defer w.client.wg.Done()
+
+	changed := make(chan string)
+	readDone := make(chan struct{})
+	go w.read(changed, readDone)
+
+	pending := make(map[string]struct{})
+	var firstChange time.Time
+	timer := time.NewTimer(0)
+	if !timer.Stop() {
+		<-timer.C
+	}
+
+	for {
+		select {
+		case apath := <-changed:
+			if len(pending) == 0 {
+				firstChange = time.Now()
+			} else if !timer.Stop() {
+				<-timer.C
+			}
+			pending[apath] = struct{}{}
+
+			// wait until changes stop, but not more than shareWatchMaxDelay
+			delay := shareWatchDebounce
+			if remaining := shareWatchMaxDelay - time.Since(firstChange); remaining < delay {
+				delay = remaining
+			}
+			timer.Reset(delay)
+
+		case <-timer.C:
+			w.client.Safe(func() {
+				if w.client.shareIndexer.terminateRequested {
+					return
+				}
+				for apath := range pending {
+					log.Log(w.client.conf.LogLevel, log.LevelDebug, "[share] %s changed", apath)
+					w.client.shareIndexer.rescanDirs[apath] = struct{}{}
+				}
+				w.client.shareIndexer.schedule()
+			})
+			pending = make(map[string]struct{})
+
+		case <-readDone:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// read reads inotify events and sends the alias paths of the directories
+// that changed.
+func (w *shareWatcher) read(changed chan string, done chan struct{}) {
+	defer close(done)
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			// the queue overflowed, scan all directories again
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				var apaths []string
+				w.mutex.Lock()
+				for _, apath := range w.paths {
+					apaths = append(apaths, apath)
+				}
+				w.mutex.Unlock()
+
+				for _, apath := range apaths {
+					changed <- apath
+				}
+				continue
+			}
+
+			w.mutex.Lock()
+			apath, ok := w.paths[event.Wd]
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				for dpath, wd := range w.watches {
+					if wd == event.Wd {
+						delete(w.watches, dpath)
+					}
+				}
+				delete(w.paths, event.Wd)
+			}
+			w.mutex.Unlock()
+
+			if ok && event.Mask&shareWatchMask != 0 {
+				changed <- apath
+			}
+		}
+	}
+}
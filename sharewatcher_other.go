@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package dctk
+
+import (
+	"fmt"
+)
+
+// shareWatcher is available on Linux only.
+type shareWatcher struct{}
+
+func newShareWatcher(client *Client) (*shareWatcher, error) {
+	return nil, fmt.Errorf("share watching is supported on Linux only")
+}
+
+func (w *shareWatcher) close() {}
+
+func (w *shareWatcher) sync(tree map[string]*shareDirectory, roots map[string]string) {}
+
+func (w *shareWatcher) do() {}
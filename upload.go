@@ -2,10 +2,10 @@ package dctk
 
 import (
 	"bytes"
+	"compress/bzip2"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"os"
 	"strings"
 	"time"
 
@@ -14,37 +14,88 @@ import (
 
 	"github.com/aler9/dctk/pkg/log"
 	"github.com/aler9/dctk/pkg/protoadc"
+	"github.com/aler9/dctk/pkg/protonmdc"
 	"github.com/aler9/dctk/pkg/tiger"
 )
 
 var errorNoSlots = fmt.Errorf("no slots available")
 
+var errorUploadDenied = fmt.Errorf("denied by upload policy")
+
+var errorFileNotAvailable = fmt.Errorf("file not available")
+
+// command used by the peer to request an upload.
+type uploadCmd int
+
+const (
+	// ADC GET or NMDC ADCGET
+	uploadCmdGet uploadCmd = iota
+	// NMDC Get, followed by Send
+	uploadCmdNmdcGet
+	// NMDC UGetBlock, GetZBlock or UGetZBlock
+	uploadCmdNmdcGetBlock
+)
+
+type uploadSlotType int
+
+const (
+	uploadSlotNormal uploadSlotType = iota
+	uploadSlotMini
+	uploadSlotExtra
+	uploadSlotReserved
+)
+
 type upload struct {
 	client             *Client
 	terminateRequested bool
 	state              string
 	pconn              *peerConn
+	cmd                uploadCmd
 	reader             io.ReadCloser
+	file               *shareFile
 	isCompressed       bool
+	sampleCompression  bool
+	slotType           uploadSlotType
 	query              string
 	start              uint64
 	length             uint64
 	offset             uint64
+	wireBytes          uint64
 	lastPrintTime      time.Time
 }
 
 func (*upload) isTransfer() {}
 
+// UploadStats contains statistics about the data sent to other peers.
+type UploadStats struct {
+	// the number of finished uploads
+	Finished uint64
+	// the number of finished uploads whose content has been compressed
+	Compressed uint64
+	// the size of the uploaded content
+	RawBytes uint64
+	// the bytes that passed through the connection
+	WireBytes uint64
+}
+
+// UploadStats returns statistics about the data sent to other peers.
+func (c *Client) UploadStats() UploadStats {
+	return c.uploadStats
+}
+
 func newUpload(client *Client,
 	pconn *peerConn,
+	reqCmd uploadCmd,
 	reqQuery string,
 	reqStart uint64,
 	reqLength int64,
-	reqCompressed bool) bool {
+	reqCompressed bool,
+	reqRecursive bool) bool {
 	u := &upload{
 		client:       client,
 		state:        "processing",
 		pconn:        pconn,
+		cmd:          reqCmd,
 		query:        reqQuery,
 		start:        reqStart,
 		isCompressed: (!client.conf.PeerDisableCompression && reqCompressed),
@@ -53,10 +104,20 @@ func newUpload(client *Client,
 	log.Log(client.conf.LogLevel, log.LevelInfo, "[upload] [%s] request %s (s=%d l=%d)",
 		pconn.peer.Nick, dcReadableQuery(u.query), u.start, reqLength)
 
+	// whether the upload can be served through a mini-slot
+	miniSlotAllowed := false
+
+	// decision of the upload policy
+	decision := UploadAllow
+	denyMsg := ""
+
+	// the share profile of the peer
+	profile := client.shareProfileFor(pconn.peer)
+
 	err := func() error {
-		// check available slots
-		if u.client.uploadSlotAvail <= 0 {
-			return errorNoSlots
+		// a compressed block can't be sent uncompressed
+		if u.cmd == uploadCmdNmdcGetBlock && reqCompressed && !u.isCompressed {
+			return fmt.Errorf("compression is disabled")
 		}
 
 		// upload is file list
@@ -65,47 +126,70 @@ func newUpload(client *Client,
 				return fmt.Errorf("filelist seeking is not supported")
 			}
 
-			u.reader = ioutil.NopCloser(bytes.NewReader(u.client.fileList))
-			u.length = uint64(len(u.client.fileList))
+			u.reader = ioutil.NopCloser(bytes.NewReader(profile.fileList))
+			u.length = uint64(len(profile.fileList))
+			miniSlotAllowed = true
+			u.skipCompression() // already compressed with bzip2
 			return nil
 		}
 
-		if !strings.HasPrefix(u.query, "file TTH/") && !strings.HasPrefix(u.query, "tthl TTH/") {
-			return fmt.Errorf("invalid query")
+		// upload is uncompressed file list, requested by peers that do not support bzip2
+		if u.query == "file files.xml" {
+			if u.start != 0 || reqLength != -1 {
+				return fmt.Errorf("filelist seeking is not supported")
+			}
+
+			cnt, err := ioutil.ReadAll(bzip2.NewReader(bytes.NewReader(profile.fileList)))
+			if err != nil {
+				return err
+			}
+
+			u.reader = ioutil.NopCloser(bytes.NewReader(cnt))
+			u.length = uint64(len(cnt))
+			miniSlotAllowed = true
+			return nil
 		}
 
-		// skip "file TTH/" or "tthl TTH/"
-		tthString := u.query[9:]
+		// upload is partial file list
+		if strings.HasPrefix(u.query, "list /") {
+			if u.start != 0 || reqLength != -1 {
+				return fmt.Errorf("partial list seeking is not supported")
+			}
 
-		// upload is file by TTH or its tthl
-		tth, err := tiger.HashFromBase32(tthString)
-		if err != nil {
-			return err
+			cnt, err := u.client.sharePartialList(profile, strings.TrimPrefix(u.query, "list "), reqRecursive)
+			if err != nil {
+				return err
+			}
+
+			u.reader = ioutil.NopCloser(bytes.NewReader(cnt))
+			u.length = uint64(len(cnt))
+			miniSlotAllowed = true
+			return nil
 		}
 
-		sfile := func() (ret *shareFile) {
-			var scanDir func(dir *shareDirectory) bool
-			scanDir = func(dir *shareDirectory) bool {
-				for _, file := range dir.files {
-					if file.tth == tth {
-						ret = file
-						return true
-					}
-				}
-				for _, sdir := range dir.dirs {
-					if scanDir(sdir) {
-						return true
-					}
-				}
-				return false
+		var sfile *shareFile
+
+		switch {
+		// upload is file by path
+		case strings.HasPrefix(u.query, "file /"):
+			sfile = u.client.shareFileByPath(strings.TrimPrefix(u.query, "file "))
+			if sfile != nil && !profile.visible(sfile.aliasPath) {
+				sfile = nil
 			}
-			for _, dir := range u.client.shareTree {
-				if scanDir(dir) {
-					break
-				}
+
+		// upload is file by TTH or its tthl
+		case strings.HasPrefix(u.query, "file TTH/"), strings.HasPrefix(u.query, "tthl TTH/"):
+			// skip "file TTH/" or "tthl TTH/"
+			tth, err := tiger.HashFromBase32(u.query[9:])
+			if err != nil {
+				return err
 			}
-			return
-		}()
+			sfile = u.client.shareVisibleFileByTTH(profile, tth)
+
+		default:
+			return fmt.Errorf("invalid query")
+		}
+
 		if sfile == nil {
 			return fmt.Errorf("file does not exists")
 		}
@@ -115,34 +199,47 @@ func newUpload(client *Client,
 			if u.start != 0 || reqLength != -1 {
 				return fmt.Errorf("tthl seeking is not supported")
 			}
-			buf := bytes.NewBuffer(nil)
-			for _, leaf := range sfile.tthl {
-				buf.Write(leaf[:])
+			if sfile.provider != nil && sfile.tthl == nil {
+				return fmt.Errorf("tthl is not available")
 			}
-			u.reader = ioutil.NopCloser(buf)
-			u.length = uint64(buf.Len())
-			return nil
-		}
 
-		// open file
-		var f *os.File
-		f, err = os.Open(sfile.realPath)
-		if err != nil {
-			return err
+			// leaves are loaded when the upload starts, since they may be
+			// read from disk or computed again. Their length is known in
+			// advance, unless they are kept in memory
+			count := tiger.LeavesCount(sfile.size, u.client.conf.ShareTTHLDepth)
+			if sfile.tthl != nil {
+				count = len(sfile.tthl.Reduce(u.client.conf.ShareTTHLDepth))
+			}
+			u.length = uint64(count * len(tiger.Hash{}))
+			u.reader = ioutil.NopCloser(&lazyReader{
+				open: func() ([]byte, error) {
+					tthl, err := u.client.shareIndexer.fileLeaves(sfile)
+					if err != nil {
+						return nil, err
+					}
+					buf, err := tthl.SaveToBytes()
+					if err != nil {
+						return nil, err
+					}
+					if uint64(len(buf)) != u.length {
+						return nil, fmt.Errorf("unexpected tthl size")
+					}
+					return buf, nil
+				},
+			})
+			miniSlotAllowed = true
+			u.skipCompression() // hashes can't be compressed
+			return nil
 		}
 
-		// apply start
-		_, err = f.Seek(int64(u.start), 0)
-		if err != nil {
-			f.Close()
-			return err
+		if u.start > sfile.size {
+			return fmt.Errorf("start too big")
 		}
 
 		maxLength := sfile.size - u.start
 		if reqLength != -1 {
 			// check required length
 			if uint64(reqLength) > maxLength {
-				f.Close()
 				return fmt.Errorf("length too big")
 			}
 			u.length = uint64(reqLength)
@@ -151,43 +248,145 @@ func newUpload(client *Client,
 			u.length = maxLength
 		}
 
-		u.reader = f
+		// the file is opened by the upload routine, in order not to access
+		// the disk or the provider while holding the client mutex
+		u.file = sfile
+		miniSlotAllowed = (sfile.size <= u.client.conf.UploadMiniSlotMaxSize)
+
+		if u.isCompressed {
+			if compressionSkipByName(sfile.aliasPath) {
+				u.skipCompression()
+			} else if u.cmd != uploadCmdNmdcGetBlock {
+				// the content is sampled by the upload routine, in order not to
+				// read files while holding the client mutex
+				u.sampleCompression = true
+			}
+		}
 		return nil
 	}()
+
+	// apply upload policy
+	if err == nil {
+		if u.client.conf.UploadPolicy != nil {
+			decision, denyMsg = u.client.conf.UploadPolicy(&UploadRequest{
+				Peer:   pconn.peer,
+				Query:  u.query,
+				Start:  u.start,
+				Length: reqLength,
+			})
+		}
+		if decision == UploadAllow && u.client.uploadHasGrantedSlot(pconn.peer) {
+			decision = UploadAllowExtraSlot
+		}
+		if decision == UploadDeny {
+			u.closeReader()
+			err = errorUploadDenied
+		}
+	}
+
+	// check available slots. Mini-slots are preferred, in order to leave
+	// normal slots to other uploads. Normal slots are assigned to peers
+	// in the upload queue first.
+	if err == nil {
+		switch {
+		case miniSlotAllowed && u.client.uploadMiniSlotAvail > 0:
+			u.slotType = uploadSlotMini
+
+		case decision == UploadAllowReservedSlot && u.client.uploadSlotAvail > 0:
+			u.slotType = uploadSlotReserved
+
+		case u.client.uploadPublicSlotAvail() > u.client.uploadQueueAhead(pconn.peer):
+			u.slotType = uploadSlotNormal
+
+		case decision == UploadAllowExtraSlot:
+			u.slotType = uploadSlotExtra
+
+		default:
+			u.closeReader()
+			err = errorNoSlots
+		}
+
+		// the peer is not waiting anymore, whatever slot it got
+		if err == nil {
+			u.client.uploadQueueRemove(pconn.peer)
+		}
+	}
+
 	if err != nil {
 		log.Log(u.client.conf.LogLevel, log.LevelInfo, "[peer] cannot start upload: %s", err)
-		if err == errorNoSlots {
+		if err == errorUploadDenied {
+			if denyMsg == "" {
+				denyMsg = "Access denied"
+			}
 			if u.client.protoIsAdc() {
 				u.pconn.conn.Write(&protoadc.AdcCStatus{ //nolint:govet
 					&adc.ClientPacket{},
-					&adc.Status{
+					&protoadc.AdcStatus{Status: adc.Status{
 						Sev:  adc.Recoverable,
-						Code: protoadc.AdcCodeSlotsFull,
-						Msg:  "Slots full",
-					},
+						Code: protoadc.AdcCodeAccessDenied,
+						Msg:  denyMsg,
+					}},
 				})
 			} else {
-				u.pconn.conn.Write(&nmdc.MaxedOut{})
+				u.writeNmdcError(fmt.Errorf("%s", denyMsg))
 			}
-		} else {
+		} else if err == errorNoSlots {
+			// put peer in queue
+			queuePos := u.client.uploadQueueAdd(pconn.peer)
+
 			if u.client.protoIsAdc() {
 				u.pconn.conn.Write(&protoadc.AdcCStatus{ //nolint:govet
 					&adc.ClientPacket{},
-					&adc.Status{
-						Sev:  adc.Recoverable,
-						Code: protoadc.AdcCodeFileNotAvailable,
-						Msg:  "File Not Available",
+					&protoadc.AdcStatus{
+						Status: adc.Status{
+							Sev:  adc.Recoverable,
+							Code: protoadc.AdcCodeSlotsFull,
+							Msg:  "Slots full",
+						},
+						QueuePosition: queuePos,
 					},
 				})
 			} else {
-				u.pconn.conn.Write(&nmdc.Error{Err: fmt.Errorf("File Not Available")})
+				u.pconn.conn.Write(&protonmdc.NmdcMaxedOut{QueuePosition: queuePos})
 			}
+		} else {
+			u.writeNotAvailable()
 		}
 		return false
 	}
 
+	// the response is sent after opening and sampling the file, since
+	// the file may be unavailable and sampling sets the compression flag
+	if !u.responseDeferred() {
+		u.writeResponse()
+	}
+
+	client.transfers[u] = struct{}{}
+	switch u.slotType {
+	case uploadSlotNormal:
+		u.client.uploadSlotAvail--
+	case uploadSlotMini:
+		u.client.uploadMiniSlotAvail--
+	case uploadSlotReserved:
+		u.client.uploadSlotAvail--
+		u.client.uploadReservedUsed++
+	}
+	if u.slotType != uploadSlotExtra {
+		u.client.uploadSlotsChanged()
+	}
+	u.pconn.transfer = u
+	if u.cmd == uploadCmdNmdcGet {
+		u.pconn.setBusy("wait_send")
+	} else {
+		u.pconn.setBusy("delegated_upload")
+	}
+	return true
+}
+
+// writeResponse informs the peer that the content is about to be sent.
+func (u *upload) writeResponse() {
 	if u.client.protoIsAdc() {
-		queryParts := strings.Split(u.query, " ")
+		queryParts := strings.SplitN(u.query, " ", 2)
 		u.pconn.conn.Write(&protoadc.AdcCSendFile{ //nolint:govet
 			&adc.ClientPacket{},
 			&adc.GetResponse{
@@ -200,21 +399,95 @@ func newUpload(client *Client,
 		})
 
 	} else {
-		queryParts := strings.Split(u.query, " ")
-		u.pconn.conn.Write(&nmdc.ADCSnd{
-			ContentType: nmdc.String(queryParts[0]),
-			Identifier:  nmdc.String(queryParts[1]),
-			Start:       u.start,
-			Length:      u.length,
-			Compressed:  u.isCompressed,
+		switch u.cmd {
+		case uploadCmdGet:
+			queryParts := strings.SplitN(u.query, " ", 2)
+			u.pconn.conn.Write(&protonmdc.NmdcAdcSnd{ADCSnd: nmdc.ADCSnd{
+				ContentType: nmdc.String(queryParts[0]),
+				Identifier:  nmdc.String(queryParts[1]),
+				Start:       u.start,
+				Length:      u.length,
+				Compressed:  u.isCompressed,
+			}})
+
+		case uploadCmdNmdcGet:
+			// FileLength contains the entire file size
+			u.pconn.conn.Write(&protonmdc.NmdcFileLength{Length: u.start + u.length})
+
+		case uploadCmdNmdcGetBlock:
+			u.pconn.conn.Write(&protonmdc.NmdcSending{Length: int64(u.length)})
+		}
+	}
+}
+
+// responseDeferred returns whether the response is sent by the upload routine.
+// NMDC Get is answered immediately, since the upload starts after Send.
+func (u *upload) responseDeferred() bool {
+	return (u.file != nil || u.sampleCompression) && u.cmd != uploadCmdNmdcGet
+}
+
+func (u *upload) writeNotAvailable() {
+	if u.client.protoIsAdc() {
+		u.pconn.conn.Write(&protoadc.AdcCStatus{ //nolint:govet
+			&adc.ClientPacket{},
+			&protoadc.AdcStatus{Status: adc.Status{
+				Sev:  adc.Recoverable,
+				Code: protoadc.AdcCodeFileNotAvailable,
+				Msg:  "File Not Available",
+			}},
 		})
+	} else {
+		u.writeNmdcError(fmt.Errorf("File Not Available"))
 	}
+}
 
-	client.transfers[u] = struct{}{}
-	u.client.uploadSlotAvail--
-	u.pconn.state = "delegated_upload"
-	u.pconn.transfer = u
-	return true
+// sampleContent reads a sample of the content, in order to decide whether
+// compression is worth it, and puts it back in front of the content.
+func (u *upload) sampleContent() error {
+	sample := make([]byte, compressionSampleSize)
+	if u.length < compressionSampleSize {
+		sample = sample[:u.length]
+	}
+	n, err := io.ReadFull(u.reader, sample)
+	if err != nil {
+		return err
+	}
+	sample = sample[:n]
+
+	u.reader = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(sample), u.reader), u.reader}
+
+	if compressionSkipByContent(sample, u.client.conf.PeerCompressionLevel) {
+		u.skipCompression()
+	}
+	return nil
+}
+
+// skipCompression sends the content uncompressed even if the peer asked for
+// compression, when it is allowed by the command.
+func (u *upload) skipCompression() {
+	if u.cmd != uploadCmdNmdcGetBlock {
+		u.isCompressed = false
+	}
+}
+
+// legacy NMDC block commands report errors with Failed instead of Error.
+func (u *upload) writeNmdcError(err error) {
+	if u.cmd == uploadCmdNmdcGetBlock {
+		u.pconn.conn.Write(&nmdc.Failed{Err: err})
+	} else {
+		u.pconn.conn.Write(&nmdc.Error{Err: err})
+	}
+}
+
+// nmdcLegacyQuery converts a file name used by legacy NMDC commands into a query.
+func nmdcLegacyQuery(filename string) string {
+	if filename == "files.xml.bz2" || filename == "files.xml" {
+		return "file " + filename
+	}
+	return "file /" + strings.ReplaceAll(filename, "\\", "/")
 }
 
 func (u *upload) Close() {
@@ -225,10 +498,43 @@ func (u *upload) Close() {
 	u.pconn.close()
 }
 
+// closeReader closes the content, if it has been opened.
+func (u *upload) closeReader() {
+	if u.reader != nil {
+		u.reader.Close()
+	}
+}
+
 func (u *upload) handleUpload() error {
+	if u.file != nil {
+		f, err := u.file.open(u.start)
+		if err != nil {
+			// the connection can be used again if the peer has not been
+			// informed that the content is about to be sent
+			if u.responseDeferred() {
+				log.Log(u.client.conf.LogLevel, log.LevelInfo, "[peer] cannot start upload: %s", err)
+				u.writeNotAvailable()
+				return errorFileNotAvailable
+			}
+			return err
+		}
+		u.reader = f
+	}
+
+	if u.sampleCompression {
+		if err := u.sampleContent(); err != nil {
+			return err
+		}
+	}
+
+	if u.responseDeferred() {
+		u.writeResponse()
+	}
+
 	u.pconn.conn.SetSyncMode(true)
+	u.pconn.conn.PullWriteCounter() // exclude messages sent before the content
 	if u.isCompressed {
-		u.pconn.conn.EnableWriterZlib()
+		u.pconn.conn.EnableWriterZlibLevel(u.client.conf.PeerCompressionLevel)
 	}
 
 	u.lastPrintTime = time.Now()
@@ -262,7 +568,9 @@ func (u *upload) handleUpload() error {
 		since := time.Since(u.lastPrintTime)
 		if since >= (1 * time.Second) {
 			u.lastPrintTime = time.Now()
-			speed := float64(u.pconn.conn.PullWriteCounter()) / 1024 / (float64(since) / float64(time.Second))
+			written := u.pconn.conn.PullWriteCounter()
+			u.wireBytes += uint64(written)
+			speed := float64(written) / 1024 / (float64(since) / float64(time.Second))
 			log.Log(u.client.conf.LogLevel, log.LevelInfo, "[sent] %d/%d (%.1f KiB/s)", u.offset, u.length, speed)
 		}
 	}
@@ -270,6 +578,7 @@ func (u *upload) handleUpload() error {
 	if u.isCompressed {
 		u.pconn.conn.DisableWriterZlib()
 	}
+	u.wireBytes += uint64(u.pconn.conn.PullWriteCounter())
 	u.pconn.conn.SetSyncMode(false)
 
 	return nil
@@ -282,13 +591,36 @@ func (u *upload) handleExit(err error) {
 
 	delete(u.client.transfers, u)
 
-	u.reader.Close()
+	u.closeReader()
+
+	switch u.slotType {
+	case uploadSlotNormal:
+		u.client.uploadSlotAvail++
+	case uploadSlotMini:
+		u.client.uploadMiniSlotAvail++
+	case uploadSlotReserved:
+		u.client.uploadSlotAvail++
+		u.client.uploadReservedUsed--
+	}
+	if u.slotType != uploadSlotExtra {
+		u.client.uploadSlotsChanged()
+	}
 
-	u.client.uploadSlotAvail++
+	u.client.uploadStats.RawBytes += u.offset
+	u.client.uploadStats.WireBytes += u.wireBytes
 
 	if err == nil {
-		log.Log(u.client.conf.LogLevel, log.LevelInfo, "[upload] [%s] finished %s (s=%d l=%d)",
-			u.pconn.peer.Nick, dcReadableQuery(u.query), u.start, u.length)
+		u.client.uploadStats.Finished++
+		if u.isCompressed {
+			u.client.uploadStats.Compressed++
+		}
+		log.Log(u.client.conf.LogLevel, log.LevelInfo, "[upload] [%s] finished %s (s=%d l=%d, sent %d bytes%s)",
+			u.pconn.peer.Nick, dcReadableQuery(u.query), u.start, u.length, u.wireBytes, func() string {
+				if u.isCompressed {
+					return " compressed"
+				}
+				return ""
+			}())
 	} else {
 		log.Log(u.client.conf.LogLevel, log.LevelInfo, "[upload] [%s] failed %s",
 			u.pconn.peer.Nick, dcReadableQuery(u.query))
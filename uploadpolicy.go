@@ -0,0 +1,217 @@
+package dctk
+
+import (
+	"sync"
+	"time"
+)
+
+// UploadDecision is the decision taken by an UploadPolicy about an upload request.
+type UploadDecision int
+
+const (
+	// UploadAllow allows the upload, if a slot is available.
+	UploadAllow UploadDecision = iota
+	// UploadDeny denies the upload.
+	UploadDeny
+	// UploadAllowExtraSlot allows the upload through an extra slot, even if
+	// all slots are busy.
+	UploadAllowExtraSlot
+	// UploadAllowReservedSlot allows the upload through one of the slots
+	// reserved with ClientConf.UploadReservedSlots, or through a normal slot
+	// if they are all busy. The upload queue is skipped.
+	UploadAllowReservedSlot
+)
+
+// UploadRequest contains the parameters of an incoming upload request.
+type UploadRequest struct {
+	// peer that is requesting the upload
+	Peer *Peer
+	// requested query, i.e. "file files.xml.bz2", "file TTH/..." or "tthl TTH/..."
+	Query string
+	// requested start
+	Start uint64
+	// requested length, -1 means until the end of the file
+	Length int64
+}
+
+// UploadPolicy is a function that decides whether an upload request can be
+// served. If the request is denied, the returned message is sent to the peer.
+// It is called inside the client mutex.
+type UploadPolicy func(req *UploadRequest) (UploadDecision, string)
+
+// UploadPolicyChain returns a policy that applies the given policies in order,
+// and returns the first decision that is not UploadAllow.
+func UploadPolicyChain(policies ...UploadPolicy) UploadPolicy {
+	return func(req *UploadRequest) (UploadDecision, string) {
+		for _, p := range policies {
+			if dec, msg := p(req); dec != UploadAllow {
+				return dec, msg
+			}
+		}
+		return UploadAllow, ""
+	}
+}
+
+// UploadPolicyOperatorsOnly returns a policy that allows uploads to operators only.
+func UploadPolicyOperatorsOnly() UploadPolicy {
+	return func(req *UploadRequest) (UploadDecision, string) {
+		if !req.Peer.IsOperator {
+			return UploadDeny, "Operators only"
+		}
+		return UploadAllow, ""
+	}
+}
+
+// UploadPolicyRegisteredOnly returns a policy that allows uploads to
+// registered peers only.
+func UploadPolicyRegisteredOnly() UploadPolicy {
+	return func(req *UploadRequest) (UploadDecision, string) {
+		if !req.Peer.IsRegistered {
+			return UploadDeny, "Registered users only"
+		}
+		return UploadAllow, ""
+	}
+}
+
+// UploadPolicyMinShare returns a policy that allows uploads to peers that
+// share at least the given size, in bytes. File lists are always allowed,
+// in order to let peers browse the share.
+func UploadPolicyMinShare(size uint64) UploadPolicy {
+	return func(req *UploadRequest) (UploadDecision, string) {
+		isFileList := (req.Query == "file files.xml.bz2" || req.Query == "file files.xml")
+		if !isFileList && req.Peer.ShareSize < size {
+			return UploadDeny, "Share size too small"
+		}
+		return UploadAllow, ""
+	}
+}
+
+// UploadBanList is a list of banned peers, that can be used as an UploadPolicy
+// through its Policy() method. Its methods can be called from any goroutine.
+type UploadBanList struct {
+	mutex sync.Mutex
+	nicks map[string]struct{}
+	cids  map[string]struct{}
+	ips   map[string]struct{}
+}
+
+// NewUploadBanList allocates an UploadBanList.
+func NewUploadBanList() *UploadBanList {
+	return &UploadBanList{
+		nicks: make(map[string]struct{}),
+		cids:  make(map[string]struct{}),
+		ips:   make(map[string]struct{}),
+	}
+}
+
+// BanNick bans a peer by nickname.
+func (b *UploadBanList) BanNick(nick string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.nicks[nick] = struct{}{}
+}
+
+// UnbanNick removes a nickname from the list.
+func (b *UploadBanList) UnbanNick(nick string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.nicks, nick)
+}
+
+// BanCID bans a peer by client ID, encoded in base32 (ADC only).
+func (b *UploadBanList) BanCID(cid string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.cids[cid] = struct{}{}
+}
+
+// UnbanCID removes a client ID from the list.
+func (b *UploadBanList) UnbanCID(cid string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.cids, cid)
+}
+
+// BanIP bans a peer by IP.
+func (b *UploadBanList) BanIP(ip string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.ips[ip] = struct{}{}
+}
+
+// UnbanIP removes an IP from the list.
+func (b *UploadBanList) UnbanIP(ip string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.ips, ip)
+}
+
+// IsBanned checks whether a peer is banned.
+func (b *UploadBanList) IsBanned(peer *Peer) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.nicks[peer.Nick]; ok {
+		return true
+	}
+	if peer.IP != "" {
+		if _, ok := b.ips[peer.IP]; ok {
+			return true
+		}
+	}
+	if !peer.adcClientID.IsZero() {
+		if _, ok := b.cids[peer.adcClientID.String()]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Policy returns an UploadPolicy that denies uploads to banned peers.
+func (b *UploadBanList) Policy() UploadPolicy {
+	return func(req *UploadRequest) (UploadDecision, string) {
+		if b.IsBanned(req.Peer) {
+			return UploadDeny, "Banned"
+		}
+		return UploadAllow, ""
+	}
+}
+
+// UploadGrantSlot grants an extra upload slot to a peer for the given duration.
+// During this period, the peer can download even if all slots are busy.
+func (c *Client) UploadGrantSlot(peer *Peer, duration time.Duration) {
+	c.uploadGrantedSlots[peer.Nick] = time.Now().Add(duration)
+}
+
+// UploadUngrantSlot removes an extra upload slot granted previously to a peer.
+func (c *Client) UploadUngrantSlot(peer *Peer) {
+	delete(c.uploadGrantedSlots, peer.Nick)
+}
+
+func (c *Client) uploadHasGrantedSlot(peer *Peer) bool {
+	expire, ok := c.uploadGrantedSlots[peer.Nick]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expire) {
+		delete(c.uploadGrantedSlots, peer.Nick)
+		return false
+	}
+	return true
+}
+
+// uploadPublicSlotAvail returns the number of available slots that can be
+// used by any peer, i.e. that are not reserved.
+func (c *Client) uploadPublicSlotAvail() uint {
+	reserved := c.conf.UploadReservedSlots
+	if c.uploadReservedUsed >= reserved {
+		reserved = 0
+	} else {
+		reserved -= c.uploadReservedUsed
+	}
+
+	if c.uploadSlotAvail <= reserved {
+		return 0
+	}
+	return c.uploadSlotAvail - reserved
+}
@@ -0,0 +1,111 @@
+package dctk
+
+import (
+	"time"
+)
+
+// peers that are waiting for a slot usually renew their requests every
+// minute. Entries that were not renewed for twice this period are not taken
+// into account when assigning slots, but keep their position until they
+// expire.
+const uploadQueueStalePeriod = 2 * time.Minute
+
+// the upload queue is ordered by arrival, therefore the first entry is the
+// longest waiter.
+type uploadQueueEntry struct {
+	key      string
+	lastSeen time.Time
+}
+
+// peers are identified by CID when available (ADC), otherwise by nick.
+func uploadQueueKey(peer *Peer) string {
+	if !peer.adcClientID.IsZero() {
+		return peer.adcClientID.String()
+	}
+	return peer.Nick
+}
+
+// uploadQueuePurge removes entries that were not renewed in time.
+func (c *Client) uploadQueuePurge() {
+	now := time.Now()
+	n := 0
+	for _, e := range c.uploadQueue {
+		if now.Sub(e.lastSeen) < c.conf.UploadQueueExpiry {
+			c.uploadQueue[n] = e
+			n++
+		}
+	}
+	for i := n; i < len(c.uploadQueue); i++ {
+		c.uploadQueue[i] = nil
+	}
+	c.uploadQueue = c.uploadQueue[:n]
+}
+
+// uploadQueueIndex returns the index of a peer in the upload queue, or -1.
+func (c *Client) uploadQueueIndex(peer *Peer) int {
+	key := uploadQueueKey(peer)
+	for i, e := range c.uploadQueue {
+		if e.key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// uploadQueueAhead returns the number of peers that are waiting for a slot
+// before the given peer. Stale entries are not counted.
+func (c *Client) uploadQueueAhead(peer *Peer) uint {
+	if c.conf.UploadQueueMaxLen == 0 {
+		return 0
+	}
+
+	c.uploadQueuePurge()
+
+	now := time.Now()
+	key := uploadQueueKey(peer)
+	n := uint(0)
+	for _, e := range c.uploadQueue {
+		if e.key == key {
+			break
+		}
+		if now.Sub(e.lastSeen) < uploadQueueStalePeriod {
+			n++
+		}
+	}
+	return n
+}
+
+// uploadQueueAdd puts a peer in the upload queue, or renews its entry, and
+// returns its position (starting from 1). It returns zero if the queue is
+// disabled or full.
+func (c *Client) uploadQueueAdd(peer *Peer) int {
+	if c.conf.UploadQueueMaxLen == 0 {
+		return 0
+	}
+
+	c.uploadQueuePurge()
+
+	now := time.Now()
+
+	if i := c.uploadQueueIndex(peer); i >= 0 {
+		c.uploadQueue[i].lastSeen = now
+		return int(c.uploadQueueAhead(peer)) + 1
+	}
+
+	if uint(len(c.uploadQueue)) >= c.conf.UploadQueueMaxLen {
+		return 0
+	}
+
+	c.uploadQueue = append(c.uploadQueue, &uploadQueueEntry{
+		key:      uploadQueueKey(peer),
+		lastSeen: now,
+	})
+	return int(c.uploadQueueAhead(peer)) + 1
+}
+
+// uploadQueueRemove removes a peer from the upload queue.
+func (c *Client) uploadQueueRemove(peer *Peer) {
+	if i := c.uploadQueueIndex(peer); i >= 0 {
+		c.uploadQueue = append(c.uploadQueue[:i], c.uploadQueue[i+1:]...)
+	}
+}
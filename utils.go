@@ -1,6 +1,7 @@
 package dctk
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"math/rand"
@@ -21,14 +22,16 @@ func dcReadableQuery(request string) string {
 	if strings.HasPrefix(request, "file TTH/") {
 		return "tth/" + strings.TrimPrefix(request, "file TTH/")
 	}
-	if request == "file files.xml.bz2" {
+	if request == "file files.xml.bz2" || request == "file files.xml" {
 		return "filelist"
 	}
+	if strings.HasPrefix(request, "list ") {
+		return "list" + strings.TrimPrefix(request, "list ")
+	}
 	return "\"" + request + "\""
 }
 
 func randomInt(min, max int) int {
-	rand.Seed(time.Now().Unix())
 	return rand.Intn(max-min) + min
 }
 
@@ -90,3 +93,20 @@ func (rc *bytesWriteCloser) Write(in []byte) (int, error) {
 func (rc *bytesWriteCloser) Close() error {
 	return nil
 }
+
+// lazyReader loads its content at the first read.
+type lazyReader struct {
+	open func() ([]byte, error)
+	r    io.Reader
+}
+
+func (lr *lazyReader) Read(p []byte) (int, error) {
+	if lr.r == nil {
+		buf, err := lr.open()
+		if err != nil {
+			return 0, err
+		}
+		lr.r = bytes.NewReader(buf)
+	}
+	return lr.r.Read(p)
+}